@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/richinsley/whet/pkg"
+)
+
+// exit codes of the whet subcommands
+const (
+	exitOK = 0
+	// exitError is any failure not covered by a more specific code
+	exitError = 1
+	// exitUsage is an invalid command line
+	exitUsage = 2
+	// exitAuth is a request rejected by the server as unauthorized or forbidden
+	exitAuth = 3
+	// exitNotFound is an unknown target, session or token
+	exitNotFound = 4
+	// exitUnavailable is a server that can't be reached, is rate limiting the client or
+	// failed to connect to the target, a failure worth retrying later
+	exitUnavailable = 5
+)
+
+// apiError is an unsuccessful response from the server API
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("server returned %d %s", e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("server returned %d: %s", e.status, e.message)
+}
+
+// exitStatus maps the error of a command to its exit code
+func exitStatus(err error) int {
+	status := 0
+	var ae *apiError
+	var se *pkg.SignalError
+	var ne net.Error
+	var oe *net.OpError
+	switch {
+	case errors.As(err, &ae):
+		status = ae.status
+	case errors.As(err, &se):
+		status = se.StatusCode
+		// the signaling endpoint rejects unknown targets and offsets as bad requests
+		if status == http.StatusBadRequest {
+			return exitNotFound
+		}
+	case errors.As(err, &oe), errors.As(err, &ne):
+		return exitUnavailable
+	}
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitAuth
+	case http.StatusNotFound:
+		return exitNotFound
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return exitUnavailable
+	}
+	return exitError
+}
+
+// apiURL joins the server address and an API path, defaulting to http if the
+// address has no scheme.  The API of a server given as ws:// or wss:// for signaling is
+// on http:// or https://.
+func apiURL(server string, path string) string {
+	if pkg.IsSocketURL(server) {
+		server = "http" + strings.TrimPrefix(server, "ws")
+	}
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		server = "http://" + server
+	}
+	return strings.TrimSuffix(server, "/") + path
+}
+
+// apiRequest calls the server API, sending in as the JSON body if it is not nil and
+// decoding the JSON response into out if it is not nil
+func apiRequest(server string, token string, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	server, err := resolveServer(server)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, apiURL(server, path), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &apiError{status: resp.StatusCode, message: strings.TrimSpace(string(msg))}
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("invalid response from server: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,820 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"github.com/richinsley/whet/pkg"
+)
+
+// command is a whet subcommand, e.g. 'whet serve'
+type command struct {
+	name    string
+	summary string
+	run     func(name string, args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"serve", "Run a whet server forwarding targets to clients", serveCommand},
+		{"connect", "Forward local ports to targets on a whet server", connectCommand},
+		{"stdio", "Connect stdin and stdout to a target, e.g. as an SSH ProxyCommand", stdioCommand},
+		{"offer", "Offer a target to a peer by copy and paste, without a server", offerCommand},
+		{"answer", "Answer a peer's offer and serve the target it opens", answerCommand},
+		{"discover", "Find the whet servers advertised on the local network", discoverCommand},
+		{"status", "Check a server is up and show its targets and sessions", statusCommand},
+		{"ls", "List the targets a token may open on a server", lsCommand},
+		{"token", "Create, list and revoke named tokens", tokenCommand},
+		{"sessions", "List the open sessions of a server", sessionsCommand},
+		{"kill", "Close sessions on a server", killCommand},
+		{"help", "Show help for a command", helpCommand},
+	}
+}
+
+// usage prints the list of subcommands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: whet <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'whet help <command>' for the flags of a command.  The original")
+	fmt.Fprintln(w, "single flag set, e.g. 'whet -serve -tcptarget ssh=localhost:22', still works.")
+}
+
+// runCommand runs the named subcommand and returns its exit code
+func runCommand(name string, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(name, args)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "whet: unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return exitUsage
+}
+
+// newFlagSet creates the flag set of a subcommand with its own help text
+func newFlagSet(name string, arguments string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet("whet "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: whet %s [flags] %s\n\n%s\n\nFlags:\n", name, arguments, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses the arguments of a subcommand, returning false and the exit code
+// if the command should not run
+func parseFlags(fs *flag.FlagSet, args []string) (bool, int) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return false, exitOK
+		}
+		return false, exitUsage
+	}
+	return true, exitOK
+}
+
+// fail reports the error of a subcommand and returns its exit code
+func fail(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "whet %s: %v\n", name, err)
+	return exitStatus(err)
+}
+
+// usageError reports an invalid command line
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) int {
+	fmt.Fprintf(fs.Output(), "%s: %s\n", fs.Name(), fmt.Sprintf(format, args...))
+	fs.Usage()
+	return exitUsage
+}
+
+// envDefault returns the value of the environment variable, or def if it is not set
+func envDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// addClientFlags adds the flags every client command uses to reach a server
+func addClientFlags(fs *flag.FlagSet) (server *string, token *string) {
+	server = fs.String("server", envDefault("WHET_SERVER", "localhost:8080"), "Server address or URL, ws:// or wss:// to signal over one WebSocket, whet://name.local for a server found by 'whet discover', $WHET_SERVER if set")
+	token = fs.String("token", os.Getenv("WHET_TOKEN"), "Bearer token for authorization, $WHET_TOKEN if set")
+	return server, token
+}
+
+// resolveServer returns the address of a server given as whet://server or
+// whets://server, looking up whet://name.local on the local network
+func resolveServer(server string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return pkg.ResolveServer(ctx, server, true)
+}
+
+// serverArg lets client commands take the server as an optional argument
+func serverArg(fs *flag.FlagSet, server *string) string {
+	if fs.NArg() > 0 {
+		return fs.Arg(0)
+	}
+	return *server
+}
+
+// sessionArgs splits the arguments of a command taking an optional server followed by
+// session ids, a first argument that isn't a session id is the server
+func sessionArgs(fs *flag.FlagSet, server *string) (string, []string) {
+	args := fs.Args()
+	if len(args) > 0 {
+		if _, err := uuid.Parse(args[0]); err != nil {
+			return args[0], args[1:]
+		}
+	}
+	return *server, args
+}
+
+func serveCommand(name string, args []string) int {
+	fs := newFlagSet(name, "", "Run a whet server that forwards its targets to whet clients and browsers.")
+	listen := fs.String("listen", "localhost:8080", "Address the server listens on")
+	ngrokMode := fs.Bool("ngrok", false, "Listen on an ngrok endpoint instead, using $NGROK_AUTHTOKEN and $NGROK_DOMAIN")
+	token := fs.String("token", os.Getenv("WHET_TOKEN"), "Bearer token clients must present, $WHET_TOKEN if set")
+	gentoken := fs.Bool("gentoken", false, "Generate a bearer token and print it")
+	// the server always detaches its data channels, so this defaults to true here
+	detached := fs.Bool("detached", true, "Detach data channels")
+	mirror := fs.String("mirror", "", "Simple mirror server address (for testing)")
+	configFile := fs.String("config", "", "YAML configuration file describing the server (reloaded on SIGHUP)")
+	sf := addServerFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument %q", fs.Arg(0))
+	}
+
+	if *gentoken {
+		bearerToken = uuid.New().String()
+		fmt.Printf("Generated new bearer token: %s\n", bearerToken)
+	} else {
+		bearerToken = *token
+	}
+
+	if *configFile != "" {
+		runFromConfig(*configFile)
+		return exitOK
+	}
+
+	targets, opts, err := sf.build()
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+	go opts.reloadOnSignal()
+
+	if *mirror != "" {
+		go pkg.SimpleMirrorServer(*mirror)
+	}
+
+	if *ngrokMode {
+		runServerNGROK(context.Background(), targets, sf.serveFolders, sf.proxyTargets, opts, *detached)
+	} else {
+		runServer(*listen, targets, sf.serveFolders, sf.proxyTargets, opts, *detached)
+	}
+	return exitOK
+}
+
+func connectCommand(name string, args []string) int {
+	fs := newFlagSet(name, "listener...", `Listen on local ports and forward each connection to a target on the server.
+A listener is 'target=host:port', 'target-offset=host:port' for one port of a
+range target, 'target=host:start-end' for consecutive ports of a range target,
+or 'target=unix:/path?mode=0600' to create a unix socket.  Add '?tls' to accept
+TLS with a self-signed certificate or '?cert=file&key=file' to use your own.
+With -all a listener is created on an automatically assigned local port for
+every target the token may open.`)
+	server, token := addClientFlags(fs)
+	// the server always detaches its data channels, so this defaults to true here
+	detached := fs.Bool("detached", true, "Detach data channels")
+	all := fs.Bool("all", false, "Listen for every target the token may open")
+	bind := fs.String("bind", "127.0.0.1", "Local address the -all listeners bind to")
+	var tcplisteners targetAddrList
+	fs.Var(&tcplisteners, "tcplisten", "Listener, as an alternative to the arguments (can specify multiple)")
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	specs := append(tcplisteners, fs.Args()...)
+	if len(specs) == 0 && !*all {
+		return usageError(fs, "no listeners specified")
+	}
+	listeners, err := pkg.ParseListenTargetPortsFromStringSlice(specs)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+
+	if *all {
+		var targets []pkg.TargetInfo
+		if err := apiRequest(*server, *token, "GET", "/api/targets", nil, &targets); err != nil {
+			return fail(name, err)
+		}
+		for _, l := range allListeners(targets, *bind) {
+			if _, ok := listeners[l.TargetPath()]; !ok {
+				listeners[l.TargetPath()] = l
+			}
+		}
+		if len(listeners) == 0 {
+			fmt.Fprintf(os.Stderr, "whet %s: the token may not open any targets\n", name)
+			return exitNotFound
+		}
+	}
+
+	signalServer, err := resolveServer(*server)
+	if err != nil {
+		return fail(name, err)
+	}
+	runClient(signalServer, listeners, *token, *detached)
+	return exitOK
+}
+
+// allListeners creates a listener on a system assigned local port for every port of
+// the targets
+func allListeners(targets []pkg.TargetInfo, bind string) []*pkg.ListenTargetPort {
+	var retv []*pkg.ListenTargetPort
+	for _, t := range targets {
+		for offset := 0; offset < t.Ports; offset++ {
+			retv = append(retv, &pkg.ListenTargetPort{
+				TargetName: t.Name,
+				LocalHost:  bind,
+				LocalPort:  0,
+				PortIndex:  offset,
+			})
+		}
+	}
+	return retv
+}
+
+func stdioCommand(name string, args []string) int {
+	fs := newFlagSet(name, "target", `Connect stdin and stdout to a target without binding a local port, e.g. as an
+SSH ProxyCommand:
+
+  ssh -o ProxyCommand='whet stdio --server https://whet.example.com ssh' host
+  GIT_SSH_COMMAND="ssh -o ProxyCommand='whet stdio ssh'" git clone host:repo
+
+Only the target's data is written to stdout, errors go to stderr.  The exit code
+is 0 when the target closes the connection, 1 on other errors, 2 for an invalid
+command line, 3 when the token is rejected, 4 for an unknown target and 5 when the
+server can't be reached or is rate limiting the client.`)
+	server, token := addClientFlags(fs)
+	verbose := fs.Bool("v", false, "Log connection details to stderr")
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one target")
+	}
+
+	// stdout carries the target's data
+	stdout, err := redirectLogging(*verbose)
+	if err != nil {
+		return fail(name, err)
+	}
+
+	signalServer, err := resolveServer(*server)
+	if err != nil {
+		return fail(name, err)
+	}
+	conn, err := pkg.DialWebRTCConn(signalServer, "whet/"+fs.Arg(0), *token, true)
+	if err != nil {
+		return fail(name, err)
+	}
+	defer conn.Close()
+
+	// when stdin ends, half-close the connection so the target sees EOF but can
+	// still reply, e.g. git pushing over ssh
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "whet %s: %v\n", name, err)
+		}
+		conn.CloseWrite()
+	}()
+
+	// the session is over when the target closes its side
+	if _, err := io.Copy(stdout, conn); err != nil {
+		return fail(name, err)
+	}
+	return exitOK
+}
+
+// redirectLogging sends the whet package's logging, which is written to stdout, to
+// stderr when verbose or nowhere, returning the original stdout
+func redirectLogging(verbose bool) (*os.File, error) {
+	stdout := os.Stdout
+	if verbose {
+		os.Stdout = os.Stderr
+		return stdout, nil
+	}
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	os.Stdout = devnull
+	log.SetOutput(io.Discard)
+	return stdout, nil
+}
+
+// closeOnSignal closes a session signaled by hand on exit so the peer sees it end
+func closeOnSignal(session io.Closer) {
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		session.Close()
+		os.Exit(exitOK)
+	}()
+}
+
+// addManualFlags adds the flags of the commands signaled by hand
+func addManualFlags(fs *flag.FlagSet) *pkg.ManualSignaling {
+	m := &pkg.ManualSignaling{ICEServers: []webrtc.ICEServer{}}
+	fs.Func("stun", "Comma separated STUN servers, e.g. stun:stun.example.com:3478 (default host candidates only)", func(s string) error {
+		m.ICEServers = []webrtc.ICEServer{{URLs: splitList(s)}}
+		return nil
+	})
+	fs.DurationVar(&m.Timeout, "timeout", 10*time.Minute, "How long to wait for the peer to connect, and for a lost peer to come back")
+	return m
+}
+
+func offerCommand(name string, args []string) int {
+	fs := newFlagSet(name, "target", `Open a target of a peer without a signal server, e.g. in an air-gapped lab.
+The offer is printed to stdout as one line of text.  Give it to the peer, who
+runs 'whet answer' with the target, then paste their answer here.  Connections to
+the local listener are forwarded to the target until either side exits:
+
+  whet offer -listen 127.0.0.1:2222 ssh
+  whet answer -tcptarget ssh=localhost:22
+
+The target is a name, or name-offset for one port of a range target.`)
+	listen := fs.String("listen", "127.0.0.1:0", "Local address forwarded to the target")
+	verbose := fs.Bool("v", false, "Log connection details to stderr")
+	m := addManualFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one target")
+	}
+
+	stdout, err := redirectLogging(*verbose)
+	if err != nil {
+		return fail(name, err)
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fail(name, err)
+	}
+	defer l.Close()
+
+	offer, err := m.Offer(fs.Arg(0))
+	if err != nil {
+		return fail(name, err)
+	}
+	defer offer.Close()
+	closeOnSignal(offer)
+	fmt.Fprintln(stdout, offer.Blob())
+	fmt.Fprintln(os.Stderr, "Give the offer above to the peer and paste their answer:")
+
+	answer, err := pkg.ReadManualBlob(os.Stdin)
+	if err != nil {
+		return fail(name, err)
+	}
+	if err := offer.Accept(answer); err != nil {
+		return fail(name, err)
+	}
+	select {
+	case <-offer.Connected():
+	case <-offer.Done():
+		return fail(name, errors.New("the peer did not connect"))
+	}
+	fmt.Fprintf(os.Stderr, "Connected, forwarding %s to %s\n", l.Addr(), fs.Arg(0))
+
+	if err := offer.Serve(l); err != nil {
+		return fail(name, err)
+	}
+	fmt.Fprintln(os.Stderr, "The peer closed the session")
+	return exitOK
+}
+
+func answerCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[target...]", `Answer an offer printed by 'whet offer' on a peer without a signal server.
+Paste the offer, then give the answer printed to stdout to the peer.  The
+connections the peer opens are forwarded to the offered target until either side
+exits.  Targets are given as arguments or with -tcptarget in the form
+name=host:port[-port] or name=unix:/path, as for 'whet serve'.`)
+	var tcptargets targetAddrList
+	fs.Var(&tcptargets, "tcptarget", "Target the peer may open, as an alternative to the arguments (can specify multiple)")
+	verbose := fs.Bool("v", false, "Log connection details to stderr")
+	m := addManualFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	specs := append(tcptargets, fs.Args()...)
+	if len(specs) == 0 {
+		return usageError(fs, "no targets specified")
+	}
+	targets, err := pkg.ParseForwardTargetPortsFromStringSlice(specs)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+
+	stdout, err := redirectLogging(*verbose)
+	if err != nil {
+		return fail(name, err)
+	}
+	fmt.Fprintln(os.Stderr, "Paste the peer's offer:")
+	offer, err := pkg.ReadManualBlob(os.Stdin)
+	if err != nil {
+		return fail(name, err)
+	}
+	answer, err := m.Answer(offer, targets)
+	if err != nil {
+		return fail(name, err)
+	}
+	defer answer.Close()
+	closeOnSignal(answer)
+	fmt.Fprintln(os.Stderr, "Give this answer to the peer:")
+	fmt.Fprintln(stdout, answer.Blob())
+
+	select {
+	case <-answer.Connected():
+	case <-answer.Done():
+		return fail(name, errors.New("the peer did not connect"))
+	}
+	fmt.Fprintf(os.Stderr, "Connected, serving %s\n", answer.Target())
+	<-answer.Done()
+	fmt.Fprintln(os.Stderr, "The peer closed the session")
+	return exitOK
+}
+
+func discoverCommand(name string, args []string) int {
+	fs := newFlagSet(name, "", `Find the whet servers advertised on the local network with multicast DNS, by
+servers run with -mdns name.  A server is used with -server whet://name.local.`)
+	wait := fs.Duration("wait", 2*time.Second, "How long to wait for servers to answer")
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return usageError(fs, "unexpected argument %q", fs.Arg(0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *wait)
+	defer cancel()
+	servers, err := pkg.Discover(ctx)
+	if err != nil {
+		return fail(name, err)
+	}
+	if len(servers) == 0 {
+		fmt.Fprintf(os.Stderr, "whet %s: no servers found\n", name)
+		return exitNotFound
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tID\tTLS\tTARGETS")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "whet://%s.local\t%s\t%s\t%t\t%s\n", s.Name, s.URL(), s.ID, s.TLS, s.TargetsHash)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func statusCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[server]", `Check the server is up and show the number of targets the token may open.  With an
+admin token the open and pending sessions are shown as well.`)
+	server, token := addClientFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	addr := serverArg(fs, server)
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := apiRequest(addr, *token, "GET", "/api/health", nil, &health); err != nil {
+		return fail(name, err)
+	}
+	var targets []pkg.TargetInfo
+	if err := apiRequest(addr, *token, "GET", "/api/targets", nil, &targets); err != nil {
+		return fail(name, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Server\t%s\n", addr)
+	fmt.Fprintf(tw, "Status\t%s\n", health.Status)
+	fmt.Fprintf(tw, "Targets\t%d\n", len(targets))
+
+	// sessions are only listed to admins
+	var sessions []pkg.SessionInfo
+	err := apiRequest(addr, *token, "GET", "/api/sessions", nil, &sessions)
+	var ae *apiError
+	switch {
+	case err == nil:
+		open := 0
+		for _, s := range sessions {
+			if s.Connected {
+				open++
+			}
+		}
+		fmt.Fprintf(tw, "Sessions\t%d open, %d pending\n", open, len(sessions)-open)
+	case errors.As(err, &ae) && (ae.status == http.StatusUnauthorized || ae.status == http.StatusForbidden):
+		fmt.Fprintf(tw, "Sessions\t(requires an admin token)\n")
+	default:
+		tw.Flush()
+		return fail(name, err)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func lsCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[server]", "List the targets the token may open on the server.")
+	server, token := addClientFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	var targets []pkg.TargetInfo
+	if err := apiRequest(serverArg(fs, server), *token, "GET", "/api/targets", nil, &targets); err != nil {
+		return fail(name, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tPORTS\tDESCRIPTION")
+	for _, t := range targets {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", t.Name, t.Type, t.Ports, t.Description)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func sessionsCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[server]", "List the open and pending sessions of the server.  Requires an admin token.")
+	server, token := addClientFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	var sessions []pkg.SessionInfo
+	if err := apiRequest(serverArg(fs, server), *token, "GET", "/api/sessions", nil, &sessions); err != nil {
+		return fail(name, err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTARGET\tBACKEND\tIDENTITY\tREMOTE\tSTATE\tAGE\tIN\tOUT")
+	for _, s := range sessions {
+		state := "pending"
+		if s.Connected {
+			state = "open"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.ID, s.Target, s.Backend, s.Identity, s.RemoteAddr, state,
+			time.Since(s.Created).Round(time.Second), s.BytesIn, s.BytesOut)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func killCommand(name string, args []string) int {
+	fs := newFlagSet(name, "[server] session...", "Close sessions on the server.  Requires an admin token.")
+	server, token := addClientFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	addr, ids := sessionArgs(fs, server)
+	if len(ids) == 0 {
+		return usageError(fs, "no sessions specified")
+	}
+
+	code := exitOK
+	for _, id := range ids {
+		if err := apiRequest(addr, *token, "DELETE", "/api/sessions/"+id, nil, nil); err != nil {
+			code = fail(name, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		fmt.Printf("Killed session %s\n", id)
+	}
+	return code
+}
+
+func tokenCommand(name string, args []string) int {
+	subcommands := map[string]func(string, []string) int{
+		"create": tokenCreateCommand,
+		"list":   tokenListCommand,
+		"revoke": tokenRevokeCommand,
+	}
+	if len(args) > 0 {
+		if sub, ok := subcommands[args[0]]; ok {
+			return sub(name+" "+args[0], args[1:])
+		}
+	}
+
+	w := os.Stderr
+	code := exitUsage
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		w = os.Stdout
+		code = exitOK
+	}
+	fmt.Fprintln(w, "Usage: whet token <create|list|revoke> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Manage the named tokens of a token file.  Servers pick up changes on SIGHUP,")
+	fmt.Fprintln(w, "or straight away when -server is given with an admin -token.")
+	return code
+}
+
+// addTokenFileFlags adds the flags of the token subcommands that change a token file
+func addTokenFileFlags(fs *flag.FlagSet) (file *string, server *string, token *string) {
+	file = fs.String("file", os.Getenv("WHET_TOKEN_FILE"), "Token file, $WHET_TOKEN_FILE if set")
+	server = fs.String("server", "", "Server to reload the token file on after the change")
+	token = fs.String("token", os.Getenv("WHET_TOKEN"), "Admin bearer token used to reload the server, $WHET_TOKEN if set")
+	return file, server, token
+}
+
+// reloadTokens asks the server to reload its token file
+func reloadTokens(server string, token string) error {
+	if server == "" {
+		return nil
+	}
+	if err := apiRequest(server, token, "POST", "/api/tokens/reload", nil, nil); err != nil {
+		return fmt.Errorf("token file saved but the server was not reloaded: %v", err)
+	}
+	return nil
+}
+
+func tokenCreateCommand(name string, args []string) int {
+	fs := newFlagSet(name, "token-name", "Create a named token, printing its secret.")
+	file, server, token := addTokenFileFlags(fs)
+	targets := fs.String("targets", "", "Comma separated target names or patterns the token may open (default all)")
+	ttl := fs.Duration("ttl", 0, "How long the token is valid (default forever)")
+	cidrs := fs.String("cidrs", "", "Comma separated client networks the token is accepted from (default any)")
+	admin := fs.Bool("admin", false, "Allow the token to use the admin API")
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "expected one token name")
+	}
+	if *file == "" {
+		return usageError(fs, "no token file specified")
+	}
+
+	secret, err := pkg.GenerateTokenSecret()
+	if err != nil {
+		return fail(name, err)
+	}
+	t := &pkg.Token{
+		Name:        fs.Arg(0),
+		Secret:      secret,
+		Targets:     splitList(*targets),
+		SourceCIDRs: splitList(*cidrs),
+		Admin:       *admin,
+	}
+	if *ttl > 0 {
+		expires := time.Now().Add(*ttl).UTC().Truncate(time.Second)
+		t.Expires = &expires
+	}
+
+	ts, err := pkg.OpenTokenStore(*file)
+	if err != nil {
+		return fail(name, err)
+	}
+	if err := ts.Add(t); err != nil {
+		return fail(name, err)
+	}
+	if err := ts.Save(); err != nil {
+		return fail(name, err)
+	}
+
+	fmt.Println(secret)
+	if err := reloadTokens(*server, *token); err != nil {
+		return fail(name, err)
+	}
+	return exitOK
+}
+
+func tokenListCommand(name string, args []string) int {
+	fs := newFlagSet(name, "", "List the tokens of a token file, or of a server with -server and an admin -token.")
+	file := fs.String("file", os.Getenv("WHET_TOKEN_FILE"), "Token file, $WHET_TOKEN_FILE if set")
+	server := fs.String("server", "", "Server to list the tokens of instead of a file")
+	token := fs.String("token", os.Getenv("WHET_TOKEN"), "Admin bearer token, $WHET_TOKEN if set")
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	var tokens []pkg.TokenInfo
+	switch {
+	case *server != "":
+		if err := apiRequest(*server, *token, "GET", "/api/tokens", nil, &tokens); err != nil {
+			return fail(name, err)
+		}
+	case *file != "":
+		ts, err := pkg.LoadTokenStore(*file)
+		if err != nil {
+			return fail(name, err)
+		}
+		for _, t := range ts.Tokens() {
+			tokens = append(tokens, pkg.TokenInfo{Name: t.Name, Targets: t.Targets, Expires: t.Expires, SourceCIDRs: t.SourceCIDRs, Admin: t.Admin})
+		}
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	default:
+		return usageError(fs, "no token file or server specified")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTARGETS\tEXPIRES\tSOURCES\tADMIN")
+	for _, t := range tokens {
+		targets, expires, sources := "*", "never", "any"
+		if len(t.Targets) > 0 {
+			targets = strings.Join(t.Targets, ",")
+		}
+		if t.Expires != nil {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		if len(t.SourceCIDRs) > 0 {
+			sources = strings.Join(t.SourceCIDRs, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", t.Name, targets, expires, sources, t.Admin)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func tokenRevokeCommand(name string, args []string) int {
+	fs := newFlagSet(name, "token-name...", "Remove named tokens from a token file.")
+	file, server, token := addTokenFileFlags(fs)
+	if ok, code := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		return usageError(fs, "no token names specified")
+	}
+	if *file == "" {
+		return usageError(fs, "no token file specified")
+	}
+
+	ts, err := pkg.LoadTokenStore(*file)
+	if err != nil {
+		return fail(name, err)
+	}
+	for _, tokenName := range fs.Args() {
+		if err := ts.Remove(tokenName); err != nil {
+			fmt.Fprintf(os.Stderr, "whet %s: %s: %v\n", name, tokenName, err)
+			return exitNotFound
+		}
+	}
+	if err := ts.Save(); err != nil {
+		return fail(name, err)
+	}
+	if err := reloadTokens(*server, *token); err != nil {
+		return fail(name, err)
+	}
+	return exitOK
+}
+
+func helpCommand(name string, args []string) int {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return exitOK
+	}
+	if args[0] == "help" {
+		usage(os.Stdout)
+		return exitOK
+	}
+	return runCommand(args[0], []string{"-h"})
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var retv []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			retv = append(retv, item)
+		}
+	}
+	return retv
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/richinsley/whet/pkg"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+An example whet.yaml:
+
+listen: 0.0.0.0:8080
+tunnel: direct            # direct or ngrok
+tls:
+  cert: /etc/whet/cert.pem
+  key: /etc/whet/key.pem
+detached: true
+targets:
+  ssh: localhost:22
+  range: localhost:10000-10010
+  prism:
+    address: localhost:9000
+    origins: [https://dash.example.com]
+    description: Prism dashboard
+folders:
+  app: /srv/app?spa&cache=1h&precompressed
+proxies:
+  api: localhost:9001
+  grafana: https://10.0.0.7:3000?auth&timeout=30s
+sdk: true
+remote_listeners: true
+mdns: lab                 # advertise on the local network as whet://lab.local
+rendezvous:               # serve the targets through a public whet server as well
+  server: wss://rendezvous.example.com   # or https:// to poll instead of a WebSocket
+  token: ...
+auth:
+  token_file: /etc/whet/tokens.json
+  jwt:
+    keys: /etc/whet/jwks.json
+    audience: whet
+cors:
+  origins: [https://*.example.com]
+  max_age: 10m
+rate_limit:
+  enabled: true
+  max_sessions_per_target: 10
+audit_log: /var/log/whet/audit.jsonl
+ice_servers:
+  - urls: [stun:stun.l.google.com:19302]
+log:
+  output: stderr
+connect:
+  server: https://whet.example.com
+  token: ...
+  listeners:
+    - ssh=127.0.0.1:2222
+*/
+
+// fileConfig is the YAML configuration file of the whet command
+type fileConfig struct {
+	Listen    string                   `yaml:"listen"`
+	Tunnel    string                   `yaml:"tunnel"`
+	Ngrok     ngrokConfig              `yaml:"ngrok"`
+	TLS       tlsConfig                `yaml:"tls"`
+	Detached  *bool                    `yaml:"detached"`
+	ID        string                   `yaml:"id"`
+	Targets   map[string]*targetConfig `yaml:"targets"`
+	Folders   map[string]string        `yaml:"folders"`
+	Proxies   map[string]string        `yaml:"proxies"`
+	Auth      authConfig               `yaml:"auth"`
+	CORS      *corsConfig              `yaml:"cors"`
+	RateLimit rateLimitConfig          `yaml:"rate_limit"`
+	AuditLog  string                   `yaml:"audit_log"`
+	ICE       []iceServerConfig        `yaml:"ice_servers"`
+	Log       logConfig                `yaml:"log"`
+	Connect   *connectConfig           `yaml:"connect"`
+	SDK       bool                     `yaml:"sdk"`
+	Remote    bool                     `yaml:"remote_listeners"`
+	Agent     *rendezvousConfig        `yaml:"rendezvous"`
+	MDNS      string                   `yaml:"mdns"`
+
+	// the parsed document, used to find the line of a key in validation errors
+	root *yaml.Node
+	path string
+}
+
+type ngrokConfig struct {
+	Domain string `yaml:"domain"`
+}
+
+type tlsConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// targetConfig is a forward target, either just an address or a mapping with options
+type targetConfig struct {
+	Address     string   `yaml:"address"`
+	Origins     []string `yaml:"origins"`
+	Description string   `yaml:"description"`
+}
+
+func (t *targetConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		t.Address = node.Value
+		return nil
+	}
+	type plain targetConfig
+	return node.Decode((*plain)(t))
+}
+
+type authConfig struct {
+	Token     string     `yaml:"token"`
+	TokenFile string     `yaml:"token_file"`
+	URLKey    string     `yaml:"url_key"`
+	JWT       *jwtConfig `yaml:"jwt"`
+}
+
+type jwtConfig struct {
+	Keys          string `yaml:"keys"`
+	Audience      string `yaml:"audience"`
+	Issuer        string `yaml:"issuer"`
+	AllowNoExpiry bool   `yaml:"allow_no_expiry"`
+}
+
+type corsConfig struct {
+	Origins []string `yaml:"origins"`
+	MaxAge  string   `yaml:"max_age"`
+}
+
+type rateLimitConfig struct {
+	Enabled              bool `yaml:"enabled"`
+	MaxSessionsPerTarget int  `yaml:"max_sessions_per_target"`
+}
+
+type iceServerConfig struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+type logConfig struct {
+	Output string `yaml:"output"`
+}
+
+type connectConfig struct {
+	Server    string   `yaml:"server"`
+	Token     string   `yaml:"token"`
+	Listeners []string `yaml:"listeners"`
+}
+
+type rendezvousConfig struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// configError is a validation error that points at the offending key
+type configError struct {
+	file string
+	line int
+	key  string
+	msg  string
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", e.file, e.line, e.key, e.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.file, e.key, e.msg)
+}
+
+// loadConfig reads and validates a whet configuration file
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+func parseConfig(path string, data []byte) (*fileConfig, error) {
+	cfg := &fileConfig{path: path}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cfg.root = &root
+
+	// decode strictly so misspelled keys are reported rather than ignored
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// errorAt builds a validation error for the key at the dotted path
+func (cfg *fileConfig) errorAt(key string, format string, args ...interface{}) error {
+	return &configError{
+		file: cfg.path,
+		line: cfg.lineOf(key),
+		key:  key,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// lineOf returns the line of the key at the dotted path, or 0 if it can't be found
+func (cfg *fileConfig) lineOf(key string) int {
+	if cfg.root == nil || len(cfg.root.Content) == 0 {
+		return 0
+	}
+	node := cfg.root.Content[0]
+	line := 0
+	for _, part := range strings.Split(key, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			var idx int
+			if _, err := fmt.Sscanf(part, "%d", &idx); err == nil && idx >= 0 && idx < len(node.Content) {
+				next = node.Content[idx]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// validate checks the values of the configuration, pointing errors at the offending key
+func (cfg *fileConfig) validate() error {
+	if cfg.Tunnel != "" && cfg.Tunnel != "direct" && cfg.Tunnel != "ngrok" {
+		return cfg.errorAt("tunnel", "must be direct or ngrok, not %q", cfg.Tunnel)
+	}
+	if cfg.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			return cfg.errorAt("listen", "invalid address %q", cfg.Listen)
+		}
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return cfg.errorAt("tls", "cert and key must be set together")
+	}
+
+	for name, target := range cfg.Targets {
+		key := "targets." + name
+		if target == nil || target.Address == "" {
+			return cfg.errorAt(key, "missing address")
+		}
+		if _, err := pkg.ParseForwardTargetPortFromString(name + "=" + target.Address); err != nil {
+			return cfg.errorAt(key, "invalid target %q: %v", target.Address, err)
+		}
+	}
+
+	for sub, folder := range cfg.Folders {
+		sf, err := pkg.ParseServeFolderFromString(sub + "=" + folder)
+		if err != nil {
+			return cfg.errorAt("folders."+sub, "%v", err)
+		}
+		if info, err := os.Stat(sf.Path); err != nil || !info.IsDir() {
+			return cfg.errorAt("folders."+sub, "%q is not a directory", sf.Path)
+		}
+	}
+
+	for sub, address := range cfg.Proxies {
+		if address == "" {
+			return cfg.errorAt("proxies."+sub, "missing address")
+		}
+		if _, err := pkg.ParseProxyTargetFromString(sub + "=" + address); err != nil {
+			return cfg.errorAt("proxies."+sub, "%v", err)
+		}
+	}
+
+	if cfg.Auth.JWT != nil && cfg.Auth.JWT.Keys == "" {
+		return cfg.errorAt("auth.jwt.keys", "missing key file")
+	}
+
+	if cfg.CORS != nil && cfg.CORS.MaxAge != "" {
+		if _, err := time.ParseDuration(cfg.CORS.MaxAge); err != nil {
+			return cfg.errorAt("cors.max_age", "invalid duration %q", cfg.CORS.MaxAge)
+		}
+	}
+
+	if cfg.RateLimit.MaxSessionsPerTarget < 0 {
+		return cfg.errorAt("rate_limit.max_sessions_per_target", "must not be negative")
+	}
+
+	for i, ice := range cfg.ICE {
+		if len(ice.URLs) == 0 {
+			return cfg.errorAt(fmt.Sprintf("ice_servers.%d", i), "missing urls")
+		}
+		for _, u := range ice.URLs {
+			if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+				return cfg.errorAt(fmt.Sprintf("ice_servers.%d.urls", i), "invalid ICE server url %q", u)
+			}
+		}
+	}
+
+	if cfg.Agent != nil && cfg.Agent.Server == "" {
+		return cfg.errorAt("rendezvous.server", "missing server address")
+	}
+
+	if cfg.Connect != nil {
+		if cfg.Connect.Server == "" {
+			return cfg.errorAt("connect.server", "missing server address")
+		}
+		for i, listener := range cfg.Connect.Listeners {
+			if _, err := pkg.ParseListenTargetPortFromString(listener); err != nil {
+				return cfg.errorAt(fmt.Sprintf("connect.listeners.%d", i), "invalid listener %q: %v", listener, err)
+			}
+		}
+	}
+
+	if len(cfg.Targets) == 0 && len(cfg.Folders) == 0 && len(cfg.Proxies) == 0 && !cfg.SDK && !cfg.Remote && cfg.Connect == nil {
+		return &configError{file: cfg.path, key: "targets", msg: "no targets, folders, proxies, sdk, remote listeners or connect listeners configured"}
+	}
+	return nil
+}
+
+// isServer reports if the configuration describes a whet server
+func (cfg *fileConfig) isServer() bool {
+	return len(cfg.Targets) > 0 || len(cfg.Folders) > 0 || len(cfg.Proxies) > 0 || cfg.SDK || cfg.Remote
+}
+
+// rendezvous returns the rendezvous server settings, empty when there is none
+func (cfg *fileConfig) rendezvous() rendezvousConfig {
+	if cfg.Agent == nil {
+		return rendezvousConfig{}
+	}
+	return *cfg.Agent
+}
+
+// detached reports if data channels should be detached, which is the default
+func (cfg *fileConfig) detached() bool {
+	return cfg.Detached == nil || *cfg.Detached
+}
+
+// forwardTargets builds the server forward targets of the configuration
+func (cfg *fileConfig) forwardTargets() (map[string]*pkg.ForwardTargetPort, error) {
+	targets := make(map[string]*pkg.ForwardTargetPort)
+	for name, tc := range cfg.Targets {
+		target, err := pkg.ParseForwardTargetPortFromString(name + "=" + tc.Address)
+		if err != nil {
+			return nil, cfg.errorAt("targets."+name, "%v", err)
+		}
+		target.AllowedOrigins = tc.Origins
+		target.Description = tc.Description
+		targets[name] = target
+	}
+	return targets, nil
+}
+
+// serveFolders returns the folders in the subdomain=/path form used by the server
+func (cfg *fileConfig) serveFolders() []string {
+	folders := make([]string, 0, len(cfg.Folders))
+	for sub, path := range cfg.Folders {
+		folders = append(folders, sub+"="+path)
+	}
+	return folders
+}
+
+// proxyTargets returns the reverse proxy routes of the configuration
+func (cfg *fileConfig) proxyTargets() []pkg.ProxyTarget {
+	proxies := make([]pkg.ProxyTarget, 0, len(cfg.Proxies))
+	for sub, address := range cfg.Proxies {
+		// validate has already rejected proxies that don't parse
+		if proxy, err := pkg.ParseProxyTargetFromString(sub + "=" + address); err == nil {
+			proxies = append(proxies, *proxy)
+		}
+	}
+	return proxies
+}
+
+// iceServers returns the configured ICE servers, or nil to keep the default
+func (cfg *fileConfig) iceServers() []webrtc.ICEServer {
+	if len(cfg.ICE) == 0 {
+		return nil
+	}
+	servers := make([]webrtc.ICEServer, 0, len(cfg.ICE))
+	for _, ice := range cfg.ICE {
+		server := webrtc.ICEServer{URLs: ice.URLs, Username: ice.Username}
+		if ice.Credential != "" {
+			server.Credential = ice.Credential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// corsConfig returns the CORS configuration, or nil to allow every origin
+func (cfg *fileConfig) corsConfig() *pkg.CORSConfig {
+	if cfg.CORS == nil || len(cfg.CORS.Origins) == 0 {
+		return nil
+	}
+	maxAge := 10 * time.Minute
+	if cfg.CORS.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(cfg.CORS.MaxAge)
+	}
+	return &pkg.CORSConfig{
+		AllowedOrigins: cfg.CORS.Origins,
+		MaxAge:         maxAge,
+	}
+}
+
+// serverOptions builds the options applied to the server once it is created
+func (cfg *fileConfig) serverOptions() (*serverOptions, error) {
+	var err error
+	opts := &serverOptions{
+		cors:   cfg.corsConfig(),
+		sdk:    cfg.SDK,
+		remote: cfg.Remote,
+		mdns:   cfg.MDNS,
+	}
+	if cfg.Agent != nil {
+		opts.rendezvous = cfg.Agent.Server
+		opts.rendezvousToken = cfg.Agent.Token
+	}
+
+	if cfg.Auth.TokenFile != "" {
+		opts.tokens, err = pkg.LoadTokenStore(cfg.Auth.TokenFile)
+		if err != nil {
+			return nil, cfg.errorAt("auth.token_file", "%v", err)
+		}
+	}
+
+	if cfg.Auth.JWT != nil {
+		opts.jwt, err = pkg.LoadJWTValidator(cfg.Auth.JWT.Keys)
+		if err != nil {
+			return nil, cfg.errorAt("auth.jwt.keys", "%v", err)
+		}
+		opts.jwt.Audience = cfg.Auth.JWT.Audience
+		opts.jwt.Issuer = cfg.Auth.JWT.Issuer
+		opts.jwt.AllowNoExpiry = cfg.Auth.JWT.AllowNoExpiry
+	}
+
+	if cfg.Auth.URLKey != "" {
+		opts.urlSigner = pkg.NewURLSigner([]byte(cfg.Auth.URLKey))
+	}
+
+	if cfg.RateLimit.Enabled || cfg.RateLimit.MaxSessionsPerTarget > 0 {
+		opts.rateLimits = pkg.DefaultRateLimitConfig()
+		opts.rateLimits.MaxSessionsPerTarget = cfg.RateLimit.MaxSessionsPerTarget
+	}
+
+	if cfg.AuditLog != "" {
+		opts.audit, err = pkg.NewJSONLAuditSink(cfg.AuditLog)
+		if err != nil {
+			return nil, cfg.errorAt("audit_log", "%v", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// setLogOutput sends log output, including the output of the whet package, to stdout,
+// stderr or a file
+func setLogOutput(output string) error {
+	switch output {
+	case "", "stdout":
+		return nil
+	case "stderr":
+		os.Stdout = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		os.Stdout = f
+		os.Stderr = f
+	}
+	log.SetOutput(os.Stdout)
+	return nil
+}
+
+// runFromConfig runs the server and/or client described by a configuration file
+func runFromConfig(path string) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setLogOutput(cfg.Log.Output); err != nil {
+		log.Fatal(cfg.errorAt("log.output", "%v", err))
+	}
+
+	if ice := cfg.iceServers(); ice != nil {
+		pkg.ICEServers = ice
+	}
+
+	if cfg.Auth.Token != "" {
+		bearerToken = cfg.Auth.Token
+	}
+
+	if cfg.Connect != nil {
+		listeners, err := pkg.ParseListenTargetPortsFromStringSlice(cfg.Connect.Listeners)
+		if err != nil {
+			log.Fatal(cfg.errorAt("connect.listeners", "%v", err))
+		}
+		if !cfg.isServer() {
+			runClient(cfg.Connect.Server, listeners, cfg.Connect.Token, cfg.detached())
+			return
+		}
+		go runClient(cfg.Connect.Server, listeners, cfg.Connect.Token, cfg.detached())
+	}
+
+	targets, err := cfg.forwardTargets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts, err := cfg.serverOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := pkg.NewWhetServer(bearerToken, targets, cfg.serveFolders(), cfg.proxyTargets(), cfg.detached())
+	if err != nil {
+		log.Fatalf("Failed to create WHET server: %v", err)
+	}
+	s.Id = cfg.ID
+	opts.apply(s)
+
+	go reloadConfigOnSignal(path, cfg, s, opts)
+
+	var listener net.Listener
+	if cfg.Tunnel == "ngrok" {
+		listener, err = ngrokListener(context.Background(), cfg.Ngrok.Domain)
+	} else {
+		addr := cfg.Listen
+		if addr == "" {
+			addr = "localhost:8080"
+		}
+		listener, err = net.Listen("tcp", addr)
+		if err == nil && cfg.TLS.Cert != "" {
+			var cert tls.Certificate
+			cert, err = tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+			if err != nil {
+				err = cfg.errorAt("tls", "%v", err)
+			} else {
+				listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+			}
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	log.Printf("WHET server listening on %s", listener.Addr())
+	var advertiser *pkg.Advertiser
+	if cfg.Tunnel != "ngrok" {
+		advertiser = opts.advertise(s, listener.Addr().String(), cfg.TLS.Cert != "")
+	}
+	err = s.StartWithListener(listener, true)
+	if advertiser != nil {
+		advertiser.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to start WHET server: %v", err)
+	}
+}
+
+// reloadConfigOnSignal re-reads the configuration file each time the process receives
+// SIGHUP and applies the changes that can be made to a running server: targets, CORS,
+// remote listeners, tokens and JWT keys.  Changes to any other setting are reported as
+// needing a restart.  An invalid file is reported and the running configuration kept.
+func reloadConfigOnSignal(path string, current *fileConfig, s *pkg.WhetServer, opts *serverOptions) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Failed to reload configuration, keeping the running configuration: %v", err)
+			continue
+		}
+
+		targets, err := cfg.forwardTargets()
+		if err != nil {
+			log.Printf("Failed to reload configuration, keeping the running configuration: %v", err)
+			continue
+		}
+		s.SetTargets(targets)
+		s.SetCORS(cfg.corsConfig())
+		s.SetRemoteListeners(cfg.Remote)
+		// current tracks what is running, so only the settings applied above are updated
+		current.Targets = cfg.Targets
+		current.CORS = cfg.CORS
+		current.Remote = cfg.Remote
+
+		// token and key files may have changed even if the configuration has not
+		if opts.tokens != nil {
+			if err := opts.tokens.Reload(); err != nil {
+				log.Printf("Failed to reload tokens: %v", err)
+			}
+		}
+		if opts.jwt != nil {
+			if err := opts.jwt.Reload(); err != nil {
+				log.Printf("Failed to reload JWT keys: %v", err)
+			}
+		}
+
+		if changed := restartRequired(current, cfg); len(changed) > 0 {
+			log.Printf("Changes to %s require a restart", strings.Join(changed, ", "))
+		}
+
+		log.Printf("Reloaded configuration from %s, %d targets", path, len(targets))
+	}
+}
+
+// restartRequired returns the keys of the settings that differ between the running
+// configuration and cfg but can only be applied by restarting the server
+func restartRequired(current *fileConfig, cfg *fileConfig) []string {
+	var changed []string
+	for _, setting := range []struct {
+		key     string
+		changed bool
+	}{
+		{"listen", cfg.Listen != current.Listen},
+		{"tunnel", cfg.Tunnel != current.Tunnel || cfg.Ngrok != current.Ngrok},
+		{"tls", cfg.TLS != current.TLS},
+		{"folders", !reflect.DeepEqual(cfg.Folders, current.Folders)},
+		{"proxies", !reflect.DeepEqual(cfg.Proxies, current.Proxies)},
+		{"auth", !reflect.DeepEqual(cfg.Auth, current.Auth)},
+		{"rate_limit", cfg.RateLimit != current.RateLimit},
+		{"audit_log", cfg.AuditLog != current.AuditLog},
+		{"ice_servers", !reflect.DeepEqual(cfg.ICE, current.ICE)},
+		{"log", cfg.Log != current.Log},
+		{"sdk", cfg.SDK != current.SDK},
+		{"rendezvous", cfg.rendezvous() != current.rendezvous()},
+		{"mdns", cfg.MDNS != current.MDNS},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.key)
+		}
+	}
+	return changed
+}
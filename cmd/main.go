@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/richinsley/whet/pkg"
+	"github.com/richinsley/whet/sdk"
 	"golang.ngrok.com/ngrok"
 	"golang.ngrok.com/ngrok/config"
 )
@@ -37,6 +43,9 @@ type serveFolderList []string
 
 // Implement the Set method for serveFolderList to satisfy the flag.Value interface
 func (t *serveFolderList) Set(value string) error {
+	if _, err := pkg.ParseServeFolderFromString(value); err != nil {
+		return err
+	}
 	*t = append(*t, value)
 	return nil
 }
@@ -50,14 +59,11 @@ func (t *serveFolderList) String() string {
 type proxyTargetList []pkg.ProxyTarget
 
 func (p *proxyTargetList) Set(value string) error {
-	parts := strings.Split(value, "=")
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid proxy target format: %s (expected format: subdomain=address:port)", value)
-	}
-	*p = append(*p, pkg.ProxyTarget{
-		Subdomain: strings.Trim(parts[0], "/"),
-		Address:   parts[1],
-	})
+	target, err := pkg.ParseProxyTargetFromString(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, *target)
 	return nil
 }
 
@@ -69,27 +75,185 @@ func (p *proxyTargetList) String() string {
 	return strings.Join(strs, ", ")
 }
 
+// serverFlags are the flags that configure a whet server, shared by 'whet serve' and
+// the legacy -serve mode
+type serverFlags struct {
+	tcptargets        targetAddrList
+	serveFolders      serveFolderList
+	proxyTargets      proxyTargetList
+	targetOrigins     targetAddrList
+	targetDescs       targetAddrList
+	corsOrigins       *string
+	corsMaxAge        *time.Duration
+	tokenFile         *string
+	jwtKeys           *string
+	jwtAudience       *string
+	jwtIssuer         *string
+	jwtNoExpiry       *bool
+	urlKey            *string
+	rateLimit         *bool
+	maxTargetSessions *int
+	auditLog          *string
+	sdk               *bool
+	remoteListeners   *bool
+	rendezvous        *string
+	rendezvousToken   *string
+	mdns              *string
+}
+
+func addServerFlags(fs *flag.FlagSet) *serverFlags {
+	sf := &serverFlags{}
+	fs.Var(&sf.tcptargets, "tcptarget", "Target for server-side connections in the form name=host:port[-port] or name=unix:/path, with options such as ?tls&sni=name&ca=file (can specify multiple)")
+	fs.Var(&sf.serveFolders, "servefolder", "Folder path(s) to serve in the form subdomain=/absolute/path, with options such as ?spa&nolisting&cache=1h&precompressed (can specify multiple)")
+	fs.Var(&sf.proxyTargets, "proxytarget", "Proxy target in the form subdomain=address:port, subdomain=https://host:port/path or subdomain=whet://server/target, with options such as ?auth&timeout=30s&header=Name:value (can specify multiple)")
+	fs.Var(&sf.targetOrigins, "targetorigins", "Restrict a target to browser origins in the form targetname=origin[,origin] (can specify multiple)")
+	fs.Var(&sf.targetDescs, "targetdescription", "Describe a target in the target listing in the form targetname=description (can specify multiple)")
+
+	sf.corsOrigins = fs.String("corsorigins", "", "Comma separated browser origins allowed to use the server, e.g. https://dash.example.com,https://*.example.com (default allows any origin)")
+	sf.corsMaxAge = fs.Duration("corsmaxage", 10*time.Minute, "How long browsers may cache CORS preflight responses")
+
+	sf.tokenFile = fs.String("tokenfile", "", "JSON file of named tokens scoped to targets (reloaded on SIGHUP)")
+
+	sf.jwtKeys = fs.String("jwtkeys", "", "JWKS or PEM public key file used to validate JWT bearer tokens (reloaded on SIGHUP)")
+	sf.jwtAudience = fs.String("jwtaudience", "", "Required audience of JWT bearer tokens")
+	sf.jwtIssuer = fs.String("jwtissuer", "", "Required issuer of JWT bearer tokens")
+	sf.jwtNoExpiry = fs.Bool("jwtnoexpiry", false, "Accept JWT bearer tokens without an exp claim, which never expire")
+
+	sf.urlKey = fs.String("urlkey", os.Getenv("WHET_URL_KEY"), "HMAC key for signed connect URLs (default $WHET_URL_KEY)")
+
+	sf.rateLimit = fs.Bool("ratelimit", false, "Enable the default per-IP and per-token rate limits, pending connection cap and auth failure lockout")
+	sf.maxTargetSessions = fs.Int("maxtargetsessions", 0, "Maximum open and pending sessions per target (0 for no limit, implies -ratelimit)")
+
+	sf.auditLog = fs.String("auditlog", "", "Append an audit record of every session, auth failure and admin change to this JSON lines file")
+
+	sf.sdk = fs.Bool("sdk", false, "Serve the browser whet client under /whet-sdk/ (requires a binary built with -tags sdk after 'go generate ./sdk')")
+	sf.remoteListeners = fs.Bool("remotelisteners", false, "Let clients such as browser tabs register targets they serve, relaying the signaling of connections to them")
+	sf.rendezvous = fs.String("rendezvous", "", "Also serve the targets through this rendezvous whet server, run with -remotelisteners, for servers behind NAT (ws:// or wss:// to register over a WebSocket)")
+	sf.rendezvousToken = fs.String("rendezvoustoken", os.Getenv("WHET_RENDEZVOUS_TOKEN"), "Bearer token for the rendezvous server (default $WHET_RENDEZVOUS_TOKEN)")
+	sf.mdns = fs.String("mdns", "", "Advertise the server on the local network with multicast DNS under this name, found by 'whet discover' and dialed as whet://name.local")
+	return sf
+}
+
+// build parses the forward targets and server options of the flags
+func (sf *serverFlags) build() (map[string]*pkg.ForwardTargetPort, *serverOptions, error) {
+	if len(sf.tcptargets) == 0 && len(sf.proxyTargets) == 0 && len(sf.serveFolders) == 0 && !*sf.sdk && !*sf.remoteListeners {
+		return nil, nil, errors.New("no server targets specified")
+	}
+	targets, err := pkg.ParseForwardTargetPortsFromStringSlice(sf.tcptargets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse forward target addresses: %v", err)
+	}
+
+	// apply the per-target origin restrictions
+	for _, spec := range sf.targetOrigins {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid target origins: %s (expected format: targetname=origin[,origin])", spec)
+		}
+		target, ok := targets[parts[0]]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid target origins: unknown target %s", parts[0])
+		}
+		target.AllowedOrigins = pkg.ParseOriginList(parts[1])
+	}
+
+	for _, spec := range sf.targetDescs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid target description: %s (expected format: targetname=description)", spec)
+		}
+		target, ok := targets[parts[0]]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid target description: unknown target %s", parts[0])
+		}
+		target.Description = parts[1]
+	}
+
+	opts := &serverOptions{
+		sdk:             *sf.sdk,
+		remote:          *sf.remoteListeners,
+		rendezvous:      *sf.rendezvous,
+		rendezvousToken: *sf.rendezvousToken,
+		mdns:            *sf.mdns,
+	}
+	if *sf.corsOrigins != "" {
+		opts.cors = &pkg.CORSConfig{
+			AllowedOrigins: pkg.ParseOriginList(*sf.corsOrigins),
+			MaxAge:         *sf.corsMaxAge,
+		}
+	}
+
+	if *sf.tokenFile != "" {
+		opts.tokens, err = pkg.LoadTokenStore(*sf.tokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load tokens: %v", err)
+		}
+	}
+
+	if *sf.jwtKeys != "" {
+		opts.jwt, err = pkg.LoadJWTValidator(*sf.jwtKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load JWT keys: %v", err)
+		}
+		opts.jwt.Audience = *sf.jwtAudience
+		opts.jwt.Issuer = *sf.jwtIssuer
+		opts.jwt.AllowNoExpiry = *sf.jwtNoExpiry
+	}
+
+	if *sf.rateLimit || *sf.maxTargetSessions > 0 {
+		opts.rateLimits = pkg.DefaultRateLimitConfig()
+		opts.rateLimits.MaxSessionsPerTarget = *sf.maxTargetSessions
+	}
+
+	if *sf.auditLog != "" {
+		opts.audit, err = pkg.NewJSONLAuditSink(*sf.auditLog)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+	}
+
+	if *sf.urlKey != "" {
+		opts.urlSigner = pkg.NewURLSigner([]byte(*sf.urlKey))
+	}
+	return targets, opts, nil
+}
+
 func main() {
+	// dispatch to a subcommand, e.g. 'whet serve' or 'whet connect'
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	if len(os.Args) == 1 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	// otherwise run the original single flag set, e.g. 'whet -serve -tcptarget ...'
+	legacyMain()
+}
+
+func legacyMain() {
 	// -serve -server=localhost:9999 -target=localhost:22
 	isServer := flag.Bool("serve", false, "Run in server mode")
 	isNGROK := flag.Bool("ngrok", false, "Run in ngrok server mode")
-	serverAddr := flag.String("server", "localhost:8080", "Server address for signaling")
+	serverAddr := flag.String("server", "localhost:8080", "Server address for signaling, ws:// or wss:// to signal over one WebSocket")
 	btoken := flag.String("token", "", "Bearer token for authorization")
 	gtoken := flag.Bool("gentoken", false, "Generate a new bearer token")
 	detached := flag.Bool("detached", false, "Run in detached mode")
 	sserve := flag.String("mirror", "", "Simple mirror server address (for testing)")
 
 	var tcplisteners targetAddrList
-	flag.Var(&tcplisteners, "tcplisten", "Address to listen on for incoming TCP connections(can specify multiple)")
+	flag.Var(&tcplisteners, "tcplisten", "Address to listen on for incoming connections in the form target=host:port or target=unix:/path[?mode=0600], with ?tls or ?cert=file&key=file to accept TLS (can specify multiple)")
+
+	sf := addServerFlags(flag.CommandLine)
 
-	var tcptargets targetAddrList
-	flag.Var(&tcptargets, "tcptarget", "Target address for server-side TCP connections (can specify multiple)")
+	signURL := flag.String("signurl", "", "Print a signed connect URL for the given target on -server and exit (requires -urlkey)")
+	signTTL := flag.Duration("ttl", time.Hour, "How long a signed connect URL is valid")
+	signOnce := flag.Bool("once", false, "Make the signed connect URL single use")
 
-	var serveFolders serveFolderList
-	flag.Var(&serveFolders, "servefolder", "Folder path(s) to serve in the form subdomain=/absolute/path (can specify multiple)")
+	configFile := flag.String("config", "", "YAML configuration file describing the server and/or client (reloaded on SIGHUP)")
 
-	var proxyTargets proxyTargetList
-	flag.Var(&proxyTargets, "proxytarget", "Proxy target in the form subdomain=address:port (can specify multiple)")
+	flag.Parse()
 
 	if *gtoken {
 		// generate a new bearer token.  We'll use a random UUID for now
@@ -99,27 +263,39 @@ func main() {
 		bearerToken = *btoken
 	}
 
-	flag.Parse()
+	if *configFile != "" {
+		runFromConfig(*configFile)
+		return
+	}
+
+	if *signURL != "" {
+		if *sf.urlKey == "" {
+			log.Fatal("-signurl requires -urlkey")
+		}
+		signed, err := pkg.NewURLSigner([]byte(*sf.urlKey)).SignURL(*serverAddr, *signURL, *signTTL, *signOnce)
+		if err != nil {
+			log.Fatalf("Failed to sign URL: %v", err)
+		}
+		fmt.Println(signed)
+		return
+	}
 
 	if *sserve != "" {
 		go pkg.SimpleMirrorServer(*sserve)
 	}
 
 	if *isServer || *isNGROK {
-		// parse the forward target addresses
-		if len(tcptargets) == 0 && len(proxyTargets) == 0 && len(serveFolders) == 0 {
-			log.Fatal("No server targets specified")
-		}
-		targets, err := pkg.ParseForwardTargetPortsFromStringSlice(tcptargets)
+		targets, opts, err := sf.build()
 		if err != nil {
-			log.Fatalf("Failed to parse forward target addresses: %v", err)
+			log.Fatal(err)
 		}
+		go opts.reloadOnSignal()
 
 		if *isNGROK {
 			ctx := context.Background()
-			runServerNGROK(ctx, targets, serveFolders, proxyTargets, *detached)
+			runServerNGROK(ctx, targets, sf.serveFolders, sf.proxyTargets, opts, *detached)
 		} else {
-			runServer(*serverAddr, targets, serveFolders, proxyTargets, *detached)
+			runServer(*serverAddr, targets, sf.serveFolders, sf.proxyTargets, opts, *detached)
 		}
 	} else {
 		// parse the listener addresses
@@ -130,11 +306,117 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to parse forward target addresses: %v", err)
 		}
-		runClient(*serverAddr, listeners, *detached)
+		runClient(*serverAddr, listeners, bearerToken, *detached)
 	}
 }
 
-func runClient(whetServerAddr string, listeners map[string]*pkg.ListenTargetPort, detached bool) {
+// serverOptions holds the server settings applied after the server is created
+type serverOptions struct {
+	cors       *pkg.CORSConfig
+	tokens     *pkg.TokenStore
+	jwt        *pkg.JWTValidator
+	urlSigner  *pkg.URLSigner
+	rateLimits *pkg.RateLimitConfig
+	audit      pkg.AuditSink
+	sdk        bool
+	remote     bool
+
+	// rendezvous is the rendezvous server the targets are also served through
+	rendezvous      string
+	rendezvousToken string
+	// mdns is the name the server is advertised as on the local network
+	mdns string
+}
+
+func (o *serverOptions) apply(s *pkg.WhetServer) {
+	s.CORS = o.cors
+	s.Tokens = o.tokens
+	s.JWT = o.jwt
+	s.URLSigner = o.urlSigner
+	s.RateLimits = o.rateLimits
+	s.Audit = o.audit
+	s.RemoteListeners = o.remote
+	if o.sdk {
+		if err := sdk.Register(s); err != nil {
+			log.Fatalf("Can't serve the browser SDK: %v", err)
+		} else {
+			fmt.Printf("Serving the browser SDK at %s%s/\n", sdk.Prefix, sdk.Version)
+		}
+	}
+	if o.rendezvous != "" {
+		if _, err := s.StartAgent(o.rendezvous, o.rendezvousToken); err != nil {
+			log.Printf("Not serving targets through %s: %v", o.rendezvous, err)
+		}
+	}
+}
+
+// advertise advertises the server listening on addr on the local network if it has
+// an mDNS name.  Call it once the listener is up.  The advertisement is withdrawn when
+// the process is interrupted, the returned advertiser is nil if there is none.
+func (o *serverOptions) advertise(s *pkg.WhetServer, addr string, tls bool) *pkg.Advertiser {
+	if o.mdns == "" {
+		return nil
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	port, perr := strconv.Atoi(portStr)
+	if err != nil || perr != nil || port == 0 {
+		log.Printf("Not advertising on the local network: invalid listen address %s", addr)
+		return nil
+	}
+	a, err := s.Advertise(o.mdns, port, tls)
+	if err != nil {
+		log.Printf("Not advertising on the local network: %v", err)
+		return nil
+	}
+
+	// send the goodbye on exit so other hosts forget the server rather than waiting for
+	// the records to expire
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		a.Close()
+		os.Exit(0)
+	}()
+	return a
+}
+
+// reloadOnSignal reloads the token store and JWT keys each time the process receives SIGHUP
+func (o *serverOptions) reloadOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if o.tokens != nil {
+			if err := o.tokens.Reload(); err != nil {
+				log.Printf("Failed to reload tokens: %v", err)
+			} else {
+				log.Println("Reloaded tokens")
+			}
+		}
+		if o.jwt != nil {
+			if err := o.jwt.Reload(); err != nil {
+				log.Printf("Failed to reload JWT keys: %v", err)
+			} else {
+				log.Println("Reloaded JWT keys")
+			}
+		}
+	}
+}
+
+func runClient(whetServerAddr string, listeners map[string]*pkg.ListenTargetPort, bearerToken string, detached bool) {
+	// close the listeners on exit so their unix sockets are removed
+	var lmut sync.Mutex
+	var lsockets []net.Listener
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		lmut.Lock()
+		for _, l := range lsockets {
+			l.Close()
+		}
+		os.Exit(0)
+	}()
 
 	// we'll use a channel to wait for all listeners to initialize
 	var wg sync.WaitGroup
@@ -142,14 +424,17 @@ func runClient(whetServerAddr string, listeners map[string]*pkg.ListenTargetPort
 	for _, listener := range listeners {
 		// start a goroutine for each listener
 		go func() {
-			localaddr := fmt.Sprintf("%s:%d", listener.LocalHost, listener.LocalPort)
-			lsocket, err := net.Listen("tcp", localaddr)
+			lsocket, err := listener.Listen()
 			if err != nil {
 				panic(err)
 			}
 			defer lsocket.Close()
+			lmut.Lock()
+			lsockets = append(lsockets, lsocket)
+			lmut.Unlock()
 
-			fmt.Printf("Listening for TCP connections on %s\n", localaddr)
+			// the local port may have been picked by the system
+			fmt.Printf("Listening for connections to %s on %s\n", listener.TargetPath(), lsocket.Addr())
 			// signal the wait group that we're ready
 			wg.Done()
 
@@ -157,11 +442,14 @@ func runClient(whetServerAddr string, listeners map[string]*pkg.ListenTargetPort
 			for {
 				conn, err := lsocket.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					fmt.Printf("Error accepting connection: %v\n", err)
 					continue
 				}
 
-				go pkg.HandleClientConnection(conn, whetServerAddr, listener.TargetName, bearerToken, detached)
+				go pkg.HandleClientConnection(conn, whetServerAddr, listener.TargetPath(), bearerToken, detached)
 			}
 		}()
 	}
@@ -174,9 +462,29 @@ func runClient(whetServerAddr string, listeners map[string]*pkg.ListenTargetPort
 	select {}
 }
 
-func runServerNGROK(ctx context.Context, targets map[string]*pkg.ForwardTargetPort, serveFolders []string, proxyTargets []pkg.ProxyTarget, detached bool) {
+func runServerNGROK(ctx context.Context, targets map[string]*pkg.ForwardTargetPort, serveFolders []string, proxyTargets []pkg.ProxyTarget, opts *serverOptions, detached bool) {
+	listener, err := ngrokListener(ctx, os.Getenv("NGROK_DOMAIN"))
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := pkg.NewWhetServer(bearerToken, targets, serveFolders, proxyTargets, detached)
+	if err != nil {
+		log.Fatalf("Failed to create WHET server: %v", err)
+	}
+	opts.apply(s)
+	if opts.mdns != "" {
+		log.Println("Not advertising an ngrok endpoint on the local network")
+	}
+	err = s.StartWithListener(listener, true)
+	if err != nil {
+		log.Fatalf("Failed to start WHET server: %v", err)
+	}
+}
+
+// ngrokListener opens an ngrok HTTP endpoint, on domain if it is not empty
+func ngrokListener(ctx context.Context, domain string) (net.Listener, error) {
 	token := os.Getenv("NGROK_AUTHTOKEN")
-	domain := os.Getenv("NGROK_DOMAIN")
 	var conf config.Tunnel = nil
 
 	options := make([]config.HTTPEndpointOption, 0)
@@ -185,32 +493,31 @@ func runServerNGROK(ctx context.Context, targets map[string]*pkg.ForwardTargetPo
 	}
 	conf = config.HTTPEndpoint(options...)
 
-	listener, err := ngrok.Listen(ctx,
+	return ngrok.Listen(ctx,
 		conf,
 		ngrok.WithAuthtoken(token),
 	)
-	if err != nil {
-		panic(err)
-	}
+}
 
+func runServer(serverAddr string, targets map[string]*pkg.ForwardTargetPort, serveFolders []string, proxyTargets []pkg.ProxyTarget, opts *serverOptions, detached bool) {
+	// create the regular HTTP server
 	s, err := pkg.NewWhetServer(bearerToken, targets, serveFolders, proxyTargets, detached)
 	if err != nil {
 		log.Fatalf("Failed to create WHET server: %v", err)
 	}
-	err = s.StartWithListener(listener, true)
+	opts.apply(s)
+
+	listener, err := net.Listen("tcp", serverAddr)
 	if err != nil {
 		log.Fatalf("Failed to start WHET server: %v", err)
 	}
-}
+	// serve only speaks plain HTTP, TLS is set up with a configuration file
+	advertiser := opts.advertise(s, listener.Addr().String(), false)
 
-func runServer(serverAddr string, targets map[string]*pkg.ForwardTargetPort, serveFolders []string, proxyTargets []pkg.ProxyTarget, detached bool) {
-	// create the regular HTTP server
-	s, err := pkg.NewWhetServer(bearerToken, targets, serveFolders, proxyTargets, detached)
-	if err != nil {
-		log.Fatalf("Failed to create WHET server: %v", err)
+	err = s.StartWithListener(listener, true)
+	if advertiser != nil {
+		advertiser.Close()
 	}
-
-	err = s.StartWithAddress(serverAddr, true)
 	if err != nil {
 		log.Fatalf("Failed to start WHET server: %v", err)
 	}
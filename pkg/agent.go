@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+An agent serves the targets of a whet server that can't accept connections itself, such
+as one behind NAT, through a public rendezvous whet server:
+
+// on the public host
+whet serve -remotelisteners -listen 0.0.0.0:8080
+
+// on the host with the targets
+whet serve -tcptarget ssh=localhost:22 -rendezvous https://rendezvous.example.com
+
+The agent registers its targets as remote listeners of the rendezvous server and answers
+the offers it relays, so only signaling goes through the rendezvous server and the data
+path is peer to peer.  Clients dial the rendezvous server as if it had the targets.  The
+rendezvous server authenticates the clients, the agent applies its own session limits.
+The registration follows changes to the agent's targets.  With a ws:// or wss://
+rendezvous server the agent registers and receives offers over a signaling WebSocket
+instead of polling.
+*/
+
+// Agent serves a server's targets through a rendezvous whet server
+type Agent struct {
+	server *WhetServer
+	client *relayClient
+}
+
+// StartAgent registers the server's targets with the rendezvous server at signalServer,
+// which must have RemoteListeners set, and answers the offers it relays for them
+func (ws *WhetServer) StartAgent(signalServer string, bearerToken string) (*Agent, error) {
+	a := &Agent{server: ws}
+	a.client = newRelayClient(signalServer, bearerToken, relayAnswerTimeout, a.targets, a.answer)
+	if err := a.client.start(true); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Serving targets through the rendezvous server %s\n", signalServer)
+	return a, nil
+}
+
+// Close removes the agent's targets from the rendezvous server.  Open sessions are not closed.
+func (a *Agent) Close() error {
+	return a.client.close()
+}
+
+// targets returns the targets of the server the agent registers, sorted by name
+func (a *Agent) targets() []relayTarget {
+	a.server.mut.Lock()
+	defer a.server.mut.Unlock()
+	targets := make([]relayTarget, 0, len(a.server.Targets))
+	for name, target := range a.server.Targets {
+		if target.ForwardTargetType == ForwardTargetTypeRemote {
+			continue
+		}
+		targets = append(targets, relayTarget{Name: name, Ports: target.PortCount, Description: target.Description})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets
+}
+
+// answer answers an offer relayed by the rendezvous server like the signaling endpoint would
+func (a *Agent) answer(ctx context.Context, offer relayOffer) (string, error) {
+	ws := a.server
+	name, offsetStr, hasOffset := strings.Cut(offer.Target, "-")
+	offset := 0
+	if hasOffset {
+		var err error
+		if offset, err = strconv.Atoi(offsetStr); err != nil {
+			return "", fmt.Errorf("invalid target %q", offer.Target)
+		}
+	}
+	target, ok := ws.Target(name)
+	if !ok || target.ForwardTargetType == ForwardTargetTypeRemote || offset < 0 || (offset != 0 && offset >= target.PortCount) {
+		return "", fmt.Errorf("invalid target %q", offer.Target)
+	}
+	if limit, _ := ws.reserveSession(name); limit != "" {
+		ws.Metrics.Inc("whet_rate_limited_total", "reason", limit)
+		return "", errors.New("too many sessions")
+	}
+
+	// the rendezvous server authenticated the client
+	identity := &Identity{Name: offer.Identity}
+	if identity.Name == "" {
+		identity.Name = "rendezvous"
+	}
+	remoteAddr := a.client.signalServer
+	server := a.client.signalServer
+	if !IsSocketURL(server) {
+		server = signalURL(server, "")
+	}
+	if u, err := url.Parse(server); err == nil {
+		remoteAddr = u.Host
+	}
+
+	_, answer, err := ws.answerOffer(offer.SDP, target, name, offset, identity, remoteAddr, nil)
+	return answer, err
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// audit event types
+const (
+	AuditSessionOpen  = "session_open"
+	AuditSessionClose = "session_close"
+	AuditAuthFailure  = "auth_failure"
+	AuditAdmin        = "admin"
+)
+
+// AuditEvent is a single record of the audit log
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	SessionID  string    `json:"session_id,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	TargetAddr string    `json:"target_addr,omitempty"`
+	// Backend is the address the target connection was made to, one of the backends of a pool
+	Backend string `json:"backend,omitempty"`
+	// the ICE candidates selected for the session's peer connection
+	LocalCandidate  string `json:"local_candidate,omitempty"`
+	RemoteCandidate string `json:"remote_candidate,omitempty"`
+	// bytes received from and sent to the client
+	BytesIn    int64  `json:"bytes_in,omitempty"`
+	BytesOut   int64  `json:"bytes_out,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// AuditSink receives audit events.  Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Audit(event *AuditEvent)
+}
+
+// AuditSinkFunc adapts a function to an AuditSink
+type AuditSinkFunc func(event *AuditEvent)
+
+func (f AuditSinkFunc) Audit(event *AuditEvent) {
+	f(event)
+}
+
+// JSONLAuditSink appends audit events to a file as JSON lines
+type JSONLAuditSink struct {
+	mut  *sync.Mutex
+	file *os.File
+}
+
+// NewJSONLAuditSink opens filename for appending audit events, creating it if needed
+func NewJSONLAuditSink(filename string) (*JSONLAuditSink, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLAuditSink{
+		mut:  &sync.Mutex{},
+		file: f,
+	}, nil
+}
+
+func (s *JSONLAuditSink) Audit(event *AuditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Error encoding audit event: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, err := s.file.Write(data); err != nil {
+		fmt.Printf("Error writing audit event: %v\n", err)
+	}
+}
+
+func (s *JSONLAuditSink) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.file.Close()
+}
+
+// audit sends an event to the server's audit sink, if one is configured
+func (ws *WhetServer) audit(event *AuditEvent) {
+	if ws.Audit == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	ws.Audit.Audit(event)
+}
+
+// auditSession builds an audit event describing a server side session.  The session's
+// fields are written under ws.mut, so it must be held.
+func auditSession(event string, c *Connection) *AuditEvent {
+	e := &AuditEvent{
+		Event:           event,
+		SessionID:       c.id,
+		RemoteAddr:      c.remoteAddr,
+		Target:          c.targetName,
+		TargetAddr:      c.targetAddr,
+		Backend:         c.backend,
+		LocalCandidate:  c.localCandidate,
+		RemoteCandidate: c.remoteCandidate,
+		BytesIn:         c.BytesIn(),
+		BytesOut:        c.BytesOut(),
+		Reason:          c.closeReason,
+	}
+	if c.identity != nil {
+		e.Identity = c.identity.Name
+	}
+	if event == AuditSessionClose {
+		e.DurationMs = time.Since(c.created).Milliseconds()
+	}
+	return e
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJSONLAuditSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(filename, []byte(`{"event":"earlier"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewJSONLAuditSink(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.Audit(&AuditEvent{Event: AuditAdmin, Action: "test", Detail: strings.Repeat("x", 4096)})
+		}()
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	var events []*AuditEvent
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %d is not a JSON object: %v", len(events)+1, err)
+		}
+		events = append(events, &event)
+	}
+	if len(events) != 51 {
+		t.Fatalf("expected 51 lines, got %d", len(events))
+	}
+	// the existing log is appended to
+	if events[0].Event != "earlier" {
+		t.Errorf("expected the earlier event to be kept, got %+v", events[0])
+	}
+	for _, event := range events[1:] {
+		if event.Event != AuditAdmin || len(event.Detail) != 4096 {
+			t.Fatalf("expected whole events, got %s with %d bytes of detail", event.Event, len(event.Detail))
+		}
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	target, err := ParseForwardTargetPortFromString("echo=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewWhetServer("secret", map[string]*ForwardTargetPort{"echo": target}, nil, nil, true)
+	s.URLSigner = NewURLSigner([]byte("key"))
+	var mut sync.Mutex
+	var events []*AuditEvent
+	s.Audit = AuditSinkFunc(func(event *AuditEvent) {
+		mut.Lock()
+		defer mut.Unlock()
+		events = append(events, event)
+	})
+	find := func(kind string) *AuditEvent {
+		mut.Lock()
+		defer mut.Unlock()
+		for _, event := range events {
+			if event.Event == kind {
+				return event
+			}
+		}
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := "http://" + listener.Addr().String()
+
+	d := &Dialer{Timeout: 20 * time.Second}
+	if _, err := d.Dial(server, "whet/echo", "wrong"); err == nil {
+		t.Fatalf("expected the wrong token to be rejected")
+	}
+	if event := find(AuditAuthFailure); event == nil || event.Target != "echo" || event.Reason == "" || event.RemoteAddr == "" {
+		t.Fatalf("expected an auth_failure event, got %+v", event)
+	}
+
+	conn, err := d.Dial(server, "whet/echo", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello audit log")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	open := find(AuditSessionOpen)
+	if open == nil || open.Identity != "default" || open.Target != "echo" || open.TargetAddr != echo.Addr().String() || open.SessionID == "" {
+		t.Fatalf("expected a session_open event, got %+v", open)
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected one session, got %d", len(sessions))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sessions[0].BytesIn() < int64(len(msg)) || sessions[0].BytesOut() < int64(len(msg)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the echoed bytes to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// killing the session through the admin API records both the change and the close
+	r := httptest.NewRequest("DELETE", "/api/sessions/"+open.SessionID, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the session to be killed, got %d", w.Code)
+	}
+	if event := find(AuditAdmin); event == nil || event.Action != "session_kill" || event.Detail != open.SessionID || event.Identity != "default" {
+		t.Fatalf("expected an admin event for the kill, got %+v", event)
+	}
+	closed := find(AuditSessionClose)
+	if closed == nil || closed.SessionID != open.SessionID || closed.Reason != "killed" || closed.DurationMs <= 0 ||
+		closed.BytesIn < int64(len(msg)) || closed.BytesOut < int64(len(msg)) {
+		t.Fatalf("expected a session_close event with bytes, duration and reason, got %+v", closed)
+	}
+
+	r = httptest.NewRequest("POST", "/api/sign", strings.NewReader(`{"target":"echo","ttl":"1m"}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a signed url, got %d", w.Code)
+	}
+	mut.Lock()
+	last := events[len(events)-1]
+	mut.Unlock()
+	if last.Event != AuditAdmin || last.Action != "sign_url" || !strings.Contains(last.Detail, "target=echo") {
+		t.Errorf("expected an admin event for the signed url, got %+v", last)
+	}
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// bearerFromRequest returns the bearer token from the Authorization header of r
+func bearerFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// remoteIP returns the IP address of the client that made r, or nil if it can't be determined
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// authenticate returns the identity of the caller of r.  A signed connect URL is accepted
+// in place of the Authorization header.  Bearer tokens shaped like a JWT are checked by
+// the server's JWT validator, other tokens against the token store followed by the
+// single server wide BearerToken.  When the server has no authentication configured
+// every caller is anonymous, see anonymousIdentity.
+func (ws *WhetServer) authenticate(r *http.Request) (*Identity, error) {
+	if ws.URLSigner != nil && strings.HasPrefix(r.URL.Path, "/whet/") && isSignedURL(r.URL.Query()) {
+		return ws.URLSigner.Verify(strings.TrimPrefix(r.URL.Path, "/whet/"), r.URL.Query())
+	}
+
+	secret := bearerFromRequest(r)
+
+	if ws.JWT != nil && looksLikeJWT(secret) {
+		return ws.JWT.Validate(secret)
+	}
+
+	if ws.Tokens != nil {
+		t, err := ws.Tokens.Lookup(secret, remoteIP(r))
+		if err == nil {
+			return t.Identity(), nil
+		}
+		if err != ErrUnknownToken {
+			return nil, err
+		}
+	}
+
+	if ws.BearerToken != "" {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(ws.BearerToken)) == 1 {
+			return &Identity{Name: "default", Admin: true}, nil
+		}
+		return nil, ErrUnauthorized
+	}
+
+	if ws.Tokens != nil || ws.JWT != nil || ws.URLSigner != nil {
+		return nil, ErrUnauthorized
+	}
+
+	return anonymousIdentity, nil
+}
+
+// requireIdentity authenticates r.  Failures count towards the client's lockout like
+// failed offers, and a locked out client is refused before its credentials are checked.
+// On failure an error response is written and nil is returned.
+func (ws *WhetServer) requireIdentity(w http.ResponseWriter, r *http.Request) *Identity {
+	clientIP := remoteIP(r).String()
+	if err := ws.checkLockout(clientIP); err != nil {
+		ws.rejectOffer(w, err)
+		return nil
+	}
+	identity, err := ws.authenticate(r)
+	if err != nil {
+		ws.authFailed(r, clientIP, "", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	return identity
+}
+
+// requireAdmin authenticates r and checks that the caller may use the admin API, which
+// an anonymous caller only may from a loopback address.
+// On failure an error response is written and nil is returned.
+func (ws *WhetServer) requireAdmin(w http.ResponseWriter, r *http.Request) *Identity {
+	identity := ws.requireIdentity(w, r)
+	if identity == nil {
+		return nil
+	}
+	// without authentication the admin API is only served to callers on this host
+	if identity == anonymousIdentity && remoteIP(r).IsLoopback() {
+		return identity
+	}
+	if !identity.Admin {
+		ws.audit(&AuditEvent{Event: AuditAuthFailure, RemoteAddr: r.RemoteAddr, Identity: identity.Name, Action: r.URL.Path, Reason: "not an admin"})
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	return identity
+}
+
+// auditAdmin records a change made through the admin API
+func (ws *WhetServer) auditAdmin(r *http.Request, identity *Identity, action string, detail string) {
+	ws.audit(&AuditEvent{
+		Event:      AuditAdmin,
+		RemoteAddr: r.RemoteAddr,
+		Identity:   identity.Name,
+		Action:     action,
+		Detail:     detail,
+	})
+}
+
+// requestBaseURL returns the scheme and host the client used to reach the server
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
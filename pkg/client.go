@@ -3,14 +3,16 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +20,20 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// SignalError is returned when the signal server rejects an offer, e.g. with 401 when
+// the bearer token is not accepted or 429 when the client is rate limited
+type SignalError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *SignalError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("signaling failed: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("signaling failed: %d %s", e.StatusCode, e.Message)
+}
+
 var dataChannelConfig = &webrtc.DataChannelInit{
 	// ensures that data messages are delivered in the order they were sent
 	Ordered: &[]bool{true}[0],
@@ -29,7 +45,7 @@ func HandleClientConnection(conn net.Conn, signalServer string, targetName strin
 	defer conn.Close()
 
 	// create a new WebRTC peer connection
-	_, peerConnection, err := setupWebRTCConnection(detached)
+	_, peerConnection, err := setupWebRTCConnection(detached, nil)
 	if err != nil {
 		fmt.Printf("HandleClientConnection failed to create peer connection: %v\n", err)
 		return
@@ -131,76 +147,27 @@ func HandleClientConnection(conn net.Conn, signalServer string, targetName strin
 
 	fmt.Println(offerString)
 
-	if strings.HasPrefix(signalServer, "http") {
-		signalServer = fmt.Sprintf("%s/whet/%s", signalServer, targetName)
-	} else {
-		signalServer = fmt.Sprintf("http://%s/whet/%s", signalServer, targetName)
-	}
-
-	// post the request to the whet server
-	client := getHttpClient()
-
-	fmt.Printf("Making request to signal server URL: %s\n", signalServer)
-	req, err := http.NewRequest("POST", signalServer, bytes.NewBuffer([]byte(offerString)))
-	if err != nil {
-		fmt.Printf("Error creating request: %v\n", err)
-		return
-	}
-
-	req.Header.Add("Content-Type", "application/sdp")
-	if bearerToken != "" {
-		req.Header.Add("Authorization", "Bearer "+bearerToken)
-	}
-
-	resp, err := client.Do(req)
+	// send the offer to the whet server
+	answer, err := signalOffer(context.Background(), signalServer, "whet/"+targetName, bearerToken, offerString)
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
-		fmt.Println(err.Error())
-		return
-	}
-
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
-		// return nil, nil, err
-	}
-
-	if resp.StatusCode != 201 && resp.StatusCode != 200 {
-		return
-		// return nil, nil, fmt.Errorf(fmt.Sprintf("non successful POST: %d", resp.StatusCode))
-	}
-
-	resourceUrl, err := url.Parse(resp.Header.Get("Location"))
-	if err != nil {
-		return
-		// return nil, nil, err
-	}
-	base, err := url.Parse(signalServer)
-	if err != nil {
 		return
-		// return nil, nil, err
 	}
-
-	// Get the connection ID from the resource URL
-	connectionID := resourceUrl.Path[strings.LastIndex(resourceUrl.Path, "/")+1:]
-
-	answer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  string(body),
-	}
-
-	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP})
-	if err != nil {
-		fmt.Printf("Failed to set remote description: %v\n", err)
+	if err := answer.start(peerConnection); err != nil {
+		fmt.Printf("%v\n", err)
+		if answer.socket != nil {
+			answer.socket.close()
+		}
 		return
 	}
+	connectionID := answer.connectionID
 
 	// store the connection in the map
 	c.peerConnection = peerConnection
 	c.dataChannel = dataChannel
 	c.conn = conn
-	c.resourceURL = base.ResolveReference(resourceUrl).String()
+	c.resourceURL = answer.resourceURL
+	c.socket = answer.socket
 	c.clientReady = false
 
 	// Client side WebRTC to TCP proxy (input from WebRTC, output to local TCP)
@@ -269,20 +236,8 @@ func HandleClientConnection(conn net.Conn, signalServer string, targetName strin
 				c.peerConnection.Close()
 
 				// call the "DELETE" on the host ResourceUrl if one was provided
-				if c.resourceURL != "" {
-					req, err := http.NewRequest("DELETE", c.resourceURL, nil)
-					if err != nil {
-						log.Fatal("Unexpected error building http request. ", err)
-					}
-					if bearerToken != "" {
-						req.Header.Add("Authorization", "Bearer "+bearerToken)
-					}
-
-					client := getHttpClient()
-					_, err = client.Do(req)
-					if err != nil {
-						fmt.Printf("Failed http DELETE request: %s\n", err)
-					}
+				if err := c.closeSignaling(); err != nil {
+					fmt.Printf("%v\n", err)
 				}
 				done <- struct{}{}
 				return
@@ -315,6 +270,84 @@ func HandleClientConnection(conn net.Conn, signalServer string, targetName strin
 	fmt.Println("Connection closed")
 }
 
+// Listen opens the local TCP port or unix socket of the listener.  A stale unix socket
+// left behind by a previous run is removed first.  With TLS set connections are
+// accepted over TLS.
+func (l *ListenTargetPort) Listen() (net.Listener, error) {
+	listener, err := l.listen()
+	if err != nil || !l.TLS {
+		return listener, err
+	}
+
+	var cert tls.Certificate
+	if l.TLSCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(l.TLSCertFile, l.TLSKeyFile)
+	} else {
+		cert, err = SelfSignedCertificate(l.LocalHost, "localhost", "127.0.0.1", "::1")
+		if err == nil {
+			fmt.Printf("Using a self-signed certificate for %s with SHA-256 fingerprint %s\n", l.TargetPath(), CertificateFingerprint(cert))
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
+
+// listen opens the plain TCP or unix socket listener
+func (l *ListenTargetPort) listen() (net.Listener, error) {
+	if l.SocketPath == "" {
+		return net.Listen("tcp", net.JoinHostPort(l.LocalHost, strconv.Itoa(l.LocalPort)))
+	}
+
+	if info, err := os.Lstat(l.SocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", l.SocketPath)
+		}
+		// only remove the socket if nothing is listening on it
+		if conn, err := net.Dial("unix", l.SocketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", l.SocketPath)
+		}
+		os.Remove(l.SocketPath)
+	}
+
+	listener, err := net.Listen("unix", l.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	if l.SocketMode != 0 {
+		if err := os.Chmod(l.SocketPath, l.SocketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// IsConnectURL reports if signalServer is a complete connect URL that already names the
+// target, such as a signed URL like https://example.com/whet/ssh?exp=...&sig=...
+func IsConnectURL(signalServer string) bool {
+	u, err := url.Parse(signalServer)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return isSignedURL(u.Query()) || (strings.HasPrefix(u.Path, "/whet/") && len(u.Path) > len("/whet/"))
+}
+
+// signalURL builds the URL an offer is posted to from the signal server address and
+// the target path.  Complete connect URLs are used as is.
+func signalURL(signalServer string, targetPath string) string {
+	if !strings.HasPrefix(signalServer, "http") {
+		signalServer = "http://" + signalServer
+	}
+	if IsConnectURL(signalServer) {
+		return signalServer
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(signalServer, "/"), targetPath)
+}
+
 func getHttpClient() *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
@@ -331,15 +364,34 @@ func getHttpClient() *http.Client {
 }
 
 func DialClientConnection(signalServer string, targetName string, bearerToken string, detached bool) (*Connection, error) {
+	return dialClientConnection(context.Background(), signalServer, targetName, bearerToken, detached, nil)
+}
+
+// dialClientConnection is DialClientConnection giving up when ctx is done, using the
+// package ICEServers when iceServers is nil
+func dialClientConnection(ctx context.Context, signalServer string, targetName string, bearerToken string, detached bool, iceServers []webrtc.ICEServer) (*Connection, error) {
 	// Create a SettingEngine and enable Detach
 	errstr := ""
 
 	// create a new WebRTC peer connection
-	_, peerConnection, err := setupWebRTCConnection(detached)
+	_, peerConnection, err := setupWebRTCConnection(detached, iceServers)
 	if err != nil {
 		return nil, fmt.Errorf("DialClientConnection failed to create peer connection: %v", err)
 	}
 
+	// close the peer connection and any session on a signaling socket unless the
+	// connection is established
+	established := false
+	var socket *socketSession
+	defer func() {
+		if !established {
+			peerConnection.Close()
+			if socket != nil {
+				socket.close()
+			}
+		}
+	}()
+
 	dataChannel, err := peerConnection.CreateDataChannel("data", dataChannelConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create data channel: %v", err)
@@ -400,98 +452,64 @@ func DialClientConnection(signalServer string, targetName string, bearerToken st
 		return nil, err
 	}
 
-	<-gatherComplete
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
 	offerString := peerConnection.LocalDescription().SDP
 
 	fmt.Println(offerString)
 
-	// replace all "." with "/" and merge with the signal server URL base
+	// replace all "." with "/" to make the target path
 	targetName = strings.ReplaceAll(targetName, ".", "/")
 
-	if strings.HasPrefix(signalServer, "http") {
-		signalServer = fmt.Sprintf("%s/%s", signalServer, targetName)
-	} else {
-		signalServer = fmt.Sprintf("http://%s/%s", signalServer, targetName)
-	}
-
-	// post the request to the whet server
-	client := getHttpClient()
-
-	fmt.Printf("WHET client using endpoint%s\n", signalServer)
-	req, err := http.NewRequest("POST", signalServer, bytes.NewBuffer([]byte(offerString)))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Content-Type", "application/sdp")
-	if bearerToken != "" {
-		req.Header.Add("Authorization", "Bearer "+bearerToken)
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 201 && resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non successful POST: %d", resp.StatusCode)
-	}
-
-	// location provides the resource URL that is used to manage the connection
-	// the last part of the URL is the connection ID
-	location := resp.Header.Get("Location")
-	if location == "" {
-		return nil, fmt.Errorf("location not found in response")
-	}
-
-	resourceUrl, err := url.Parse(location)
-	log.Default().Println("Resource URL: ", resourceUrl)
-	fmt.Printf("Resource URL %s\n", resourceUrl)
+	// send the offer to the whet server
+	answer, err := signalOffer(ctx, signalServer, targetName, bearerToken, offerString)
 	if err != nil {
 		return nil, err
 	}
-	base, err := url.Parse(signalServer)
-	if err != nil {
+	socket = answer.socket
+	if err := answer.start(peerConnection); err != nil {
 		return nil, err
 	}
-
-	// Get the connection ID from the resource URL
-	connectionID := resourceUrl.Path[strings.LastIndex(resourceUrl.Path, "/")+1:]
-
-	answer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  string(body),
-	}
-
-	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP})
-	if err != nil {
-		return nil, fmt.Errorf("failed to set remote description: %v", err)
-	}
+	connectionID := answer.connectionID
 
 	// store the connection in the map
 	c.peerConnection = peerConnection
 	c.dataChannel = dataChannel
 	c.conn = nil
-	c.resourceURL = base.ResolveReference(resourceUrl).String()
+	c.resourceURL = answer.resourceURL
+	c.socket = answer.socket
 	c.clientReady = false
 
 	connectionsLock.Lock()
-	defer connectionsLock.Unlock()
 	OpenConnections[connectionID] = c
+	connectionsLock.Unlock()
 
 	// wait for the connection handshake to complete
-	wg.Wait()
+	handshakeDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(handshakeDone)
+	}()
+	select {
+	case <-handshakeDone:
+	case <-ctx.Done():
+		connectionsLock.Lock()
+		delete(OpenConnections, connectionID)
+		connectionsLock.Unlock()
+		return nil, ctx.Err()
+	}
 
 	if errstr != "" {
+		connectionsLock.Lock()
+		delete(OpenConnections, connectionID)
+		connectionsLock.Unlock()
 		return nil, errors.New(errstr)
 	}
 
+	established = true
 	return c, nil
 }
@@ -7,6 +7,8 @@ import (
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/datachannel"
 	"github.com/pion/webrtc/v4"
@@ -30,19 +32,53 @@ type Connection struct {
 	dataChannel    *webrtc.DataChannel
 	conn           net.Conn
 	resourceURL    string
+	socket         *socketSession
 	clientReady    bool
 	detached       bool
 	rawDetached    datachannel.ReadWriteCloser
 	sendMoreCh     chan struct{} // rate control signal
 	bearerToken    string
 	closed         bool
+	identity       *Identity
+	// sharedPeer is set when other data channels share the peer connection, closing the
+	// connection then only closes its data channel
+	sharedPeer bool
+
+	// server side session state
+	id              string
+	targetName      string
+	targetAddr      string
+	backend         string
+	remoteAddr      string
+	created         time.Time
+	connected       bool
+	ended           bool
+	closeReason     string
+	localCandidate  string
+	remoteCandidate string
+
+	// bytes received from and sent to the peer over the data channel
+	bytesIn  int64
+	bytesOut int64
+}
+
+// ICEServers are the STUN and TURN servers used by new peer connections
+var ICEServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
 }
 
 func DefaultPeerConnectionConfig() webrtc.Configuration {
+	return peerConnectionConfig(nil)
+}
+
+// peerConnectionConfig is the default configuration with the given ICE servers, or the
+// package ICEServers when nil
+func peerConnectionConfig(iceServers []webrtc.ICEServer) webrtc.Configuration {
+	if iceServers == nil {
+		iceServers = ICEServers
+	}
 	return webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+		ICEServers: iceServers,
 		// Use a single transport for all media streams. In our case, we're not dealing with media streams,
 		// but setting this to MaxBundle can potentially reduce overhead by minimizing the number of network connections used
 		BundlePolicy: webrtc.BundlePolicyMaxBundle,
@@ -92,6 +128,21 @@ func (c *Connection) Closed() bool {
 	return c.closed
 }
 
+// BytesIn returns the number of bytes received from the peer
+func (c *Connection) BytesIn() int64 {
+	return atomic.LoadInt64(&c.bytesIn)
+}
+
+// BytesOut returns the number of bytes sent to the peer
+func (c *Connection) BytesOut() int64 {
+	return atomic.LoadInt64(&c.bytesOut)
+}
+
+// Identity returns the authenticated identity of the client on server side connections
+func (c *Connection) Identity() *Identity {
+	return c.identity
+}
+
 // SendRawDataChannel sends data over the data channel and blocks until all data has been sent.
 func (c *Connection) SendRawDataChannel(data []byte) error {
 	// if !c.detached {
@@ -123,12 +174,14 @@ func (c *Connection) SendRawDataChannel(data []byte) error {
 				return err
 			}
 			sentData += n
+			atomic.AddInt64(&c.bytesOut, int64(n))
 		} else {
 			err := c.dataChannel.Send(data[sentData : sentData+maxwrite])
 			if err != nil {
 				return err
 			}
 			sentData += maxwrite
+			atomic.AddInt64(&c.bytesOut, int64(maxwrite))
 		}
 
 		// check if we can send more
@@ -166,11 +219,13 @@ func (c *Connection) ReceiveRaw(data []byte) (int, error) {
 		}
 		return r, io.EOF
 	}
+	atomic.AddInt64(&c.bytesIn, int64(r))
 	return r, nil
 }
 
 // setupWebRTCConnection creates a new WebRTC API and PeerConnection with the given settings.
-func setupWebRTCConnection(detached bool) (*webrtc.API, *webrtc.PeerConnection, error) {
+// The package ICEServers are used when iceServers is nil.
+func setupWebRTCConnection(detached bool, iceServers []webrtc.ICEServer) (*webrtc.API, *webrtc.PeerConnection, error) {
 	// Create a SettingEngine and enable Detach
 	s := webrtc.SettingEngine{}
 	if detached {
@@ -180,8 +235,7 @@ func setupWebRTCConnection(detached bool) (*webrtc.API, *webrtc.PeerConnection,
 	// Create an API object with the engine
 	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
 
-	peerConnectionConfig := DefaultPeerConnectionConfig()
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig(iceServers))
 	if err != nil {
 		return nil, nil, fmt.Errorf("setupWebRTCConnection failed to create peer connection: %v", err)
 	}
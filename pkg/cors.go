@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig controls which browser origins may use the whet signaling endpoints.
+// Origins are matched either exactly ("https://dash.example.com") or as a wildcard
+// subdomain ("https://*.example.com").  A single "*" allows every origin.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowCredentials bool
+	// MaxAge is how long a browser may cache the result of a preflight request
+	MaxAge time.Duration
+}
+
+// the headers a browser client is allowed to send and read
+const (
+	corsAllowHeaders  = "Content-Type, Authorization"
+	corsExposeHeaders = "Location"
+)
+
+// ParseOriginList splits a comma separated list of origins
+func ParseOriginList(value string) []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// originMatches reports if origin is matched by any of the given patterns
+func originMatches(patterns []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+		if pattern == "*" {
+			return true
+		}
+
+		// split off the optional scheme of the pattern
+		pscheme := ""
+		phost := pattern
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			pscheme = pattern[:i]
+			phost = pattern[i+3:]
+		}
+		if pscheme != "" && pscheme != scheme {
+			continue
+		}
+
+		if strings.HasPrefix(phost, "*.") {
+			// wildcard subdomains match any depth of subdomain, but not the apex domain itself
+			if strings.HasSuffix(host, phost[1:]) {
+				return true
+			}
+		} else if phost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// corsConfig returns the server level CORS configuration, which SetCORS may replace
+func (ws *WhetServer) corsConfig() *CORSConfig {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	return ws.CORS
+}
+
+// targetOriginAllowed reports if a browser origin may open the given target.  Requests
+// without an Origin header do not come from a browser and are not restricted.
+func targetOriginAllowed(target *ForwardTargetPort, origin string) bool {
+	if origin == "" || len(target.AllowedOrigins) == 0 {
+		return true
+	}
+	return originMatches(target.AllowedOrigins, origin)
+}
+
+// setCORSHeaders writes the CORS headers for the response to r.  It returns false if
+// the request carries an Origin header that is not allowed by the server.
+func (ws *WhetServer) setCORSHeaders(w http.ResponseWriter, r *http.Request, methods string) bool {
+	h := w.Header()
+
+	cors := ws.corsConfig()
+	if cors == nil {
+		// no CORS configuration, allow every origin
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		return true
+	}
+
+	// the response varies with the origin, so caches must not share it between origins
+	h.Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a cross origin browser request
+		return true
+	}
+
+	if !originMatches(cors.AllowedOrigins, origin) {
+		return false
+	}
+
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", methods)
+	h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	if cors.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if r.Method == http.MethodOptions && cors.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+	}
+	return true
+}
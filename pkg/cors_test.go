@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginMatches(t *testing.T) {
+	patterns := []string{"https://dash.example.com/", "https://*.apps.example.com", "lab.example.org"}
+	for _, tt := range []struct {
+		origin string
+		want   bool
+	}{
+		{"https://dash.example.com", true},
+		{"HTTPS://Dash.Example.com", true},
+		{"http://dash.example.com", false},
+		{"https://dash.example.com:8443", false},
+		{"https://a.apps.example.com", true},
+		{"https://a.b.apps.example.com", true},
+		{"https://apps.example.com", false},
+		{"https://evilapps.example.com", false},
+		{"http://lab.example.org", true},
+		{"https://lab.example.org", true},
+		{"https://evil.example.com", false},
+		{"null", false},
+		{"", false},
+	} {
+		if got := originMatches(patterns, tt.origin); got != tt.want {
+			t.Errorf("%q: expected %t, got %t", tt.origin, tt.want, got)
+		}
+	}
+	if !originMatches([]string{"*"}, "https://anything.example.net") {
+		t.Errorf("expected * to match every origin")
+	}
+}
+
+func TestSetCORSHeaders(t *testing.T) {
+	restricted := &CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true, MaxAge: 10 * time.Minute}
+	for _, tt := range []struct {
+		name    string
+		cors    *CORSConfig
+		method  string
+		origin  string
+		allowed bool
+		headers map[string]string
+	}{
+		{
+			name: "no configuration", method: "POST", origin: "https://evil.example.net", allowed: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Methods": "POST, OPTIONS", "Vary": ""},
+		},
+		{
+			name: "allowed origin", cors: restricted, method: "POST", origin: "https://dash.example.com", allowed: true,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://dash.example.com",
+				"Access-Control-Allow-Methods":     "POST, OPTIONS",
+				"Access-Control-Allow-Headers":     corsAllowHeaders,
+				"Access-Control-Expose-Headers":    corsExposeHeaders,
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name: "preflight", cors: restricted, method: "OPTIONS", origin: "https://dash.example.com", allowed: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "https://dash.example.com", "Access-Control-Max-Age": "600"},
+		},
+		{
+			name: "rejected origin", cors: restricted, method: "OPTIONS", origin: "https://evil.example.net", allowed: false,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Max-Age": "", "Vary": "Origin"},
+		},
+		{
+			name: "no origin", cors: restricted, method: "POST", allowed: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+	} {
+		s, _ := NewWhetServer("", nil, nil, nil, true)
+		s.SetCORS(tt.cors)
+		r := httptest.NewRequest(tt.method, "/whet/ssh", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		if allowed := s.setCORSHeaders(w, r, "POST, OPTIONS"); allowed != tt.allowed {
+			t.Errorf("%s: expected allowed %t, got %t", tt.name, tt.allowed, allowed)
+		}
+		for name, want := range tt.headers {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("%s: expected %s %q, got %q", tt.name, name, want, got)
+			}
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s, _ := NewWhetServer("secret", nil, nil, nil, true)
+	s.SetCORS(&CORSConfig{AllowedOrigins: []string{"https://dash.example.com"}})
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/whet/ssh", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		s.Mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := preflight("https://dash.example.com"); w.Code != 200 || w.Header().Get("Access-Control-Allow-Origin") != "https://dash.example.com" {
+		t.Errorf("expected the preflight to be allowed, got %d %v", w.Code, w.Header())
+	}
+	if w := preflight("https://evil.example.com"); w.Code != 403 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected the preflight to be refused, got %d %v", w.Code, w.Header())
+	}
+}
@@ -3,8 +3,12 @@ package pkg
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -23,17 +27,47 @@ import (
 // create a range of non-local ports with the forward id of 'remoterange'
 -tcptarget remoterange=192.168.0.33:10000-10010
 
+// forward the docker unix socket with the forward id of 'docker'
+-tcptarget docker=unix:/var/run/docker.sock
+
+// originate TLS to an internal service with its own CA, using a client certificate
+-tcptarget api=10.0.0.9:443?tls&sni=api.internal&ca=/etc/whet/ca.pem&cert=/etc/whet/client.pem&key=/etc/whet/client.key
+
+// terminate TLS locally with a self-signed certificate for clients that expect TLS
+-tcplisten ssh=localhost:8822?tls
+
+// or with a provided certificate
+-tcplisten web=localhost:8443?cert=/etc/whet/local.pem&key=/etc/whet/local.key
+
+// forward a pool of database replicas, using the first healthy one checked every 10 seconds
+-tcptarget db=10.0.0.5:5432,10.0.0.6:5432?policy=first&health=10s&timeout=3s
+
+// spread connections over a pool of backends
+-tcptarget web=10.0.0.7:80,10.0.0.8:80?policy=roundrobin
+
+// resolve the backends from a DNS SRV record at each connection
+-tcptarget db=srv:_postgres._tcp.example.com
+
 // forward the port defined in ssh and map to local port localhost:8822
--tcplisten ssh:8822
+-tcplisten ssh=localhost:8822
 
 // forward the port defined in sshelsewhere and map to local port 0.0.0.0:8823
--tcplisten sshelsewhere:0.0.0.0:8823
+-tcplisten sshelsewhere=0.0.0.0:8823
 
 // forward the port defined in sshelsewhere and map to local port 192.168.0.48:8823
--tcplisten sshelsewhere:192.168.0.48:8823
+-tcplisten sshelsewhere=192.168.0.48:8823
+
+// forward the port 10010 (offset 10) from the range of 10000-10010 and map to local port localhost:8824
+-tcplisten range-10=localhost:8824
+
+// forward the whole range of 10000-10010 to local ports 20000-20010
+-tcplisten range=127.0.0.1:20000-20010
 
-// forward the port 10010 from the range of 10000-10010 and map to local port localhost:8824
--tcplisten range-10010:8824
+// forward ports 10002-10004 of the range to local ports 20000-20002
+-tcplisten range-2=127.0.0.1:20000-20002
+
+// forward the docker target to a local unix socket only the current user may use
+-tcplisten docker=unix:/tmp/remote-docker.sock?mode=0600
 */
 
 type ForwardTargetType int
@@ -41,8 +75,25 @@ type ForwardTargetType int
 const (
 	ForwardTargetTypeTCP ForwardTargetType = iota
 	ForwardTargetTypeListener
+	ForwardTargetTypeUnix
+	// ForwardTargetTypeRemote is served by a remote listener, see relay.go
+	ForwardTargetTypeRemote
 )
 
+func (t ForwardTargetType) String() string {
+	switch t {
+	case ForwardTargetTypeTCP:
+		return "tcp"
+	case ForwardTargetTypeListener:
+		return "listener"
+	case ForwardTargetTypeUnix:
+		return "unix"
+	case ForwardTargetTypeRemote:
+		return "remote"
+	}
+	return "unknown"
+}
+
 // ForwardTargetPort represents a target port to forward from the server to the client, or a target listener from the server to the client
 type ForwardTargetPort struct {
 	TargetName        string
@@ -50,17 +101,104 @@ type ForwardTargetPort struct {
 	StartPort         int
 	PortCount         int
 	ForwardTargetType ForwardTargetType
+	// AllowedOrigins restricts the browser origins that may open this target.
+	// An empty list allows any origin the server allows.
+	AllowedOrigins []string
+	// Description is a human readable description shown in the target listing
+	Description string
+	// Path is the socket path of a unix socket target
+	Path string
+	// Backends lists the hosts of a pool target.  Each backend serves the same
+	// PortCount ports.  When empty Host and StartPort are the only backend.
+	Backends []TargetBackend
+	// SRV is a DNS SRV name resolved to the backends at each connection
+	SRV string
+	// Policy selects a backend of a pool, PolicyFirst or PolicyRoundRobin
+	Policy string
+	// DialTimeout limits how long connecting to a backend may take, 0 for the default
+	DialTimeout time.Duration
+	// HealthInterval is how often the backends of a pool are checked, 0 for never.
+	// Backends failing the check are skipped while any backend is healthy.
+	HealthInterval time.Duration
+	// TLS originates TLS to the backends so plaintext clients can reach TLS-only
+	// services, when nil connections to the backends are not wrapped
+	TLS *TargetTLS
+
+	next   uint32
+	health *targetHealth
+	// relay is the remote listener serving a ForwardTargetTypeRemote target
+	relay *relayListener
+}
+
+// TargetBackend is one host of a pool target
+type TargetBackend struct {
+	Host      string
+	StartPort int
 }
 
+// backend selection policies of pool targets
+const (
+	// PolicyFirst uses the first healthy backend in the order listed
+	PolicyFirst = "first"
+	// PolicyRoundRobin rotates through the healthy backends
+	PolicyRoundRobin = "roundrobin"
+)
+
+// srvPrefix marks the address of a target as a DNS SRV name
+const srvPrefix = "srv:"
+
+// unixPrefix marks the address of a target or listener as a unix socket path
+const unixPrefix = "unix:"
+
 // represents a client-side port forward to a target port
 type ListenTargetPort struct {
 	TargetName string
 	LocalHost  string
 	LocalPort  int
-	PortIndex  int
+	// PortIndex is the offset of the target port in a range target
+	PortIndex int
+	// LocalPortCount is the number of consecutive local ports, starting at LocalPort,
+	// mapped to consecutive target ports starting at PortIndex.  0 is the same as 1.
+	LocalPortCount int
+	// SocketPath is set to listen on a unix socket rather than a TCP port
+	SocketPath string
+	// SocketMode is the file mode of the unix socket, 0 to leave it to the umask
+	SocketMode os.FileMode
+	// TLS terminates TLS on the listener so TLS clients can reach a plaintext target.
+	// Without TLSCertFile and TLSKeyFile a self-signed certificate is used.
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// TargetPath returns the target name as used in the signaling URL, with the port
+// offset appended for ports of a range beyond the first
+func (l *ListenTargetPort) TargetPath() string {
+	if l.PortIndex == 0 {
+		return l.TargetName
+	}
+	return fmt.Sprintf("%s-%d", l.TargetName, l.PortIndex)
 }
 
-// ParseListenTargetPortsFromStringSlice parses a slice of forward target ports from a string slice
+// Ports splits a listener for a range of local ports into one listener per port
+func (l *ListenTargetPort) Ports() []*ListenTargetPort {
+	if l.LocalPortCount <= 1 {
+		return []*ListenTargetPort{l}
+	}
+	retv := make([]*ListenTargetPort, 0, l.LocalPortCount)
+	for i := 0; i < l.LocalPortCount; i++ {
+		port := *l
+		port.LocalPort = l.LocalPort + i
+		port.PortIndex = l.PortIndex + i
+		port.LocalPortCount = 1
+		retv = append(retv, &port)
+	}
+	return retv
+}
+
+// ParseListenTargetPortsFromStringSlice parses a slice of listen target ports from a string
+// slice.  Listeners for a range of local ports are split into one listener per port and
+// the listeners are keyed by their target path, e.g. 'range-3'.
 func ParseListenTargetPortsFromStringSlice(ids []string) (map[string]*ListenTargetPort, error) {
 	listenPorts := make(map[string]*ListenTargetPort)
 	for _, id := range ids {
@@ -68,66 +206,226 @@ func ParseListenTargetPortsFromStringSlice(ids []string) (map[string]*ListenTarg
 		if err != nil {
 			return nil, err
 		}
-		listenPorts[listenPort.TargetName] = listenPort
+		for _, port := range listenPort.Ports() {
+			if _, ok := listenPorts[port.TargetPath()]; ok {
+				return nil, fmt.Errorf("target port %s is listened on more than once", port.TargetPath())
+			}
+			listenPorts[port.TargetPath()] = port
+		}
 	}
 	return listenPorts, nil
 }
 
 // ParseListenTargetPortFromString parses a listen target port from a string
 // the string should be in the format of 'targetname=host:port' where targetname
-// can be a server-side forward target name followed by an optional port index separated by a dash
+// can be a server-side forward target name followed by an optional port index separated
+// by a dash, and port can be a range of local ports 'start-end'
 func ParseListenTargetPortFromString(id string) (*ListenTargetPort, error) {
 	// split the id into the target name and the host/port
-	idparts := strings.Split(id, "=")
+	idparts := strings.SplitN(id, "=", 2)
 	if len(idparts) != 2 {
 		return nil, errors.New("invalid forward ID")
 	}
 
-	// split the host/port into the host and port
-	localHostParts := strings.Split(idparts[1], ":")
-	if len(localHostParts) != 2 {
-		return nil, errors.New("invalid host/port")
-	}
-
 	// split the target name into the target name and the port index
 	targetParts := strings.Split(idparts[0], "-")
 	portIndex := 0
 	var err error
 	if len(targetParts) == 2 {
-		portIndex, err = strconv.Atoi(targetParts[0])
-		if err != nil {
+		portIndex, err = strconv.Atoi(targetParts[1])
+		if err != nil || portIndex < 0 {
 			return nil, errors.New("invalid target port index")
 		}
 	} else if len(targetParts) > 2 {
 		return nil, errors.New("invalid target name")
 	}
 
-	localHostPort, err := strconv.Atoi(localHostParts[1])
+	address, options, _ := strings.Cut(idparts[1], "?")
+	listener := &ListenTargetPort{
+		TargetName:     targetParts[0],
+		PortIndex:      portIndex,
+		LocalPortCount: 1,
+	}
+
+	// listen on a unix socket, optionally setting its mode with '?mode=0660'
+	if strings.HasPrefix(address, unixPrefix) {
+		listener.SocketPath = strings.TrimPrefix(address, unixPrefix)
+		if listener.SocketPath == "" {
+			return nil, errors.New("missing unix socket path")
+		}
+		if err := listener.parseOptions(options); err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	// split the host/port into the host and port
+	localHostParts := strings.Split(address, ":")
+	if len(localHostParts) != 2 {
+		return nil, errors.New("invalid host/port")
+	}
+
+	// the local port may be a range of ports
+	portParts := strings.Split(localHostParts[1], "-")
+	if len(portParts) > 2 {
+		return nil, errors.New("invalid local port")
+	}
+	localHostPort, err := strconv.Atoi(portParts[0])
 	if err != nil {
 		return nil, errors.New("invalid local port")
 	}
+	portCount := 1
+	if len(portParts) == 2 {
+		endPort, err := strconv.Atoi(portParts[1])
+		if err != nil {
+			return nil, errors.New("invalid local port")
+		}
+		if localHostPort == 0 || endPort < localHostPort {
+			return nil, fmt.Errorf("invalid local port range %d-%d", localHostPort, endPort)
+		}
+		portCount = endPort - localHostPort + 1
+	}
+
+	listener.LocalHost = localHostParts[0]
+	listener.LocalPort = localHostPort
+	listener.LocalPortCount = portCount
+	if err := listener.parseOptions(options); err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// parseOptions parses the '?key=value&...' options of a listener: 'mode' sets the octal
+// file mode of a unix socket, 'tls' terminates TLS with 'cert' and 'key' or a self-signed
+// certificate
+func (l *ListenTargetPort) parseOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("invalid listener options %q", options)
+	}
+	for _, key := range optionKeys(values) {
+		value := values.Get(key)
+		switch key {
+		case "mode":
+			if l.SocketPath == "" {
+				return errors.New("mode is only supported on unix sockets")
+			}
+			m, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || m > 0777 {
+				return fmt.Errorf("invalid unix socket mode %q", value)
+			}
+			l.SocketMode = os.FileMode(m)
+		case "tls":
+			if l.TLS, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid tls %q", value)
+			}
+		case "cert":
+			l.TLSCertFile = value
+		case "key":
+			l.TLSKeyFile = value
+		default:
+			return fmt.Errorf("unknown listener option %q", key)
+		}
+	}
+	if (l.TLSCertFile == "") != (l.TLSKeyFile == "") {
+		return errors.New("cert and key must be set together")
+	}
+	// a certificate enables TLS unless it is turned off with tls=false
+	if l.TLSCertFile != "" && !values.Has("tls") {
+		l.TLS = true
+	}
+	return nil
+}
+
+// optionKeys returns the keys of parsed options in a fixed order, sorted with 'tls'
+// last so an explicit tls option wins over the options that imply it
+func optionKeys(values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "tls") != (keys[j] == "tls") {
+			return keys[j] == "tls"
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
 
-	return &ListenTargetPort{
-		TargetName: targetParts[0],
-		LocalHost:  localHostParts[0],
-		LocalPort:  localHostPort,
-		PortIndex:  portIndex,
-	}, nil
+// parseBoolOption parses a boolean option, where an empty value means true as in '?tls'
+func parseBoolOption(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
 }
 
 // ParseForwardTargetPortFromString parses a forward target port from a string
-// the string should be in the format of 'targetname=host:port-range'
+// the string should be in the format of 'targetname=host:port-range', optionally with
+// more backends 'targetname=host:port,host:port', a DNS SRV name 'targetname=srv:name'
+// or a unix socket 'targetname=unix:/path', followed by options '?policy=roundrobin&timeout=3s&health=10s'
 func ParseForwardTargetPortFromString(id string) (*ForwardTargetPort, error) {
 	// split the id into the target name and the host/port
-	parts := strings.Split(id, "=")
+	parts := strings.SplitN(id, "=", 2)
 	if len(parts) != 2 {
 		return nil, errors.New("invalid forward ID")
 	}
 
+	address, options, _ := strings.Cut(parts[1], "?")
+	target := &ForwardTargetPort{
+		TargetName:        parts[0],
+		ForwardTargetType: ForwardTargetTypeTCP,
+		PortCount:         1,
+	}
+	if err := target.parseOptions(options); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(address, unixPrefix):
+		// a unix socket on the server, e.g. 'docker=unix:/var/run/docker.sock'
+		target.Path = strings.TrimPrefix(address, unixPrefix)
+		if target.Path == "" {
+			return nil, errors.New("missing unix socket path")
+		}
+		target.ForwardTargetType = ForwardTargetTypeUnix
+	case strings.HasPrefix(address, srvPrefix):
+		target.SRV = strings.TrimPrefix(address, srvPrefix)
+		if target.SRV == "" {
+			return nil, errors.New("missing SRV name")
+		}
+	default:
+		for i, backend := range strings.Split(address, ",") {
+			host, startPort, portCount, err := parseHostPortRange(backend)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				target.Host = host
+				target.StartPort = startPort
+				target.PortCount = portCount
+			} else if portCount != target.PortCount {
+				return nil, fmt.Errorf("backend %s has %d ports, expected %d", backend, portCount, target.PortCount)
+			}
+			target.Backends = append(target.Backends, TargetBackend{Host: host, StartPort: startPort})
+		}
+		if len(target.Backends) == 1 {
+			target.Backends = nil
+		}
+	}
+	return target, nil
+}
+
+// parseHostPortRange parses 'host:port' or 'host:start-end'
+func parseHostPortRange(address string) (string, int, int, error) {
 	// split the host/port into the host and port range
-	hostParts := strings.Split(parts[1], ":")
+	hostParts := strings.Split(address, ":")
 	if len(hostParts) != 2 {
-		return nil, errors.New("invalid host/port")
+		return "", 0, 0, errors.New("invalid host/port")
 	}
 
 	// split the port range into start and end ports
@@ -139,25 +437,66 @@ func ParseForwardTargetPortFromString(id string) (*ForwardTargetPort, error) {
 	// convert the port range to integers
 	startPort, err := strconv.Atoi(portParts[0])
 	if err != nil {
-		return nil, err
+		return "", 0, 0, err
 	}
 	endPort, err := strconv.Atoi(portParts[1])
 	if err != nil {
-		return nil, err
+		return "", 0, 0, err
 	}
 
 	// ensure start port is less than or equal to end port
 	if startPort > endPort {
-		return nil, fmt.Errorf("invalid port rangen %d-%d", startPort, endPort)
+		return "", 0, 0, fmt.Errorf("invalid port rangen %d-%d", startPort, endPort)
 	}
+	return hostParts[0], startPort, endPort - startPort + 1, nil
+}
 
-	return &ForwardTargetPort{
-		TargetName: parts[0],
-		Host:       hostParts[0],
-		StartPort:  startPort,
-		PortCount:  endPort - startPort + 1,
-		ForwardTargetType: ForwardTargetTypeTCP,
-	}, nil
+// parseOptions parses the '?key=value&...' options of a target
+func (t *ForwardTargetPort) parseOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("invalid target options %q", options)
+	}
+	for _, key := range optionKeys(values) {
+		value := values.Get(key)
+		switch key {
+		case "policy":
+			if value != PolicyFirst && value != PolicyRoundRobin {
+				return fmt.Errorf("invalid policy %q, expected %s or %s", value, PolicyFirst, PolicyRoundRobin)
+			}
+			t.Policy = value
+		case "timeout":
+			t.DialTimeout, err = time.ParseDuration(value)
+			if err != nil || t.DialTimeout < 0 {
+				return fmt.Errorf("invalid timeout %q", value)
+			}
+		case "health":
+			t.HealthInterval, err = time.ParseDuration(value)
+			if err != nil || t.HealthInterval < 0 {
+				return fmt.Errorf("invalid health check interval %q", value)
+			}
+		case "tls", "sni", "ca", "cert", "key", "insecure":
+			if t.TLS == nil {
+				t.TLS = &TargetTLS{}
+			}
+			if err := t.TLS.setOption(key, value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown target option %q", key)
+		}
+	}
+	if t.TLS != nil {
+		if !t.TLS.Enabled {
+			t.TLS = nil
+		} else if err := t.TLS.load(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ParseForwardTargetPortsFromStringSlice(ids []string) (map[string]*ForwardTargetPort, error) {
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestParseListenTargetPort(t *testing.T) {
+	tests := []struct {
+		id        string
+		name      string
+		host      string
+		port      int
+		index     int
+		count     int
+		path      string
+		expectErr bool
+	}{
+		{id: "ssh=localhost:8822", name: "ssh", host: "localhost", port: 8822, index: 0, count: 1, path: "ssh"},
+		{id: "range-10=127.0.0.1:8824", name: "range", host: "127.0.0.1", port: 8824, index: 10, count: 1, path: "range-10"},
+		{id: "range=127.0.0.1:20000-20010", name: "range", host: "127.0.0.1", port: 20000, index: 0, count: 11, path: "range"},
+		{id: "range-2=127.0.0.1:20000-20002", name: "range", host: "127.0.0.1", port: 20000, index: 2, count: 3, path: "range-2"},
+		{id: "range-x=127.0.0.1:8824", expectErr: true},
+		{id: "range-1-2=127.0.0.1:8824", expectErr: true},
+		{id: "range=127.0.0.1:20010-20000", expectErr: true},
+		{id: "range=127.0.0.1:0-10", expectErr: true},
+		{id: "ssh:8822", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		l, err := ParseListenTargetPortFromString(tt.id)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.id, err)
+			continue
+		}
+		if l.TargetName != tt.name || l.LocalHost != tt.host || l.LocalPort != tt.port || l.PortIndex != tt.index || l.LocalPortCount != tt.count {
+			t.Errorf("%s: got %+v", tt.id, l)
+		}
+		if l.TargetPath() != tt.path {
+			t.Errorf("%s: expected target path %s, got %s", tt.id, tt.path, l.TargetPath())
+		}
+	}
+}
+
+func TestParseUnixSocketTargets(t *testing.T) {
+	target, err := ParseForwardTargetPortFromString("docker=unix:/var/run/docker.sock")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if target.ForwardTargetType != ForwardTargetTypeUnix || target.Path != "/var/run/docker.sock" || target.PortCount != 1 {
+		t.Errorf("got %+v", target)
+	}
+
+	l, err := ParseListenTargetPortFromString("docker=unix:/tmp/remote-docker.sock?mode=0600")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if l.TargetName != "docker" || l.SocketPath != "/tmp/remote-docker.sock" || l.SocketMode != 0600 {
+		t.Errorf("got %+v", l)
+	}
+
+	for _, id := range []string{"docker=unix:", "docker=unix:/tmp/d.sock?mode=999", "docker=unix:/tmp/d.sock?owner=me"} {
+		if _, err := ParseListenTargetPortFromString(id); err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+}
+
+func TestParseListenTargetPortRange(t *testing.T) {
+	listeners, err := ParseListenTargetPortsFromStringSlice([]string{"range=127.0.0.1:20000-20002", "ssh=localhost:8822"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("expected 4 listeners, got %d", len(listeners))
+	}
+	for offset, path := range []string{"range", "range-1", "range-2"} {
+		l, ok := listeners[path]
+		if !ok {
+			t.Fatalf("missing listener %s", path)
+		}
+		if l.PortIndex != offset || l.LocalPort != 20000+offset {
+			t.Errorf("%s: expected offset %d on port %d, got %+v", path, offset, 20000+offset, l)
+		}
+	}
+
+	// the same target port can't be listened on twice
+	if _, err := ParseListenTargetPortsFromStringSlice([]string{"range=127.0.0.1:20000-20002", "range-1=127.0.0.1:9000"}); err == nil {
+		t.Errorf("expected overlapping listeners to fail")
+	}
+}
+
+func TestParseTLSOptions(t *testing.T) {
+	target, err := ParseForwardTargetPortFromString("api=10.0.0.9:443?tls&sni=api.internal&insecure=1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if target.TLS == nil || target.TLS.ServerName != "api.internal" || !target.TLS.InsecureSkipVerify {
+		t.Errorf("got TLS %+v", target.TLS)
+	}
+	if target, err = ParseForwardTargetPortFromString("api=10.0.0.9:443?tls=0"); err != nil || target.TLS != nil {
+		t.Errorf("expected TLS to be disabled, got %+v %v", target, err)
+	}
+	// an explicit tls=false wins over the options that imply TLS, whatever their order
+	for i := 0; i < 20; i++ {
+		if target, err = ParseForwardTargetPortFromString("api=10.0.0.9:443?tls=false&sni=x"); err != nil || target.TLS != nil {
+			t.Fatalf("expected TLS to be disabled with tls=false&sni=x, got %+v %v", target.TLS, err)
+		}
+	}
+
+	l, err := ParseListenTargetPortFromString("web=localhost:8443-8444?tls")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, port := range l.Ports() {
+		if !port.TLS {
+			t.Errorf("expected TLS on every port, got %+v", port)
+		}
+	}
+	l, err = ParseListenTargetPortFromString("web=localhost:8443?cert=c.pem&key=k.pem")
+	if err != nil || !l.TLS || l.TLSCertFile != "c.pem" || l.TLSKeyFile != "k.pem" {
+		t.Errorf("got %+v %v", l, err)
+	}
+	l, err = ParseListenTargetPortFromString("web=localhost:8443?tls=false&cert=c.pem&key=k.pem")
+	if err != nil || l.TLS {
+		t.Errorf("expected tls=false to disable TLS, got %+v %v", l, err)
+	}
+
+	for _, id := range []string{
+		"web=localhost:8443?cert=c.pem",
+		"web=localhost:8443?mode=0600",
+		"web=localhost:8443?tls=maybe",
+	} {
+		if _, err := ParseListenTargetPortFromString(id); err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+	if _, err := ParseForwardTargetPortFromString("api=10.0.0.9:443?ca=/nonexistent/ca.pem"); err == nil {
+		t.Errorf("expected a missing CA bundle to fail")
+	}
+}
@@ -0,0 +1,371 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJWTTargetsClaim is the claim listing the whet targets a JWT grants access to
+const DefaultJWTTargetsClaim = "whet_targets"
+
+// DefaultJWTAdminClaim is the boolean claim granting access to the admin API
+const DefaultJWTAdminClaim = "whet_admin"
+
+var (
+	ErrJWTMalformed = errors.New("malformed jwt")
+	ErrJWTSignature = errors.New("invalid jwt signature")
+	ErrJWTExpired   = errors.New("jwt expired")
+	ErrJWTNotYet    = errors.New("jwt not yet valid")
+	ErrJWTAudience  = errors.New("jwt audience mismatch")
+	ErrJWTIssuer    = errors.New("jwt issuer mismatch")
+	ErrJWTNoExpiry  = errors.New("jwt has no expiry")
+	ErrJWTSubject   = errors.New("jwt has no subject")
+)
+
+// JWTValidator validates bearer tokens that are JSON Web Tokens signed with
+// RS256, ES256 or EdDSA against a set of public keys.
+type JWTValidator struct {
+	mut     *sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	keyFile string
+
+	// Audience, when set, must be one of the token's "aud" values
+	Audience string
+	// Issuer, when set, must equal the token's "iss" claim
+	Issuer string
+	// TargetsClaim names the claim listing the allowed targets, DefaultJWTTargetsClaim if empty
+	TargetsClaim string
+	// AdminClaim names the boolean claim granting admin access, DefaultJWTAdminClaim if empty
+	AdminClaim string
+	// Leeway allows for clock skew when checking "exp" and "nbf"
+	Leeway time.Duration
+	// AllowNoExpiry accepts tokens without an "exp" claim, which never expire
+	AllowNoExpiry bool
+}
+
+// jwk is a single JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWTValidator creates a validator for a static key set.  Keys are indexed by
+// key ID, a key stored under the empty ID is used for tokens without a "kid".
+func NewJWTValidator(keys map[string]crypto.PublicKey) *JWTValidator {
+	return &JWTValidator{
+		mut:  &sync.RWMutex{},
+		keys: keys,
+	}
+}
+
+// LoadJWTValidator creates a validator from a JWKS file or a file of PEM encoded public keys
+func LoadJWTValidator(filename string) (*JWTValidator, error) {
+	v := &JWTValidator{
+		mut:     &sync.RWMutex{},
+		keyFile: filename,
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the key file the validator was loaded from
+func (v *JWTValidator) Reload() error {
+	if v.keyFile == "" {
+		return errors.New("jwt validator was not loaded from a file")
+	}
+
+	data, err := os.ReadFile(v.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var keys map[string]crypto.PublicKey
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		keys, err = ParseJWKS(data)
+	} else {
+		keys, err = parsePEMPublicKeys(data)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid key file %s: %v", v.keyFile, err)
+	}
+
+	v.mut.Lock()
+	v.keys = keys
+	v.mut.Unlock()
+	return nil
+}
+
+// ParseJWKS parses a JSON Web Key Set into public keys indexed by key ID
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// parsePEMPublicKeys parses every PEM encoded public key in data.  The keys have no
+// key ID, so the first is also stored under the empty ID.
+func parsePEMPublicKeys(data []byte) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for i := 0; ; i++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys[fmt.Sprintf("%d", i)] = key
+		if i == 0 {
+			keys[""] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return keys, nil
+}
+
+// looksLikeJWT reports if a bearer token has the shape of a compact JWS
+func looksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// Validate checks the signature and claims of a JWT and returns the identity it grants.
+// The identity is named after the "sub" claim.
+func (v *JWTValidator) Validate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	if err := v.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	return v.checkClaims(claims)
+}
+
+// verify checks the signature of signed with the key selected by kid, making sure the
+// algorithm in the header matches the type of the key.
+func (v *JWTValidator) verify(alg string, kid string, signed []byte, signature []byte) error {
+	v.mut.RLock()
+	key, ok := v.keys[kid]
+	v.mut.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: unknown key id %q", ErrJWTSignature, kid)
+	}
+
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return ErrJWTSignature
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrJWTSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrJWTSignature
+		}
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, signature) {
+			return ErrJWTSignature
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrJWTSignature, alg)
+	}
+	return nil
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]interface{}) (*Identity, error) {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+			return nil, ErrJWTExpired
+		}
+	} else if !v.AllowNoExpiry {
+		return nil, ErrJWTNoExpiry
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Before(time.Unix(int64(nbf), 0).Add(-v.Leeway)) {
+			return nil, ErrJWTNotYet
+		}
+	}
+
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return nil, ErrJWTIssuer
+		}
+	}
+
+	if v.Audience != "" && !containsString(claimStrings(claims["aud"]), v.Audience) {
+		return nil, ErrJWTAudience
+	}
+
+	targetsClaim := v.TargetsClaim
+	if targetsClaim == "" {
+		targetsClaim = DefaultJWTTargetsClaim
+	}
+	adminClaim := v.AdminClaim
+	if adminClaim == "" {
+		adminClaim = DefaultJWTAdminClaim
+	}
+
+	// a token without the targets claim grants no targets rather than all of them
+	targets := claimStrings(claims[targetsClaim])
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	// the subject names the identity in logs and the audit trail
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, ErrJWTSubject
+	}
+	admin, _ := claims[adminClaim].(bool)
+	return &Identity{
+		Name:    subject,
+		Targets: targets,
+		Admin:   admin,
+	}, nil
+}
+
+// claimStrings returns a claim that may be a string, a space separated string or an array of strings
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		retv := make([]string, 0, len(c))
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				retv = append(retv, s)
+			}
+		}
+		return retv
+	}
+	return nil
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestJWT creates a compact JWT signed with key
+func signTestJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidatorAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	// publish the keys as a JWKS document
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+		},
+	})
+	keys, err := ParseJWKS(jwks)
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v", err)
+	}
+
+	v := NewJWTValidator(keys)
+	v.Audience = "whet"
+
+	claims := map[string]interface{}{
+		"sub":          "alice",
+		"aud":          []string{"whet", "other"},
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"whet_targets": []string{"ssh", "range-3"},
+	}
+
+	for _, tt := range []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{
+		{"RS256", "rsa", rsaKey},
+		{"ES256", "ec", ecKey},
+		{"EdDSA", "ed", edKey},
+	} {
+		token := signTestJWT(t, tt.alg, tt.kid, tt.key, claims)
+		if !looksLikeJWT(token) {
+			t.Fatalf("%s: token does not look like a jwt", tt.alg)
+		}
+		id, err := v.Validate(token)
+		if err != nil {
+			t.Fatalf("%s: Validate: %v", tt.alg, err)
+		}
+		if id.Name != "alice" || !id.CanAccess("ssh", 0) || !id.CanAccess("range", 3) || id.CanAccess("db", 0) {
+			t.Errorf("%s: unexpected identity %+v", tt.alg, id)
+		}
+
+		// a key of the wrong type for the algorithm must not verify
+		if _, err := v.Validate(signTestJWT(t, tt.alg, "ed", tt.key, claims)); tt.kid != "ed" && err == nil {
+			t.Errorf("%s: expected key type mismatch to fail", tt.alg)
+		}
+	}
+}
+
+func TestJWTValidatorClaims(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	v := NewJWTValidator(map[string]crypto.PublicKey{"": key.Public()})
+	v.Audience = "whet"
+	v.Issuer = "https://sso.example.com"
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "bob",
+			"iss": "https://sso.example.com",
+			"aud": "whet",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, valid())); err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+
+	expired := valid()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, expired)); err != ErrJWTExpired {
+		t.Errorf("expected ErrJWTExpired, got %v", err)
+	}
+
+	noExpiry := valid()
+	delete(noExpiry, "exp")
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, noExpiry)); err != ErrJWTNoExpiry {
+		t.Errorf("expected ErrJWTNoExpiry, got %v", err)
+	}
+	v.AllowNoExpiry = true
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, noExpiry)); err != nil {
+		t.Errorf("expected a token without exp to be allowed, got %v", err)
+	}
+	v.AllowNoExpiry = false
+
+	for _, sub := range []interface{}{"", nil} {
+		noSubject := valid()
+		noSubject["sub"] = sub
+		if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, noSubject)); err != ErrJWTSubject {
+			t.Errorf("expected ErrJWTSubject for sub %v, got %v", sub, err)
+		}
+	}
+
+	early := valid()
+	early["nbf"] = time.Now().Add(time.Minute).Unix()
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, early)); err != ErrJWTNotYet {
+		t.Errorf("expected ErrJWTNotYet, got %v", err)
+	}
+
+	wrongAud := valid()
+	wrongAud["aud"] = "someone-else"
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, wrongAud)); err != ErrJWTAudience {
+		t.Errorf("expected ErrJWTAudience, got %v", err)
+	}
+
+	wrongIss := valid()
+	wrongIss["iss"] = "https://evil.example.com"
+	if _, err := v.Validate(signTestJWT(t, "EdDSA", "", key, wrongIss)); err != ErrJWTIssuer {
+		t.Errorf("expected ErrJWTIssuer, got %v", err)
+	}
+
+	// a token without the targets claim may not open any target
+	id, _ := v.Validate(signTestJWT(t, "EdDSA", "", key, valid()))
+	if id.CanAccess("ssh", 0) {
+		t.Errorf("expected token without targets claim to grant no targets")
+	}
+
+	// tampering with the payload invalidates the signature
+	parts := strings.Split(signTestJWT(t, "EdDSA", "", key, valid()), ".")
+	forged := valid()
+	forged["sub"] = "mallory"
+	payload, _ := json.Marshal(forged)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := v.Validate(strings.Join(parts, ".")); err != ErrJWTSignature {
+		t.Errorf("expected ErrJWTSignature for tampered token, got %v", err)
+	}
+}
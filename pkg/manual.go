@@ -0,0 +1,494 @@
+//go:build !js
+
+package pkg
+
+// Manual signaling connects two peers that can't reach a signal server, e.g. in an
+// air-gapped lab, by exchanging the offer and answer by hand over chat or a file:
+//
+//	whet offer ssh                          prints the offer, reads the answer
+//	whet answer -tcptarget ssh=localhost:22 reads the offer, prints the answer
+//
+// Each side prints a blob, "whet:" followed by the URL safe base64 of the deflated
+// manualBlob JSON, and reads the peer's.  The offer carries a one-time secret and
+// the offering side only accepts an answer carrying the MAC of its SDP keyed with
+// that secret.  Every connection forwarded over the session is a data channel of
+// one peer connection, with the same handshake and half-close as a signaled
+// session.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	manualBlobPrefix = "whet:"
+	// manualControlLabel is the data channel that is open for the whole session, the
+	// session ends when it closes
+	manualControlLabel = "whet-control"
+	// maxManualBlob limits the size of an inflated blob
+	maxManualBlob = 1 << 20
+	// defaultManualTimeout is how long a peer may take to paste the other's blob
+	defaultManualTimeout = 10 * time.Minute
+)
+
+// ManualSignaling creates sessions signaled by exchanging blobs by hand
+type ManualSignaling struct {
+	// ICEServers are used in place of the package ICEServers when not nil, an empty
+	// slice gathers host candidates only
+	ICEServers []webrtc.ICEServer
+	// Timeout is how long ICE keeps checking while the answer is pasted and how long
+	// a lost peer has to come back, 10 minutes when zero
+	Timeout time.Duration
+}
+
+// manualBlob is the JSON carried by a blob
+type manualBlob struct {
+	// Type is offer or answer
+	Type string `json:"t"`
+	// Target is the target path the offer opens, e.g. ssh or range-2
+	Target string `json:"n,omitempty"`
+	// Secret is the offer's one-time secret
+	Secret []byte `json:"k,omitempty"`
+	SDP    string `json:"s"`
+	// MAC is the answer's HMAC-SHA256 of its SDP keyed with the offer's secret
+	MAC []byte `json:"m,omitempty"`
+}
+
+// encode returns the blob as text
+func (b *manualBlob) encode() (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return manualBlobPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeManualBlob parses a blob of the given type, or any type when blobType is
+// empty, ignoring white space so blobs wrapped by a chat client still parse
+func decodeManualBlob(text string, blobType string) (*manualBlob, error) {
+	text = strings.Join(strings.Fields(text), "")
+	if !strings.HasPrefix(text, manualBlobPrefix) {
+		return nil, errors.New("not a whet blob")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, manualBlobPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid whet blob: %v", err)
+	}
+	data, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxManualBlob))
+	if err != nil {
+		return nil, fmt.Errorf("invalid whet blob: %v", err)
+	}
+	var b manualBlob
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid whet blob: %v", err)
+	}
+	if blobType != "" && b.Type != blobType {
+		return nil, fmt.Errorf("expected a whet %s, got %q", blobType, b.Type)
+	}
+	return &b, nil
+}
+
+// ReadManualBlob reads lines from r until they hold a complete blob, skipping any
+// text before it
+func ReadManualBlob(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxManualBlob)
+	text := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			i := strings.Index(line, manualBlobPrefix)
+			if i < 0 {
+				continue
+			}
+			line = line[i:]
+		}
+		text += line
+		// a blob split over lines only decodes once the last line is read
+		if _, err := decodeManualBlob(text, ""); err == nil {
+			return text, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if text != "" {
+		return "", errors.New("incomplete whet blob")
+	}
+	return "", errors.New("no whet blob found")
+}
+
+// manualPeer is the peer connection of a manually signaled session
+type manualPeer struct {
+	peerConnection *webrtc.PeerConnection
+	blob           string
+	connected      chan struct{}
+	connectOnce    sync.Once
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+// newManualPeer creates the peer connection of a session
+func (m *ManualSignaling) newManualPeer() (*manualPeer, error) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = defaultManualTimeout
+	}
+	s := webrtc.SettingEngine{}
+	s.DetachDataChannels()
+	// the answering side starts checking when it creates the answer, so it must keep
+	// checking while the answer is pasted on the other side
+	s.SetICETimeouts(5*time.Second, timeout, 2*time.Second)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig(m.ICEServers))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %v", err)
+	}
+
+	p := &manualPeer{
+		peerConnection: peerConnection,
+		connected:      make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		fmt.Printf("Manual session %s\n", state)
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			p.Close()
+		}
+	})
+	return p, nil
+}
+
+// control tracks the session's control data channel
+func (p *manualPeer) control(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		p.connectOnce.Do(func() { close(p.connected) })
+	})
+	dc.OnClose(func() {
+		p.Close()
+	})
+}
+
+// gather sets the local description and returns it once all candidates are gathered
+func (p *manualPeer) gather(description webrtc.SessionDescription) (string, error) {
+	gatherComplete := webrtc.GatheringCompletePromise(p.peerConnection)
+	if err := p.peerConnection.SetLocalDescription(description); err != nil {
+		return "", fmt.Errorf("failed to set local description: %v", err)
+	}
+	<-gatherComplete
+	return p.peerConnection.LocalDescription().SDP, nil
+}
+
+// Blob returns the blob to give to the peer
+func (p *manualPeer) Blob() string {
+	return p.blob
+}
+
+// Connected is closed when the peers are connected
+func (p *manualPeer) Connected() <-chan struct{} {
+	return p.connected
+}
+
+// Done is closed when the session ends
+func (p *manualPeer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Close ends the session and every connection forwarded over it
+func (p *manualPeer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		err = p.peerConnection.Close()
+		close(p.done)
+	})
+	return err
+}
+
+// newManualConnection creates the Connection of a data channel of the session
+func newManualConnection(peerConnection *webrtc.PeerConnection, dataChannel *webrtc.DataChannel) *Connection {
+	c := &Connection{
+		peerConnection: peerConnection,
+		dataChannel:    dataChannel,
+		sendMoreCh:     make(chan struct{}, 1),
+		detached:       true,
+		sharedPeer:     true,
+	}
+	dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	dataChannel.OnBufferedAmountLow(func() {
+		select {
+		case c.sendMoreCh <- struct{}{}:
+		default:
+		}
+	})
+	return c
+}
+
+// ManualOffer is the offering side of a manually signaled session, it dials the target
+// named in the offer
+type ManualOffer struct {
+	*manualPeer
+	target   string
+	secret   []byte
+	mut      sync.Mutex
+	answered bool
+}
+
+// Offer creates the offer for target, e.g. ssh or range-2 for a port of a range
+// target.  Give its Blob to the peer and Accept the peer's answer.
+func (m *ManualSignaling) Offer(target string) (*ManualOffer, error) {
+	p, err := m.newManualPeer()
+	if err != nil {
+		return nil, err
+	}
+	o := &ManualOffer{manualPeer: p, target: target, secret: make([]byte, 16)}
+	if _, err := rand.Read(o.secret); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	// the control channel puts the data channels in the offer
+	dc, err := p.peerConnection.CreateDataChannel(manualControlLabel, dataChannelConfig)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("failed to create data channel: %v", err)
+	}
+	p.control(dc)
+
+	offer, err := p.peerConnection.CreateOffer(nil)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	sdp, err := p.gather(offer)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	blob := &manualBlob{Type: "offer", Target: target, Secret: o.secret, SDP: sdp}
+	if p.blob, err = blob.encode(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// Accept starts connecting with the peer's answer, an offer accepts one answer
+func (o *ManualOffer) Accept(answer string) error {
+	b, err := decodeManualBlob(answer, "answer")
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(b.SDP))
+	if !hmac.Equal(mac.Sum(nil), b.MAC) {
+		return errors.New("the answer is not for this offer")
+	}
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.answered {
+		return errors.New("the offer was already answered")
+	}
+	o.answered = true
+	err = o.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: b.SDP})
+	if err != nil {
+		return fmt.Errorf("failed to set remote description: %v", err)
+	}
+	return nil
+}
+
+// DialContext opens a connection to the target over a new data channel of the session
+func (o *ManualOffer) DialContext(ctx context.Context) (*WebRTCConn, error) {
+	dc, err := o.peerConnection.CreateDataChannel("data", dataChannelConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data channel: %v", err)
+	}
+	c := newManualConnection(o.peerConnection, dc)
+	opened := make(chan error, 1)
+	dc.OnOpen(func() {
+		rawDetached, err := dc.Detach()
+		if err == nil {
+			c.rawDetached = rawDetached
+			err = handleHandshake(c, false, nil)
+		}
+		opened <- err
+	})
+
+	select {
+	case err = <-opened:
+	case <-o.done:
+		err = errors.New("manual session closed")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	return newWebRTCConn(c, ""), nil
+}
+
+// Serve forwards the connections accepted by l to the target until the session ends,
+// or returns the error accepting from l
+func (o *ManualOffer) Serve(l net.Listener) error {
+	go func() {
+		<-o.done
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-o.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		go func() {
+			wconn, err := o.DialContext(context.Background())
+			if err != nil {
+				fmt.Printf("Failed to open %s: %v\n", o.target, err)
+				conn.Close()
+				return
+			}
+			pipe(conn, wconn)
+		}()
+	}
+}
+
+// ManualAnswer is the answering side of a manually signaled session, it forwards the
+// session's connections to the offered target
+type ManualAnswer struct {
+	*manualPeer
+	target string
+}
+
+// Answer answers offer for one of targets, give the answer's Blob to the peer
+func (m *ManualSignaling) Answer(offer string, targets map[string]*ForwardTargetPort) (*ManualAnswer, error) {
+	b, err := decodeManualBlob(offer, "offer")
+	if err != nil {
+		return nil, err
+	}
+	name, offset, ok := parseTargetPath(b.Target)
+	target := targets[name]
+	if !ok || target == nil || offset < 0 || (offset != 0 && offset >= target.PortCount) {
+		return nil, fmt.Errorf("unknown target %q", b.Target)
+	}
+
+	p, err := m.newManualPeer()
+	if err != nil {
+		return nil, err
+	}
+	a := &ManualAnswer{manualPeer: p, target: b.Target}
+	p.peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == manualControlLabel {
+			p.control(dc)
+			return
+		}
+		c := newManualConnection(p.peerConnection, dc)
+		dc.OnOpen(func() {
+			rawDetached, err := dc.Detach()
+			if err != nil {
+				fmt.Printf("Failed to detach data channel: %v\n", err)
+				return
+			}
+			c.rawDetached = rawDetached
+			go a.forward(c, target, offset)
+		})
+	})
+
+	err = p.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: b.SDP})
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("failed to set remote description: %v", err)
+	}
+	answer, err := p.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	sdp, err := p.gather(answer)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, b.Secret)
+	mac.Write([]byte(sdp))
+	reply := &manualBlob{Type: "answer", SDP: sdp, MAC: mac.Sum(nil)}
+	if p.blob, err = reply.encode(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Target returns the target path the offer opens
+func (a *ManualAnswer) Target() string {
+	return a.target
+}
+
+// forward connects a data channel of the session to the target
+func (a *ManualAnswer) forward(c *Connection, target *ForwardTargetPort, offset int) {
+	conn, backend, err := target.dial(offset)
+	if err != nil {
+		fmt.Printf("Error connecting to target: %v\n", err)
+		c.rawDetached.Write([]byte("SERVER_ERROR"))
+		c.dataChannel.Close()
+		return
+	}
+	c.conn = conn
+	if err := handleHandshake(c, true, nil); err != nil {
+		fmt.Printf("Error handling handshake: %v\n", err)
+		c.dataChannel.Close()
+		return
+	}
+	fmt.Printf("Forwarding a connection to %s\n", backend)
+	pipe(newWebRTCConn(c, ""), conn)
+}
+
+// pipe copies between a and b until both directions end, half-closing the side
+// whose peer finished sending, then closes both
+func pipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,120 @@
+//go:build !js
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestManualSignaling(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	target, err := ParseForwardTargetPortFromString("echo=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := map[string]*ForwardTargetPort{"echo": target}
+
+	// host candidates only
+	m := &ManualSignaling{ICEServers: []webrtc.ICEServer{}}
+	if _, err := m.Answer("whet:not-a-blob", targets); err == nil {
+		t.Fatalf("expected an invalid blob to be rejected")
+	}
+	missing, err := m.Offer("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+	if _, err := m.Answer(missing.Blob(), targets); err == nil {
+		t.Fatalf("expected an offer for an unknown target to be rejected")
+	}
+
+	offer, err := m.Offer("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offer.Close()
+
+	// the blob survives being wrapped and surrounded by other text
+	wrapped := "here is my offer:\n"
+	for blob := offer.Blob(); blob != ""; {
+		n := min(len(blob), 60)
+		wrapped += blob[:n] + "\n"
+		blob = blob[n:]
+	}
+	received, err := ReadManualBlob(strings.NewReader(wrapped + "thanks\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := m.Answer(received, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answer.Close()
+
+	// the answer to another offer is rejected
+	other, err := m.Answer(missing.Blob(), map[string]*ForwardTargetPort{"missing": target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := offer.Accept(other.Blob()); err == nil {
+		t.Fatalf("expected the answer to another offer to be rejected")
+	}
+	if err := offer.Accept(answer.Blob()); err != nil {
+		t.Fatal(err)
+	}
+	if err := offer.Accept(answer.Blob()); err == nil {
+		t.Fatalf("expected an offer to accept one answer")
+	}
+
+	// connections share the session, closing one leaves the others open
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		conn, err := offer.DialContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("hello without a signal server")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("expected the message echoed, got %q %v", got, err)
+		}
+		conn.Close()
+	}
+
+	// closing one side ends the session on the other
+	offer.Close()
+	select {
+	case <-answer.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the answering side to end")
+	}
+}
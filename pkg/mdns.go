@@ -0,0 +1,610 @@
+//go:build !js
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+/*
+A whet server on a local network can advertise itself with DNS-SD over multicast DNS so
+clients find it without knowing its address:
+
+// on the server
+whet serve -tcptarget ssh=localhost:22 -mdns lab
+
+// on a client on the same network
+whet discover
+whet stdio -server whet://lab.local ssh
+
+The server answers queries for _whet._tcp.local with its instance, lab._whet._tcp.local,
+whose SRV record gives the server's port on the host lab.local and whose TXT record holds:
+
+id       the Id of the server
+tls      1 when the server is served with TLS, clients then signal with https
+targets  a hash of the names and port counts of the server's targets, which changes when
+         the targets change
+
+The records are announced when the server starts advertising and when its targets
+change, and withdrawn when it stops.  Clients query from an ephemeral port and are
+answered directly, like legacy unicast queries in RFC 6762, so they don't need port
+5353.  Only IPv4 is used.
+*/
+
+const (
+	mdnsService     = "_whet._tcp.local."
+	mdnsServiceEnum = "_services._dns-sd._udp.local."
+	// mdnsTTL is the time to live of the advertised records in seconds
+	mdnsTTL = 120
+	// mdnsWatchInterval is how often an advertiser checks if the targets changed
+	mdnsWatchInterval = 10 * time.Second
+	// mdnsUnicastClass is the top bit of a class, asking for a unicast answer in a
+	// question and flushing older records from caches in an answer
+	mdnsUnicastClass = 1 << 15
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Advertiser advertises a whet server on the local network with multicast DNS
+type Advertiser struct {
+	server *WhetServer
+	name   string
+	port   int
+	tls    bool
+	conn   *ipv4.PacketConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Advertise advertises the server as name, found by clients as whet://name.local, with
+// the port and TLS status it is served with.  The name is a DNS label such as lab.
+func (ws *WhetServer) Advertise(name string, port int, tls bool) (*Advertiser, error) {
+	if !validMDNSName(name) {
+		return nil, fmt.Errorf("invalid mDNS name %q, expected letters, digits and hyphens", name)
+	}
+	udp, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv4.NewPacketConn(udp)
+	// listen on every multicast interface, not only the default one.  Joining the
+	// default interface again fails and is ignored.
+	for _, ifi := range mdnsInterfaces() {
+		conn.JoinGroup(&ifi, &net.UDPAddr{IP: mdnsGroup.IP})
+	}
+	// the interface of a query selects the addresses in the answer
+	conn.SetControlMessage(ipv4.FlagInterface, true)
+
+	a := &Advertiser{
+		server: ws,
+		name:   name,
+		port:   port,
+		tls:    tls,
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	go a.serve()
+	go a.watch()
+	a.announce(mdnsTTL)
+	fmt.Printf("Advertising the server as whet://%s.local on port %d\n", name, port)
+	return a, nil
+}
+
+// Close withdraws the advertisement
+func (a *Advertiser) Close() error {
+	var err error
+	a.once.Do(func() {
+		close(a.done)
+		a.announce(0)
+		err = a.conn.Close()
+	})
+	return err
+}
+
+// serve answers queries until the advertiser is closed
+func (a *Advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			fmt.Printf("mDNS read failed: %v\n", err)
+			return
+		}
+		udpSrc, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		a.answer(buf[:n], udpSrc, ifIndex)
+	}
+}
+
+// watch announces the records again when the server's targets change
+func (a *Advertiser) watch() {
+	ticker := time.NewTicker(mdnsWatchInterval)
+	defer ticker.Stop()
+	hash := a.server.targetsHash()
+	for {
+		select {
+		case <-ticker.C:
+			if h := a.server.targetsHash(); h != hash {
+				hash = h
+				a.announce(mdnsTTL)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// answer replies to a query received on the interface with ifIndex, zero if unknown
+func (a *Advertiser) answer(msg []byte, src *net.UDPAddr, ifIndex int) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	unicast := src.Port != mdnsGroup.Port
+	for _, q := range questions {
+		if q.Class&mdnsUnicastClass != 0 {
+			unicast = true
+		}
+		an, ad := a.records(q, ifIndex, mdnsTTL)
+		answers = append(answers, an...)
+		additionals = append(additionals, ad...)
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	resp := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	dst := mdnsGroup
+	if unicast {
+		// a legacy unicast query is answered with its id and questions
+		dst = src
+		resp.ID = header.ID
+		resp.Questions = questions
+		for i := range resp.Questions {
+			resp.Questions[i].Class &^= mdnsUnicastClass
+		}
+		for _, records := range [][]dnsmessage.Resource{resp.Answers, resp.Additionals} {
+			for i := range records {
+				records[i].Header.Class &^= mdnsUnicastClass
+			}
+		}
+	}
+	a.send(&resp, dst, ifIndex)
+}
+
+// announce sends the records unsolicited on every interface, a ttl of 0 withdraws them
+func (a *Advertiser) announce(ttl uint32) {
+	q := dnsmessage.Question{Name: mustName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	for _, ifi := range mdnsInterfaces() {
+		answers, additionals := a.records(q, ifi.Index, ttl)
+		resp := dnsmessage.Message{
+			Header:  dnsmessage.Header{Response: true, Authoritative: true},
+			Answers: append(answers, additionals...),
+		}
+		a.send(&resp, mdnsGroup, ifi.Index)
+	}
+}
+
+// send sends a response on the interface with ifIndex, or the default one for zero
+func (a *Advertiser) send(resp *dnsmessage.Message, dst *net.UDPAddr, ifIndex int) {
+	packed, err := resp.Pack()
+	if err != nil {
+		fmt.Printf("mDNS response failed: %v\n", err)
+		return
+	}
+	var cm *ipv4.ControlMessage
+	if ifIndex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifIndex}
+	}
+	a.conn.WriteTo(packed, cm, dst)
+}
+
+// records returns the answers and additional records for question q
+func (a *Advertiser) records(q dnsmessage.Question, ifIndex int, ttl uint32) ([]dnsmessage.Resource, []dnsmessage.Resource) {
+	if q.Class&^mdnsUnicastClass != dnsmessage.ClassINET && q.Class&^mdnsUnicastClass != dnsmessage.ClassANY {
+		return nil, nil
+	}
+	name := strings.ToLower(q.Name.String())
+	instance := mustName(a.name + "." + mdnsService)
+	host := mustName(a.name + ".local.")
+	asked := func(t dnsmessage.Type) bool {
+		return q.Type == t || q.Type == dnsmessage.TypeALL
+	}
+	header := func(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+		// the records are unique to this server except for the shared PTRs, so they
+		// replace cached ones
+		class := dnsmessage.ClassINET
+		if t != dnsmessage.TypePTR {
+			class |= mdnsUnicastClass
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: class, TTL: ttl}
+	}
+
+	srv := dnsmessage.Resource{
+		Header: header(instance, dnsmessage.TypeSRV),
+		Body:   &dnsmessage.SRVResource{Port: uint16(a.port), Target: host},
+	}
+	txt := dnsmessage.Resource{
+		Header: header(instance, dnsmessage.TypeTXT),
+		Body:   &dnsmessage.TXTResource{TXT: a.txt()},
+	}
+	var addrs []dnsmessage.Resource
+	for _, ip := range mdnsAddrs(ifIndex) {
+		var ip4 [4]byte
+		copy(ip4[:], ip.To4())
+		addrs = append(addrs, dnsmessage.Resource{Header: header(host, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: ip4}})
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	switch name {
+	case mdnsServiceEnum:
+		if asked(dnsmessage.TypePTR) {
+			answers = append(answers, dnsmessage.Resource{
+				Header: header(mustName(mdnsServiceEnum), dnsmessage.TypePTR),
+				Body:   &dnsmessage.PTRResource{PTR: mustName(mdnsService)},
+			})
+		}
+	case mdnsService:
+		if asked(dnsmessage.TypePTR) {
+			answers = append(answers, dnsmessage.Resource{
+				Header: header(mustName(mdnsService), dnsmessage.TypePTR),
+				Body:   &dnsmessage.PTRResource{PTR: instance},
+			})
+			additionals = append(append(additionals, srv, txt), addrs...)
+		}
+	case instance.String():
+		if asked(dnsmessage.TypeSRV) {
+			answers = append(answers, srv)
+			additionals = append(additionals, addrs...)
+		}
+		if asked(dnsmessage.TypeTXT) {
+			answers = append(answers, txt)
+		}
+	case host.String():
+		if asked(dnsmessage.TypeA) {
+			answers = append(answers, addrs...)
+		}
+	}
+	return answers, additionals
+}
+
+// txt returns the TXT record of the server
+func (a *Advertiser) txt() []string {
+	tls := "0"
+	if a.tls {
+		tls = "1"
+	}
+	return []string{"id=" + a.server.Id, "tls=" + tls, "targets=" + a.server.targetsHash()}
+}
+
+// targetsHash returns a short hash of the names and port counts of the server's targets
+func (ws *WhetServer) targetsHash() string {
+	ws.mut.Lock()
+	targets := make([]string, 0, len(ws.Targets))
+	for name, target := range ws.Targets {
+		targets = append(targets, name+"/"+strconv.Itoa(max(target.PortCount, 1)))
+	}
+	ws.mut.Unlock()
+	sort.Strings(targets)
+	sum := sha256.Sum256([]byte(strings.Join(targets, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// validMDNSName reports if name is a DNS label
+func validMDNSName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// mustName returns the DNS name of a valid name
+func mustName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(strings.ToLower(name))
+}
+
+// mdnsInterfaces returns the interfaces that are up and support multicast
+func mdnsInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var retv []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			retv = append(retv, ifi)
+		}
+	}
+	return retv
+}
+
+// mdnsAddrs returns the IPv4 addresses of the interface with ifIndex, or of every
+// interface except loopback for zero
+func mdnsAddrs(ifIndex int) []net.IP {
+	var ifaces []net.Interface
+	if ifIndex != 0 {
+		if ifi, err := net.InterfaceByIndex(ifIndex); err == nil {
+			ifaces = append(ifaces, *ifi)
+		}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+
+	var retv []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || (ifIndex == 0 && ifi.Flags&net.FlagLoopback != 0) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				retv = append(retv, ipnet.IP.To4())
+			}
+		}
+	}
+	return retv
+}
+
+// DiscoveredServer is a whet server advertised on the local network
+type DiscoveredServer struct {
+	// Name is the instance name, the server is dialed as whet://Name.local/target
+	Name string
+	// Host is the server's host name, such as lab.local
+	Host  string
+	Port  int
+	Addrs []net.IP
+	// ID is the Id of the server
+	ID string
+	// TLS is set when the server is served with TLS
+	TLS bool
+	// TargetsHash changes when the server's targets change
+	TargetsHash string
+}
+
+// URL returns the address clients signal the server with, http or https with its
+// first address
+func (s *DiscoveredServer) URL() string {
+	scheme := "http"
+	if s.TLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(s.Addrs[0].String(), strconv.Itoa(s.Port))
+}
+
+// Discover returns the whet servers advertised on the local network that answer
+// before ctx is done, sorted by name
+func Discover(ctx context.Context) ([]*DiscoveredServer, error) {
+	q := dnsmessage.Question{Name: mustName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	servers, err := mdnsQuery(ctx, []dnsmessage.Question{q}, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers, nil
+}
+
+// LookupServer finds the whet server advertised as name on the local network
+func LookupServer(ctx context.Context, name string) (*DiscoveredServer, error) {
+	if !validMDNSName(name) {
+		return nil, fmt.Errorf("invalid mDNS name %q", name)
+	}
+	instance := mustName(name + "." + mdnsService)
+	questions := []dnsmessage.Question{
+		{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+		{Name: instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+	}
+	servers, err := mdnsQuery(ctx, questions, func(s *DiscoveredServer) bool {
+		return strings.EqualFold(s.Name, name)
+	})
+	if errors.Is(err, context.DeadlineExceeded) || (err == nil && len(servers) == 0) {
+		return nil, fmt.Errorf("no whet server %s.local found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return servers[0], nil
+}
+
+// lookupServer returns the address clients signal the server advertised as name with
+func lookupServer(ctx context.Context, name string) (string, error) {
+	s, err := LookupServer(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return s.URL(), nil
+}
+
+// mdnsQuery asks the questions on every interface each second until ctx is done and
+// returns the servers that answered with a port and address.  When found is not nil
+// it returns as soon as found returns true for a server, or ctx's error if none did.
+func mdnsQuery(ctx context.Context, questions []dnsmessage.Question, found func(*DiscoveredServer) bool) ([]*DiscoveredServer, error) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer udp.Close()
+	conn := ipv4.NewPacketConn(udp)
+	conn.SetMulticastLoopback(true)
+
+	query := dnsmessage.Message{Questions: questions}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	send := func() {
+		for _, ifi := range mdnsInterfaces() {
+			if conn.SetMulticastInterface(&ifi) == nil {
+				conn.WriteTo(packed, nil, mdnsGroup)
+			}
+		}
+	}
+
+	servers := make(map[string]*DiscoveredServer)
+	hosts := make(map[string][]net.IP)
+	complete := func() []*DiscoveredServer {
+		var retv []*DiscoveredServer
+		for _, s := range servers {
+			if ips := hosts[strings.ToLower(s.Host)]; len(s.Addrs) == 0 && len(ips) > 0 {
+				s.Addrs = ips
+			}
+			if s.Port != 0 && len(s.Addrs) > 0 {
+				retv = append(retv, s)
+			}
+		}
+		return retv
+	}
+
+	send()
+	lastSent := time.Now()
+	buf := make([]byte, 9000)
+	for {
+		deadline := time.Now().Add(time.Second)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		udp.SetReadDeadline(deadline)
+		n, _, src, err := conn.ReadFrom(buf)
+		if err == nil {
+			parseMDNSResponse(buf[:n], servers, hosts, src)
+			if found != nil {
+				for _, s := range complete() {
+					if found(s) {
+						return []*DiscoveredServer{s}, nil
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if found != nil {
+				return nil, ctx.Err()
+			}
+			return complete(), nil
+		default:
+		}
+		if time.Since(lastSent) >= time.Second {
+			send()
+			lastSent = time.Now()
+		}
+	}
+}
+
+// parseMDNSResponse adds the whet servers and host addresses of a response to servers
+// and hosts
+func parseMDNSResponse(msg []byte, servers map[string]*DiscoveredServer, hosts map[string][]net.IP, src net.Addr) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || !m.Header.Response {
+		return
+	}
+	server := func(instance string) *DiscoveredServer {
+		name, ok := strings.CutSuffix(strings.ToLower(instance), "."+mdnsService)
+		if !ok || name == "" {
+			return nil
+		}
+		s := servers[name]
+		if s == nil {
+			s = &DiscoveredServer{Name: name}
+			servers[name] = s
+		}
+		return s
+	}
+
+	for _, r := range append(m.Answers, m.Additionals...) {
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if strings.ToLower(r.Header.Name.String()) != mdnsService {
+				continue
+			}
+			if r.Header.TTL == 0 {
+				// the server withdrew its advertisement
+				name, _ := strings.CutSuffix(strings.ToLower(body.PTR.String()), "."+mdnsService)
+				delete(servers, name)
+				continue
+			}
+			server(body.PTR.String())
+		case *dnsmessage.SRVResource:
+			if s := server(r.Header.Name.String()); s != nil {
+				s.Port = int(body.Port)
+				s.Host = strings.TrimSuffix(body.Target.String(), ".")
+				// the addresses may come in a later response, the sender is one
+				if udpSrc, ok := src.(*net.UDPAddr); ok && len(s.Addrs) == 0 && len(hosts[strings.ToLower(s.Host)]) == 0 {
+					hosts[strings.ToLower(s.Host)] = []net.IP{udpSrc.IP}
+				}
+			}
+		case *dnsmessage.TXTResource:
+			if s := server(r.Header.Name.String()); s != nil {
+				for _, kv := range body.TXT {
+					key, value, _ := strings.Cut(kv, "=")
+					switch key {
+					case "id":
+						s.ID = value
+					case "tls":
+						s.TLS = value == "1"
+					case "targets":
+						s.TargetsHash = value
+					}
+				}
+			}
+		case *dnsmessage.AResource:
+			host := strings.TrimSuffix(strings.ToLower(r.Header.Name.String()), ".")
+			ip := net.IP(body.A[:])
+			if !containsIP(hosts[host], ip) {
+				hosts[host] = append(hosts[host], ip)
+			}
+		}
+	}
+}
+
+// containsIP reports if ips contains ip
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
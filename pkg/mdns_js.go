@@ -0,0 +1,13 @@
+//go:build js
+
+package pkg
+
+import (
+	"context"
+	"errors"
+)
+
+// lookupServer is not available in the browser, which can't send multicast DNS
+func lookupServer(ctx context.Context, name string) (string, error) {
+	return "", errors.New("mDNS lookups are not available in the browser")
+}
@@ -0,0 +1,116 @@
+//go:build !js
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMDNS(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	target, err := ParseForwardTargetPortFromString("echo=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewWhetServer("secret", map[string]*ForwardTargetPort{"echo": target}, nil, nil, true)
+	s.Id = "test-server"
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if _, err := s.Advertise("not.a.label", port, false); err == nil {
+		t.Fatalf("expected an invalid name to be rejected")
+	}
+	// a name of its own so servers of other runs don't answer
+	name := fmt.Sprintf("whet-test-%d", time.Now().UnixNano()%1000000)
+	a, err := s.Advertise(name, port, false)
+	if err != nil {
+		t.Skipf("multicast DNS is not available: %v", err)
+	}
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	servers, err := Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *DiscoveredServer
+	for _, server := range servers {
+		if server.Name == name {
+			found = server
+		}
+	}
+	if found == nil {
+		t.Skipf("the advertisement was not received, multicast may be blocked")
+	}
+	if found.ID != "test-server" || found.TLS || found.Port != port || found.TargetsHash != s.targetsHash() || found.Host != name+".local" {
+		t.Fatalf("unexpected discovered server %+v", found)
+	}
+
+	// the target list hash follows the targets
+	hash := s.targetsHash()
+	s.SetTargets(map[string]*ForwardTargetPort{"echo": target, "other": target})
+	if s.targetsHash() == hash {
+		t.Fatalf("expected the hash to change with the targets")
+	}
+
+	d := &Dialer{Timeout: 20 * time.Second, MDNS: true}
+	conn, err := d.DialURL(context.Background(), "whet://"+name+".local/echo", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello from the local network")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expected the message echoed, got %q %v", got, err)
+	}
+
+	// without MDNS the name is left to the system resolver, a port is never looked up
+	server, err := ResolveServer(context.Background(), "whets://"+name+".local:"+strconv.Itoa(port), true)
+	if err != nil || server != "https://"+name+".local:"+strconv.Itoa(port) {
+		t.Fatalf("expected the address to be kept, got %s %v", server, err)
+	}
+
+	// a withdrawn server is no longer found
+	a.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := LookupServer(ctx, name); err == nil {
+		t.Fatalf("expected the closed advertisement not to be found")
+	}
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a set of named counters.  Names may carry Prometheus style labels,
+// e.g. `whet_sessions_opened_total{target="ssh"}`, and are written out in the
+// Prometheus text exposition format.
+type Metrics struct {
+	mut      *sync.Mutex
+	counters map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mut:      &sync.Mutex{},
+		counters: make(map[string]int64),
+	}
+}
+
+// metricName builds a metric name with the given label pairs
+func metricName(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add adds delta to the counter with the given name and label pairs
+func (m *Metrics) Add(delta int64, name string, labels ...string) {
+	key := metricName(name, labels...)
+	m.mut.Lock()
+	m.counters[key] += delta
+	m.mut.Unlock()
+}
+
+// Inc increments the counter with the given name and label pairs
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(1, name, labels...)
+}
+
+// Get returns the value of the counter with the given name and label pairs
+func (m *Metrics) Get(name string, labels ...string) int64 {
+	key := metricName(name, labels...)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.counters[key]
+}
+
+// Snapshot returns a copy of all counters
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	retv := make(map[string]int64, len(m.counters))
+	for k, v := range m.counters {
+		retv[k] = v
+	}
+	return retv
+}
+
+// WriteText writes the counters, plus any extra gauges, in the Prometheus text format
+func (m *Metrics) WriteText(w io.Writer, gauges map[string]int64) error {
+	all := m.Snapshot()
+	for k, v := range gauges {
+		all[k] = v
+	}
+
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", k, all[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig protects the signaling endpoint from resource exhaustion.  Every
+// POST to /whet/ allocates a peer connection and gathers ICE candidates, so offers
+// are limited per client IP and per token, the number of peer connections that have
+// not yet connected is capped, and clients repeatedly failing authentication are
+// locked out.  A zero value disables the corresponding limit.
+type RateLimitConfig struct {
+	// PerIPRate is the sustained number of offers per second accepted from one client IP
+	PerIPRate float64
+	// PerIPBurst is the number of offers a client IP may make at once
+	PerIPBurst int
+	// PerTokenRate is the sustained number of offers per second accepted per token identity
+	PerTokenRate float64
+	// PerTokenBurst is the number of offers a token identity may make at once
+	PerTokenBurst int
+	// MaxPending caps the peer connections that have been answered but not yet connected
+	MaxPending int
+	// PendingTimeout closes peer connections that have not connected in time
+	PendingTimeout time.Duration
+	// AuthFailureLimit is the number of failed authentications from a client IP within
+	// AuthFailureWindow that locks the IP out for AuthLockout
+	AuthFailureLimit  int
+	AuthFailureWindow time.Duration
+	AuthLockout       time.Duration
+	// MaxSessionsPerTarget caps the open and pending sessions of each target.  The
+	// sessions of a remote listener's targets are between the client and the listener,
+	// so for those it only caps the offers waiting for the listener's answer.
+	MaxSessionsPerTarget int
+}
+
+// DefaultRateLimitConfig returns limits suitable for a server exposed to the internet
+func DefaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		PerIPRate:            1,
+		PerIPBurst:           10,
+		PerTokenRate:         5,
+		PerTokenBurst:        20,
+		MaxPending:           32,
+		PendingTimeout:       30 * time.Second,
+		AuthFailureLimit:     10,
+		AuthFailureWindow:    time.Minute,
+		AuthLockout:          15 * time.Minute,
+		MaxSessionsPerTarget: 0,
+	}
+}
+
+// tokenBucket is a classic token bucket refilled at rate tokens per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// authFailures tracks the failed authentications of a client IP
+type authFailures struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// rateLimiter holds the state of the limits of a RateLimitConfig
+type rateLimiter struct {
+	mut       *sync.Mutex
+	buckets   map[string]*tokenBucket
+	failures  map[string]*authFailures
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		mut:       &sync.Mutex{},
+		buckets:   make(map[string]*tokenBucket),
+		failures:  make(map[string]*authFailures),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket for key, returning false if the bucket is empty
+func (rl *rateLimiter) allow(key string, rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	rl.prune(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// lockedOut reports if ip is locked out after too many failed authentications
+func (rl *rateLimiter) lockedOut(ip string, now time.Time) bool {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	f, ok := rl.failures[ip]
+	return ok && now.Before(f.lockedUntil)
+}
+
+// authFailed records a failed authentication from ip, returning true if ip is now locked out
+func (rl *rateLimiter) authFailed(ip string, cfg *RateLimitConfig, now time.Time) bool {
+	if cfg.AuthFailureLimit <= 0 {
+		return false
+	}
+
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+
+	f, ok := rl.failures[ip]
+	if !ok || now.Sub(f.windowStart) > cfg.AuthFailureWindow {
+		f = &authFailures{windowStart: now}
+		rl.failures[ip] = f
+	}
+	f.count++
+	if f.count >= cfg.AuthFailureLimit {
+		f.lockedUntil = now.Add(cfg.AuthLockout)
+		f.count = 0
+		f.windowStart = now
+		return true
+	}
+	return false
+}
+
+// prune drops state that no longer limits anyone so the maps don't grow without bound.
+// rl.mut must be held.
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(rl.buckets, key)
+		}
+	}
+	for ip, f := range rl.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.windowStart) > 10*time.Minute {
+			delete(rl.failures, ip)
+		}
+	}
+}
+
+// tooManyRequests rejects a request that exceeded a limit and counts it in the metrics
+func (ws *WhetServer) tooManyRequests(w http.ResponseWriter, reason string, retryAfter time.Duration) {
+	ws.Metrics.Inc("whet_rate_limited_total", "reason", reason)
+	seconds := int(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// tooManyOffers is the error of an offer rejected by the limit named reason
+func tooManyOffers(reason string, retryAfter time.Duration) *offerError {
+	return &offerError{status: http.StatusTooManyRequests, message: "Too many requests", reason: reason, retry: retryAfter}
+}
+
+// checkLockout checks the client at clientIP isn't locked out after repeated authentication failures
+func (ws *WhetServer) checkLockout(clientIP string) *offerError {
+	if ws.RateLimits != nil && ws.limiter.lockedOut(clientIP, time.Now()) {
+		return tooManyOffers("lockout", ws.RateLimits.AuthLockout)
+	}
+	return nil
+}
+
+// limitClient checks the offers of the client at clientIP aren't locked out or rate limited
+func (ws *WhetServer) limitClient(clientIP string) *offerError {
+	if ws.RateLimits == nil {
+		return nil
+	}
+	if err := ws.checkLockout(clientIP); err != nil {
+		return err
+	}
+	if !ws.limiter.allow("ip:"+clientIP, ws.RateLimits.PerIPRate, ws.RateLimits.PerIPBurst, time.Now()) {
+		return tooManyOffers("ip", time.Second)
+	}
+	return nil
+}
+
+// limitIdentity checks the offers of an authenticated caller aren't rate limited
+func (ws *WhetServer) limitIdentity(identity *Identity) *offerError {
+	if ws.RateLimits != nil && !ws.limiter.allow("token:"+identity.Name, ws.RateLimits.PerTokenRate, ws.RateLimits.PerTokenBurst, time.Now()) {
+		return tooManyOffers("token", time.Second)
+	}
+	return nil
+}
+
+// authFailed counts a failed authentication of r for target and locks out a client that keeps failing
+func (ws *WhetServer) authFailed(r *http.Request, clientIP string, target string, err error) {
+	ws.Metrics.Inc("whet_auth_failures_total")
+	ws.audit(&AuditEvent{Event: AuditAuthFailure, RemoteAddr: r.RemoteAddr, Target: target, Action: r.URL.Path, Reason: err.Error()})
+	if ws.RateLimits != nil && ws.limiter.authFailed(clientIP, ws.RateLimits, time.Now()) {
+		ws.Metrics.Inc("whet_auth_lockouts_total")
+		fmt.Printf("Locking out %s after repeated authentication failures\n", clientIP)
+	}
+}
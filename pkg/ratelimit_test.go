@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	rl := newRateLimiter()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !rl.allow("ip:1.2.3.4", 1, 3, now) {
+			t.Fatalf("request %d should be within the burst", i)
+		}
+	}
+	if rl.allow("ip:1.2.3.4", 1, 3, now) {
+		t.Errorf("request beyond the burst should be limited")
+	}
+	if !rl.allow("ip:5.6.7.8", 1, 3, now) {
+		t.Errorf("other keys should have their own bucket")
+	}
+	if !rl.allow("ip:1.2.3.4", 1, 3, now.Add(time.Second)) {
+		t.Errorf("bucket should refill over time")
+	}
+}
+
+func TestAuthFailureLockout(t *testing.T) {
+	s, _ := NewWhetServer("secret", nil, nil, nil, true)
+	s.RateLimits = &RateLimitConfig{
+		AuthFailureLimit:  3,
+		AuthFailureWindow: time.Minute,
+		AuthLockout:       time.Minute,
+	}
+
+	post := func(token string) int {
+		r := httptest.NewRequest("POST", "/whet/ssh", nil)
+		r.RemoteAddr = "192.0.2.1:4444"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.WhetHandler(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := post("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, code)
+		}
+	}
+
+	// the client is now locked out, even with the right token
+	if code := post("secret"); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after repeated failures, got %d", code)
+	}
+	if s.Metrics.Get("whet_auth_lockouts_total") != 1 {
+		t.Errorf("expected one lockout to be counted")
+	}
+	if s.Metrics.Get("whet_rate_limited_total", "reason", "lockout") != 1 {
+		t.Errorf("expected the locked out request to be counted")
+	}
+}
+
+func TestAPIAuthFailureLockout(t *testing.T) {
+	s, _ := NewWhetServer("secret", nil, nil, nil, true)
+	s.RateLimits = &RateLimitConfig{
+		AuthFailureLimit:  3,
+		AuthFailureWindow: time.Minute,
+		AuthLockout:       time.Minute,
+	}
+
+	request := func(method string, path string, token string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = "192.0.2.1:4444"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.Mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// guessing tokens against the API counts the same as guessing them with offers
+	for i := 0; i < 3; i++ {
+		if code := request("GET", "/api/targets", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, code)
+		}
+	}
+	if code := request("POST", "/whet/ssh", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("expected offers to be locked out, got %d", code)
+	}
+	if code := request("GET", "/api/targets", "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the API to be locked out, got %d", code)
+	}
+	if s.Metrics.Get("whet_auth_failures_total") != 3 {
+		t.Errorf("expected the failures to be counted")
+	}
+}
+
+func TestSessionReservations(t *testing.T) {
+	s, _ := NewWhetServer("secret", nil, nil, nil, true)
+	s.RateLimits = &RateLimitConfig{MaxPending: 10, MaxSessionsPerTarget: 3}
+
+	// concurrent offers for a target get no more slots than the target allows
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limit, _ := s.reserveSession("ssh"); limit == "" {
+				mut.Lock()
+				reserved++
+				mut.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 3 {
+		t.Fatalf("expected 3 reserved slots, got %d", reserved)
+	}
+
+	// a slot that is given back can be reserved again, one taken by a session can't
+	s.releaseSession("ssh")
+	if limit, _ := s.reserveSession("ssh"); limit != "" {
+		t.Fatalf("expected the released slot to be reserved, got %s", limit)
+	}
+	s.addSession(&Connection{id: "one", targetName: "ssh"})
+	if limit, _ := s.reserveSession("ssh"); limit != "target" {
+		t.Fatalf("expected the target cap, got %q", limit)
+	}
+
+	// reserved slots count as pending across targets
+	for _, name := range []string{"db", "db", "db", "web", "web", "web", "mail"} {
+		if limit, _ := s.reserveSession(name); limit != "" {
+			t.Fatalf("expected a slot for %s, got %s", name, limit)
+		}
+	}
+	if limit, _ := s.reserveSession("git"); limit != "pending" {
+		t.Fatalf("expected the pending cap, got %q", limit)
+	}
+}
@@ -0,0 +1,358 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+Remote listeners are targets served by another process, such as a browser tab running
+the wasm client or an agent whet server behind NAT, when the server has RemoteListeners
+set.  The process registers its targets and polls for the offers of clients dialing them,
+the server only relays the offer and answer and the peer connection is made directly
+between the client and the process.
+
+POST   /api/listeners       registers {"target": "name"}, or several targets as
+                            {"targets": [{"name", "ports", "description"}...]}, returns {"id", "targets"}
+GET    /api/listeners/<id>  waits for the next offer {"session", "target", "identity", "sdp"},
+                            204 when there is none.  target includes any port offset, e.g. range-2.
+POST   /api/listeners/<id>  answers an offer with {"session", "sdp"} or {"session", "error"}
+DELETE /api/listeners/<id>  removes the targets
+
+The caller must be allowed to open the targets it registers, and the same identity must
+be used for the other requests.  A registration that isn't polled for relayExpiry is removed.
+*/
+
+const (
+	// relayPollTimeout is how long a poll waits for an offer before returning 204
+	relayPollTimeout = 25 * time.Second
+	// relayExpiry removes remote listeners that haven't polled for this long
+	relayExpiry = 60 * time.Second
+	// relayAnswerTimeout is how long a client waits for a remote listener to answer
+	relayAnswerTimeout = 30 * time.Second
+)
+
+// relayListener is the registration of a remote listener
+type relayListener struct {
+	id       string
+	targets  []string
+	identity string
+	offers   chan *relayOffer
+	done     chan struct{}
+
+	mut      sync.Mutex
+	pending  map[string]*relayOffer
+	polls    int
+	lastPoll time.Time
+}
+
+// relayOffer is an offer waiting for a remote listener's answer
+type relayOffer struct {
+	Session string `json:"session"`
+	// Target is the target path the client opened, with any port offset
+	Target string `json:"target"`
+	// Identity is the name the client authenticated as
+	Identity string `json:"identity,omitempty"`
+	SDP      string `json:"sdp"`
+
+	answer chan relayAnswer
+}
+
+// relayAnswer is a remote listener's answer to an offer
+type relayAnswer struct {
+	Session string `json:"session"`
+	SDP     string `json:"sdp,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// listenersHandler registers remote listeners on POST /api/listeners and serves the
+// registrations on /api/listeners/<id>
+func (ws *WhetServer) listenersHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "GET, POST, DELETE, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	ws.mut.Lock()
+	enabled := ws.RemoteListeners
+	ws.mut.Unlock()
+	if !enabled {
+		http.Error(w, "Remote listeners are not enabled", http.StatusNotFound)
+		return
+	}
+	identity := ws.requireIdentity(w, r)
+	if identity == nil {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/listeners"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ws.registerRelay(w, r, identity)
+		return
+	}
+
+	ws.mut.Lock()
+	relay := ws.relays[id]
+	ws.mut.Unlock()
+	if relay == nil || relay.identity != identity.Name {
+		http.Error(w, "Unknown listener", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		relay.poll(w, r)
+	case http.MethodPost:
+		var answer relayAnswer
+		if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !relay.answered(answer) {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ws.removeRelay(relay, "unregistered")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// relayTarget is a target in the registration of a remote listener
+type relayTarget struct {
+	Name string `json:"name"`
+	// Ports is the number of ports of a range target, 0 or 1 for a single port
+	Ports       int    `json:"ports,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// registerRelay adds the targets of a remote listener
+func (ws *WhetServer) registerRelay(w http.ResponseWriter, r *http.Request, identity *Identity) {
+	var req struct {
+		Target  string        `json:"target"`
+		Targets []relayTarget `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Target != "" {
+		req.Targets = append(req.Targets, relayTarget{Name: req.Target})
+	}
+
+	relay, err := ws.addRelay(identity, req.Targets)
+	if err != nil {
+		http.Error(w, err.message, err.status)
+		return
+	}
+	go ws.expireRelay(relay)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": relay.id, "targets": relay.targets})
+}
+
+// addRelay adds a remote listener for targets registered by identity
+func (ws *WhetServer) addRelay(identity *Identity, targets []relayTarget) (*relayListener, *offerError) {
+	invalid := &offerError{status: http.StatusBadRequest, message: "Invalid target"}
+	if len(targets) == 0 {
+		return nil, invalid
+	}
+
+	relay := &relayListener{
+		id:       uuid.New().String(),
+		identity: identity.Name,
+		offers:   make(chan *relayOffer),
+		done:     make(chan struct{}),
+		pending:  make(map[string]*relayOffer),
+		lastPoll: time.Now(),
+	}
+	added := make(map[string]*ForwardTargetPort)
+	for _, t := range targets {
+		// a hyphen separates the port offset of a target
+		if t.Name == "" || strings.ContainsAny(t.Name, "/-?#") || t.Ports < 0 || added[t.Name] != nil {
+			return nil, invalid
+		}
+		if !identity.CanAccess(t.Name, 0) {
+			return nil, &offerError{status: http.StatusForbidden, message: "Forbidden"}
+		}
+		added[t.Name] = &ForwardTargetPort{
+			TargetName:        t.Name,
+			PortCount:         t.Ports,
+			Description:       t.Description,
+			ForwardTargetType: ForwardTargetTypeRemote,
+			relay:             relay,
+		}
+		relay.targets = append(relay.targets, t.Name)
+	}
+
+	ws.mut.Lock()
+	for name := range added {
+		if _, exists := ws.Targets[name]; exists {
+			ws.mut.Unlock()
+			return nil, &offerError{status: http.StatusConflict, message: "Target already exists"}
+		}
+	}
+	for name, target := range added {
+		ws.Targets[name] = target
+	}
+	ws.relays[relay.id] = relay
+	ws.mut.Unlock()
+
+	fmt.Printf("Remote listener %s registered targets %s for %s\n", relay.id, strings.Join(relay.targets, ","), identity.Name)
+	return relay, nil
+}
+
+// removeRelay removes a remote listener and its targets.  It is safe to call more than once.
+func (ws *WhetServer) removeRelay(relay *relayListener, reason string) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	if ws.relays[relay.id] != relay {
+		return
+	}
+	delete(ws.relays, relay.id)
+	for _, name := range relay.targets {
+		if target, ok := ws.Targets[name]; ok && target.relay == relay {
+			delete(ws.Targets, name)
+		}
+	}
+	close(relay.done)
+	fmt.Printf("Remote listener %s for targets %s removed: %s\n", relay.id, strings.Join(relay.targets, ","), reason)
+}
+
+// expireRelay removes a remote listener once it stops polling
+func (ws *WhetServer) expireRelay(relay *relayListener) {
+	ticker := time.NewTicker(relayExpiry / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-relay.done:
+			return
+		case <-ticker.C:
+			relay.mut.Lock()
+			expired := relay.polls == 0 && time.Since(relay.lastPoll) > relayExpiry
+			relay.mut.Unlock()
+			if expired {
+				ws.removeRelay(relay, "stopped polling")
+				return
+			}
+		}
+	}
+}
+
+// answered passes a remote listener's answer to the client waiting for it, reporting
+// false if no client is waiting for the session
+func (relay *relayListener) answered(answer relayAnswer) bool {
+	relay.mut.Lock()
+	offer := relay.pending[answer.Session]
+	delete(relay.pending, answer.Session)
+	relay.mut.Unlock()
+	if offer == nil {
+		return false
+	}
+	offer.answer <- answer
+	return true
+}
+
+// poll writes the next offer for the remote listener, or 204 if none arrives in time
+func (relay *relayListener) poll(w http.ResponseWriter, r *http.Request) {
+	relay.mut.Lock()
+	relay.polls++
+	relay.mut.Unlock()
+	defer func() {
+		relay.mut.Lock()
+		relay.polls--
+		relay.lastPoll = time.Now()
+		relay.mut.Unlock()
+	}()
+
+	timer := time.NewTimer(relayPollTimeout)
+	defer timer.Stop()
+	select {
+	case offer := <-relay.offers:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(offer)
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-relay.done:
+		http.Error(w, "Unknown listener", http.StatusNotFound)
+	case <-r.Context().Done():
+	}
+}
+
+// relayOffer passes a client's offer for targetPath to the remote listener of the target
+// and returns the session id and the listener's answer.  The relayed session is not
+// tracked by the server: it isn't listed by the sessions API, audited when it closes or
+// counted towards MaxSessionsPerTarget once answered.
+func (ws *WhetServer) relayOffer(ctx context.Context, relay *relayListener, targetPath string, sdp string, identity *Identity) (string, string, error) {
+	offer := &relayOffer{
+		Session:  uuid.New().String(),
+		Target:   targetPath,
+		Identity: identity.Name,
+		SDP:      sdp,
+		answer:   make(chan relayAnswer, 1),
+	}
+	relay.mut.Lock()
+	relay.pending[offer.Session] = offer
+	relay.mut.Unlock()
+	defer func() {
+		relay.mut.Lock()
+		delete(relay.pending, offer.Session)
+		relay.mut.Unlock()
+	}()
+
+	closed := &offerError{status: http.StatusBadGateway, message: "Listener closed"}
+	timer := time.NewTimer(relayAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case relay.offers <- offer:
+	case <-relay.done:
+		return "", "", closed
+	case <-timer.C:
+		return "", "", &offerError{status: http.StatusGatewayTimeout, message: "Listener did not poll for the offer"}
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+
+	var answer relayAnswer
+	select {
+	case answer = <-offer.answer:
+	case <-relay.done:
+		return "", "", closed
+	case <-timer.C:
+		return "", "", &offerError{status: http.StatusGatewayTimeout, message: "Listener did not answer"}
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+	if answer.Error != "" || answer.SDP == "" {
+		return "", "", &offerError{status: http.StatusBadGateway, message: "Listener refused the offer: " + answer.Error}
+	}
+	// a single use signed URL is used up by the session it opened, the remote listener's
+	// peer connection never connects without the answer
+	if err := identity.claim(); err != nil {
+		return "", "", &offerError{status: http.StatusUnauthorized, message: "Unauthorized"}
+	}
+
+	ws.Metrics.Inc("whet_sessions_relayed_total", "target", strings.SplitN(targetPath, "-", 2)[0], "identity", identity.Name)
+	fmt.Printf("Session %s relayed by %s to remote listener %s for target %s\n", offer.Session, identity.Name, relay.id, targetPath)
+
+	// closing the session is accepted and ignored, the session is between the peers
+	return offer.Session, answer.SDP, nil
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRemoteListener(t *testing.T) {
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := "http://" + listener.Addr().String()
+
+	// remote listeners must be enabled
+	d := &Dialer{ICEServers: []webrtc.ICEServer{}, Timeout: 10 * time.Second}
+	var signalErr *SignalError
+	if _, err := d.ListenRemote(server, "echo", ""); !errors.As(err, &signalErr) || signalErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 with remote listeners disabled, got %v", err)
+	}
+	s.RemoteListeners = true
+
+	l, err := d.ListenRemote(server, "echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := d.ListenRemote(server, "echo", ""); !errors.As(err, &signalErr) || signalErr.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 registering the target twice, got %v", err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := d.Dial(server, "whet/echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello remote listener")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expected the message echoed, got %q %v", got, err)
+	}
+
+	// closing the listener removes its target
+	l.Close()
+	if _, ok := s.Target("echo"); ok {
+		t.Errorf("expected the target to be removed")
+	}
+}
+
+func TestAgent(t *testing.T) {
+	// the target only the agent can reach
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	rendezvous, _ := NewWhetServer("secret", nil, nil, nil, true)
+	rendezvous.RemoteListeners = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rendezvous.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := "http://" + listener.Addr().String()
+
+	target, err := ParseForwardTargetPortFromString("echo=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, _ := NewWhetServer("", map[string]*ForwardTargetPort{"echo": target}, nil, nil, true)
+	if _, err := agent.StartAgent(server, "wrong"); err == nil {
+		t.Fatalf("expected the rendezvous server to reject the agent's token")
+	}
+	a, err := agent.StartAgent(server, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if target, ok := rendezvous.Target("echo"); !ok || target.ForwardTargetType != ForwardTargetTypeRemote {
+		t.Fatalf("expected the agent's target on the rendezvous server")
+	}
+
+	d := &Dialer{Timeout: 20 * time.Second}
+	conn, err := d.Dial(server, "whet/echo", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello agent")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expected the message echoed, got %q %v", got, err)
+	}
+}
+
+func TestRelayedSessionLimits(t *testing.T) {
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+	s.RateLimits = &RateLimitConfig{MaxSessionsPerTarget: 1}
+	relay, oerr := s.addRelay(anonymousIdentity, []relayTarget{{Name: "echo"}})
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+	defer s.removeRelay(relay, "test")
+
+	offer := func() int {
+		r := httptest.NewRequest("POST", "/whet/echo", strings.NewReader("offer"))
+		w := httptest.NewRecorder()
+		s.WhetHandler(w, r)
+		return w.Code
+	}
+
+	// while an offer waits for the listener's answer it holds the target's slot
+	first := make(chan int, 1)
+	go func() { first <- offer() }()
+	var waiting *relayOffer
+	select {
+	case waiting = <-relay.offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the offer to be relayed")
+	}
+	if code := offer(); code != http.StatusTooManyRequests {
+		t.Errorf("expected a second offer to be refused while the first is pending, got %d", code)
+	}
+	waiting.answer <- relayAnswer{Session: waiting.Session, SDP: "answer"}
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("expected the relayed answer, got %d", code)
+	}
+
+	// answered sessions are between the client and the listener and are not counted
+	go func() {
+		waiting := <-relay.offers
+		waiting.answer <- relayAnswer{Session: waiting.Session, SDP: "answer"}
+	}()
+	if code := offer(); code != http.StatusOK {
+		t.Errorf("expected another offer once the first was answered, got %d", code)
+	}
+	if sessions := s.Sessions(); len(sessions) != 0 {
+		t.Errorf("expected relayed sessions not to be listed, got %d", len(sessions))
+	}
+	if open, pending, target := s.sessionCounts("echo"); open+pending+target != 0 || len(s.reserved) != 0 {
+		t.Errorf("expected no slots held, got %d %d %d %v", open, pending, target, s.reserved)
+	}
+}
@@ -0,0 +1,508 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// RemoteListener accepts the connections to a target this process registered with a
+// whet server.  The server relays the offers of clients dialing the target and the
+// listener answers them, so the connections are made directly between the client and
+// this process.  A browser tab running the wasm client can serve a target this way.
+type RemoteListener struct {
+	client     *relayClient
+	target     string
+	iceServers []webrtc.ICEServer
+	conns      chan net.Conn
+}
+
+// ListenRemote registers target with the whet server at signalServer, which must have
+// RemoteListeners set, and returns a listener for the connections to it
+func ListenRemote(signalServer string, target string, bearerToken string) (*RemoteListener, error) {
+	return (&Dialer{}).ListenRemote(signalServer, target, bearerToken)
+}
+
+// ListenRemote registers target like ListenRemote, answering offers with the dialer's
+// ICE servers.  The timeout limits registering the target and answering each offer.
+func (d *Dialer) ListenRemote(signalServer string, target string, bearerToken string) (*RemoteListener, error) {
+	l := &RemoteListener{
+		target:     target,
+		iceServers: d.ICEServers,
+		conns:      make(chan net.Conn),
+	}
+	l.client = newRelayClient(signalServer, bearerToken, d.Timeout, func() []relayTarget {
+		return []relayTarget{{Name: target}}
+	}, l.answer)
+	if err := l.client.start(false); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Target returns the name of the target the listener serves
+func (l *RemoteListener) Target() string {
+	return l.target
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *RemoteListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.client.ctx.Done():
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+// Close unregisters the target.  Connections already accepted are not closed.
+func (l *RemoteListener) Close() error {
+	return l.client.close()
+}
+
+// Addr returns the target the listener serves
+func (l *RemoteListener) Addr() net.Addr {
+	return whetAddr(l.target)
+}
+
+// answer answers an offer for the listener's target
+func (l *RemoteListener) answer(ctx context.Context, offer relayOffer) (string, error) {
+	return answerListenerOffer(ctx, offer.SDP, l.iceServers, func(conn net.Conn) {
+		select {
+		case l.conns <- conn:
+		case <-l.client.ctx.Done():
+			conn.Close()
+		}
+	})
+}
+
+// whetAddr is the address of a whet target
+type whetAddr string
+
+func (a whetAddr) Network() string { return "whet" }
+func (a whetAddr) String() string  { return string(a) }
+
+// relayClient registers targets as a remote listener of a whet server and answers the
+// offers the server relays for them
+type relayClient struct {
+	signalServer string
+	bearerToken  string
+	timeout      time.Duration
+	// targets returns the targets to register
+	targets func() []relayTarget
+	// answer answers an offer, returning the answer SDP
+	answer func(ctx context.Context, offer relayOffer) (string, error)
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	mut        sync.Mutex
+	id         string
+	registered []relayTarget
+	// socket carries the registration when signaling over a WebSocket
+	socket *signalClient
+}
+
+func newRelayClient(signalServer string, bearerToken string, timeout time.Duration, targets func() []relayTarget, answer func(context.Context, relayOffer) (string, error)) *relayClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &relayClient{
+		signalServer: signalServer,
+		bearerToken:  bearerToken,
+		timeout:      timeout,
+		targets:      targets,
+		answer:       answer,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// start registers the targets and polls for offers, or for ws:// and wss:// servers
+// waits for them on a signaling socket.  With reregister the targets are registered
+// again when they change or the server drops the registration, otherwise polling stops
+// when the registration is dropped.
+func (rc *relayClient) start(reregister bool) error {
+	if IsSocketURL(rc.signalServer) {
+		if err := rc.registerSocket(); err != nil {
+			rc.cancel()
+			return err
+		}
+		go rc.serveSocket(reregister)
+		return nil
+	}
+	if err := rc.register(); err != nil {
+		rc.cancel()
+		return err
+	}
+	go rc.poll(reregister)
+	return nil
+}
+
+// register registers the current targets, replacing any earlier registration
+func (rc *relayClient) register() error {
+	ctx := rc.ctx
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	rc.mut.Lock()
+	previous := rc.id
+	rc.mut.Unlock()
+	if previous != "" {
+		rc.request(ctx, http.MethodDelete, previous, nil, nil)
+	}
+
+	targets := rc.targets()
+	var registration struct {
+		ID string `json:"id"`
+	}
+	if err := rc.request(ctx, http.MethodPost, "", map[string]interface{}{"targets": targets}, &registration); err != nil {
+		return err
+	}
+	rc.mut.Lock()
+	rc.id = registration.ID
+	rc.registered = targets
+	rc.mut.Unlock()
+	return nil
+}
+
+// close stops polling and removes the registration
+func (rc *relayClient) close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		rc.cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rc.mut.Lock()
+		id, sc := rc.id, rc.socket
+		rc.mut.Unlock()
+		if IsSocketURL(rc.signalServer) {
+			// the server removes the registration when the socket closes
+			if sc != nil {
+				err = sc.close()
+			}
+			return
+		}
+		err = rc.request(ctx, http.MethodDelete, id, nil, nil)
+	})
+	return err
+}
+
+// request makes a request to the listeners API, decoding a JSON response into out
+func (rc *relayClient) request(ctx context.Context, method string, id string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	path := "api/listeners"
+	if id != "" {
+		path += "/" + id
+	}
+	req, err := http.NewRequestWithContext(ctx, method, signalURL(rc.signalServer, path), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if rc.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rc.bearerToken)
+	}
+
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return &SignalError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// poll waits for offers until the client is closed
+func (rc *relayClient) poll(reregister bool) {
+	defer rc.cancel()
+	backoff := time.Second
+	retry := func(err error) {
+		fmt.Printf("Remote listener on %s failed: %v\n", rc.signalServer, err)
+		select {
+		case <-time.After(backoff):
+		case <-rc.ctx.Done():
+		}
+		backoff = min(backoff*2, relayExpiry/4)
+	}
+
+	for rc.ctx.Err() == nil {
+		rc.mut.Lock()
+		id, registered := rc.id, rc.registered
+		rc.mut.Unlock()
+		if reregister && !sameRelayTargets(registered, rc.targets()) {
+			if err := rc.register(); err != nil {
+				retry(err)
+			}
+			continue
+		}
+
+		var offer relayOffer
+		err := rc.request(rc.ctx, http.MethodGet, id, nil, &offer)
+		var signalErr *SignalError
+		switch {
+		case rc.ctx.Err() != nil:
+			return
+		case errors.As(err, &signalErr) && signalErr.StatusCode == http.StatusNotFound:
+			if !reregister {
+				fmt.Printf("Remote listener on %s was removed by the server\n", rc.signalServer)
+				return
+			}
+			// the server restarted or expired the registration
+			rc.mut.Lock()
+			rc.id, rc.registered = "", nil
+			rc.mut.Unlock()
+			continue
+		case err != nil:
+			// keep polling through transient failures, the registration lasts relayExpiry
+			retry(err)
+			continue
+		}
+		backoff = time.Second
+		if offer.Session != "" {
+			go rc.respond(offer, func(ctx context.Context, answer relayAnswer) error {
+				return rc.request(ctx, http.MethodPost, id, answer, nil)
+			})
+		}
+	}
+}
+
+// respond answers an offer and sends the answer to the server with post
+func (rc *relayClient) respond(offer relayOffer, post func(context.Context, relayAnswer) error) {
+	ctx := rc.ctx
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	answer := relayAnswer{Session: offer.Session}
+	sdp, err := rc.answer(ctx, offer)
+	if err != nil {
+		answer.Error = err.Error()
+	} else {
+		answer.SDP = sdp
+	}
+	if err := post(ctx, answer); err != nil {
+		fmt.Printf("Remote listener failed to answer for %s: %v\n", offer.Target, err)
+	}
+}
+
+// registerSocket opens a signaling socket and registers the targets on it
+func (rc *relayClient) registerSocket() error {
+	ctx := rc.ctx
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+	sc, err := dialSignalClient(ctx, rc.signalServer, rc.bearerToken, func(sc *signalClient, msg *signalMessage) {
+		offer := relayOffer{Session: msg.Session, Target: msg.Target, Identity: msg.Identity, SDP: msg.SDP}
+		rc.respond(offer, func(ctx context.Context, answer relayAnswer) error {
+			return sc.send(&signalMessage{Type: "relay-answer", Session: answer.Session, SDP: answer.SDP, Error: answer.Error})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := rc.listenSocket(ctx, sc); err != nil {
+		sc.close()
+		return err
+	}
+	rc.mut.Lock()
+	rc.socket = sc
+	rc.mut.Unlock()
+	return nil
+}
+
+// listenSocket registers the current targets on a signaling socket, replacing any
+// earlier registration on it
+func (rc *relayClient) listenSocket(ctx context.Context, sc *signalClient) error {
+	targets := rc.targets()
+	reply, _, err := sc.request(ctx, &signalMessage{Type: "listen", Targets: targets})
+	if err != nil {
+		return err
+	}
+	sc.forget(reply.ID)
+	rc.mut.Lock()
+	rc.registered = targets
+	rc.mut.Unlock()
+	return nil
+}
+
+// serveSocket keeps the registration on the signaling socket until the client is
+// closed, the offers on it are answered as they arrive
+func (rc *relayClient) serveSocket(reregister bool) {
+	defer rc.cancel()
+	backoff := time.Second
+	ticker := time.NewTicker(relayPollTimeout)
+	defer ticker.Stop()
+
+	for rc.ctx.Err() == nil {
+		rc.mut.Lock()
+		sc, registered := rc.socket, rc.registered
+		rc.mut.Unlock()
+		if sc == nil {
+			// the server restarted or the network failed, register on a new socket
+			if err := rc.registerSocket(); err != nil {
+				fmt.Printf("Remote listener on %s failed: %v\n", rc.signalServer, err)
+				select {
+				case <-time.After(backoff):
+				case <-rc.ctx.Done():
+				}
+				backoff = min(backoff*2, relayExpiry/4)
+				continue
+			}
+			backoff = time.Second
+			continue
+		}
+
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-sc.done:
+			if !reregister {
+				fmt.Printf("Remote listener on %s lost its signaling socket\n", rc.signalServer)
+				return
+			}
+			rc.mut.Lock()
+			rc.socket = nil
+			rc.mut.Unlock()
+		case <-ticker.C:
+			if reregister && !sameRelayTargets(registered, rc.targets()) {
+				if err := rc.listenSocket(rc.ctx, sc); err != nil {
+					fmt.Printf("Remote listener on %s failed to register: %v\n", rc.signalServer, err)
+				}
+				continue
+			}
+			// keep the socket open through proxies that close idle connections
+			sc.send(&signalMessage{Type: "ping"})
+		}
+	}
+}
+
+// sameRelayTargets reports if two registrations have the same targets in the same order
+func sameRelayTargets(a []relayTarget, b []relayTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// answerListenerOffer answers an offer as the server side of a connection, passing
+// the connection to accept once its data channel is open and the handshake is done
+func answerListenerOffer(ctx context.Context, offer string, iceServers []webrtc.ICEServer, accept func(net.Conn)) (string, error) {
+	_, peerConnection, err := setupWebRTCConnection(true, iceServers)
+	if err != nil {
+		return "", err
+	}
+
+	c := &Connection{
+		peerConnection: peerConnection,
+		sendMoreCh:     make(chan struct{}, 1),
+		detached:       true,
+		created:        time.Now(),
+	}
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			peerConnection.Close()
+		}
+	})
+
+	// close peer connections the client never completes
+	var accepted atomic.Bool
+	time.AfterFunc(2*relayAnswerTimeout, func() {
+		if !accepted.Load() {
+			peerConnection.Close()
+		}
+	})
+
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		dataChannel.OnOpen(func() {
+			rawDetached, err := dataChannel.Detach()
+			if err != nil {
+				fmt.Printf("Failed to detach data channel: %v\n", err)
+				peerConnection.Close()
+				return
+			}
+			c.rawDetached = rawDetached
+			c.dataChannel = dataChannel
+
+			go func() {
+				if err := handleHandshake(c, true, nil); err != nil {
+					fmt.Printf("Error handling handshake: %v\n", err)
+					peerConnection.Close()
+					return
+				}
+				accepted.Store(true)
+				conn, _ := ListenerWebRTCConn(c)
+				accept(conn)
+			}()
+		})
+
+		dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+		dataChannel.OnBufferedAmountLow(func() {
+			select {
+			case c.sendMoreCh <- struct{}{}:
+			default:
+			}
+		})
+	})
+
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		peerConnection.Close()
+		return "", fmt.Errorf("failed to set remote description: %v", err)
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		return "", fmt.Errorf("failed to create answer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		return "", fmt.Errorf("failed to set local description: %v", err)
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		peerConnection.Close()
+		return "", ctx.Err()
+	}
+	return peerConnection.LocalDescription().SDP, nil
+}
@@ -0,0 +1,359 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Proxy targets are given in the form 'subdomain=upstream[?options]' where upstream is
+host:port for a plain http upstream or an http:// or https:// URL.  Requests to
+/subdomain/... are forwarded to the upstream with the /subdomain prefix stripped and the
+path of the upstream URL prepended.  WebSocket upgrades and streamed responses such as
+server-sent events are passed through.
+
+The upstream can also be reached through whet rather than a TCP address, making the
+server an HTTP gateway to services that are only reachable peer-to-peer.  'whet:target'
+connects to a target of this server, including listeners added with AddListener, without
+leaving the process.  'whet://server/target' and 'whets://server/target' connect to a
+target of another whet server over WebRTC, signaling with http or https.  A path after
+the target is prepended to the forwarded path like the path of an http upstream.
+
+// a plain http upstream
+-proxytarget app=localhost:3000
+
+// an https upstream serving under /v2, only for callers with a token for 'api'
+-proxytarget api=https://10.0.0.9:8443/v2?auth&timeout=30s
+
+// a listener of this server and a target of another server, signaling with its token
+-proxytarget dash=whet:dashboard
+-proxytarget wiki=whets://edge.example.com/wiki?token=s3cret
+
+// keep the /grafana prefix, set a header and drop the client's cookies
+-proxytarget grafana=localhost:3001?keepprefix&header=X-WEBAUTH-USER:admin&removeheader=Cookie
+
+The options are:
+keepprefix    forward the /subdomain prefix instead of stripping it
+auth          require a token for the subdomain, checked like a target of the same name
+timeout       how long to wait for the upstream response headers, 502 or 504 on failure
+header        'Name:value' to set on requests to the upstream (can be repeated)
+removeheader  a header to remove from requests to the upstream (can be repeated)
+insecure      skip verifying the certificate of an https upstream
+token         the token of the whet server of a whet:// or whets:// upstream
+*/
+
+// ParseProxyTargetFromString parses a proxy target in the form subdomain=upstream[?options]
+func ParseProxyTargetFromString(id string) (*ProxyTarget, error) {
+	subdomain, upstream, ok := strings.Cut(id, "=")
+	subdomain = strings.Trim(subdomain, "/")
+	if !ok || subdomain == "" || upstream == "" {
+		return nil, fmt.Errorf("invalid proxy target format: %s (expected format: subdomain=address:port)", id)
+	}
+	upstream, options, _ := strings.Cut(upstream, "?")
+
+	p := &ProxyTarget{
+		Subdomain: subdomain,
+		Address:   upstream,
+	}
+	if _, err := p.upstreamURL(); err != nil {
+		return nil, err
+	}
+	if err := p.parseOptions(options); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseOptions parses the '?key=value&...' options of a proxy target
+func (p *ProxyTarget) parseOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("invalid proxy options %q", options)
+	}
+	for key, vals := range values {
+		value := vals[0]
+		switch key {
+		case "keepprefix":
+			if p.KeepPrefix, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid keepprefix %q", value)
+			}
+		case "auth":
+			if p.Auth, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid auth %q", value)
+			}
+		case "insecure":
+			if p.InsecureSkipVerify, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid insecure %q", value)
+			}
+		case "timeout":
+			p.Timeout, err = time.ParseDuration(value)
+			if err != nil || p.Timeout < 0 {
+				return fmt.Errorf("invalid timeout %q", value)
+			}
+		case "header":
+			for _, h := range vals {
+				name, v, ok := strings.Cut(h, ":")
+				if !ok || strings.TrimSpace(name) == "" {
+					return fmt.Errorf("invalid header %q (expected Name:value)", h)
+				}
+				if p.SetHeaders == nil {
+					p.SetHeaders = make(map[string]string)
+				}
+				p.SetHeaders[strings.TrimSpace(name)] = strings.TrimSpace(v)
+			}
+		case "removeheader":
+			p.RemoveHeaders = append(p.RemoveHeaders, vals...)
+		case "token":
+			p.Token = value
+		default:
+			return fmt.Errorf("unknown proxy option %q", key)
+		}
+	}
+	return nil
+}
+
+// whetUpstream is an upstream reached through whet
+type whetUpstream struct {
+	// server is the signal server of a remote target, empty for a target of this server
+	server string
+	// target is the target path, the name with an optional port offset
+	target string
+	path   string
+}
+
+// whetUpstream parses a 'whet:target', 'whet://server/target' or 'whets://server/target'
+// upstream, returning nil for an http upstream
+func (p *ProxyTarget) whetUpstream() (*whetUpstream, error) {
+	var wu whetUpstream
+	var rest string
+	switch {
+	case strings.HasPrefix(p.Address, "whet://"), strings.HasPrefix(p.Address, "whets://"):
+		u, err := url.Parse(p.Address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy upstream %q", p.Address)
+		}
+		wu.server = "http://" + u.Host
+		if u.Scheme == "whets" {
+			wu.server = "https://" + u.Host
+		}
+		rest = strings.TrimPrefix(u.Path, "/")
+	case strings.HasPrefix(p.Address, "whet:"):
+		rest = strings.TrimPrefix(p.Address, "whet:")
+	default:
+		return nil, nil
+	}
+
+	target, path, _ := strings.Cut(rest, "/")
+	if target == "" {
+		return nil, fmt.Errorf("missing target in proxy upstream %q", p.Address)
+	}
+	wu.target = target
+	wu.path = "/" + path
+	return &wu, nil
+}
+
+// upstreamURL returns the URL requests are forwarded to, defaulting to http.  A whet
+// upstream is addressed by its target name.
+func (p *ProxyTarget) upstreamURL() (*url.URL, error) {
+	wu, err := p.whetUpstream()
+	if err != nil {
+		return nil, err
+	}
+	if wu != nil {
+		return &url.URL{Scheme: "http", Host: wu.target, Path: wu.path}, nil
+	}
+
+	address := p.Address
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy upstream %q", p.Address)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy upstream scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// proxyHandler returns the reverse proxy for the proxy target
+func (ws *WhetServer) proxyHandler(p ProxyTarget) (http.Handler, error) {
+	upstream, err := p.upstreamURL()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "/" + p.Subdomain
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = p.Timeout
+	if p.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	wu, err := p.whetUpstream()
+	if err != nil {
+		return nil, err
+	}
+	if wu != nil {
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if wu.server == "" {
+				return ws.dialLocalTarget(ctx, wu.target)
+			}
+			return dialWhetContext(ctx, wu.server, wu.target, p.Token)
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		// flush immediately so streamed responses aren't held back
+		FlushInterval: -1,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if !p.KeepPrefix {
+				pr.Out.URL.Path = stripPathPrefix(pr.Out.URL.Path, prefix)
+				if pr.Out.URL.RawPath != "" {
+					pr.Out.URL.RawPath = stripPathPrefix(pr.Out.URL.RawPath, prefix)
+				}
+			}
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+
+			// the whet token is not meant for the upstream
+			if p.Auth {
+				pr.Out.Header.Del("Authorization")
+			}
+			for _, name := range p.RemoveHeaders {
+				pr.Out.Header.Del(name)
+			}
+			for name, value := range p.SetHeaders {
+				pr.Out.Header.Set(name, value)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+			var ne net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+				status = http.StatusGatewayTimeout
+			}
+			fmt.Printf("Proxy %s to %s failed: %v\n", p.Subdomain, upstream.Host, err)
+			proxyErrorPage(w, status, p.Subdomain)
+		},
+	}
+
+	if !p.Auth {
+		return proxy, nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := ws.requireIdentity(w, r)
+		if identity == nil {
+			return
+		}
+		if !identity.CanAccess(p.Subdomain, 0) {
+			ws.audit(&AuditEvent{Event: AuditAuthFailure, RemoteAddr: r.RemoteAddr, Identity: identity.Name, Target: p.Subdomain, Action: r.URL.Path, Reason: "proxy not allowed"})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}), nil
+}
+
+// stripPathPrefix removes prefix from path, keeping the path absolute
+func stripPathPrefix(path string, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// proxyErrorPage writes a minimal error page for a failed proxy request
+func proxyErrorPage(w http.ResponseWriter, status int, subdomain string) {
+	text := strconv.Itoa(status) + " " + http.StatusText(status)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body><h1>%s</h1><p>The upstream of /%s/ could not be reached.</p></body></html>\n",
+		text, text, html.EscapeString(subdomain))
+}
+
+// dialLocalTarget connects to a target of this server in process, handing a listener
+// target one end of a pipe as if a client had connected to it
+func (ws *WhetServer) dialLocalTarget(ctx context.Context, targetPath string) (net.Conn, error) {
+	name, offsetStr, hasOffset := strings.Cut(targetPath, "-")
+	offset := 0
+	if hasOffset {
+		var err error
+		if offset, err = strconv.Atoi(offsetStr); err != nil {
+			return nil, fmt.Errorf("invalid target %q", targetPath)
+		}
+	}
+
+	target, ok := ws.Target(name)
+	if !ok || offset < 0 || (offset != 0 && offset >= target.PortCount) {
+		return nil, fmt.Errorf("unknown target %q", targetPath)
+	}
+
+	if target.ForwardTargetType == ForwardTargetTypeRemote {
+		return nil, fmt.Errorf("target %q is served by a remote listener, proxy it with whet://", name)
+	}
+	if target.ForwardTargetType != ForwardTargetTypeListener {
+		conn, _, err := target.dial(offset)
+		return conn, err
+	}
+
+	ws.mut.Lock()
+	wl := ws.Listeners[name]
+	ws.mut.Unlock()
+	if wl == nil {
+		return nil, fmt.Errorf("listener %q is closed", name)
+	}
+	client, server := net.Pipe()
+	if err := wl.deliver(ctx, server); err != nil {
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("listener %q: %w", name, err)
+	}
+	return client, nil
+}
+
+// dialWhetContext connects to a target of another whet server, giving up when ctx is done
+func dialWhetContext(ctx context.Context, signalServer string, targetPath string, token string) (net.Conn, error) {
+	type result struct {
+		conn *WebRTCConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := DialWebRTCConn(signalServer, "whet/"+targetPath, token, true)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.conn, nil
+	case <-ctx.Done():
+		// close the connection if it is established after all
+		go func() {
+			if r := <-done; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseProxyTarget(t *testing.T) {
+	p, err := ParseProxyTargetFromString("api=https://10.0.0.9:8443/v2?auth&timeout=30s&header=X-Env:prod&header=X-Team:%20core&removeheader=Cookie")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if p.Subdomain != "api" || p.Address != "https://10.0.0.9:8443/v2" || !p.Auth || p.Timeout != 30*time.Second {
+		t.Errorf("got %+v", p)
+	}
+	if p.SetHeaders["X-Env"] != "prod" || p.SetHeaders["X-Team"] != "core" || len(p.RemoveHeaders) != 1 {
+		t.Errorf("got headers %v %v", p.SetHeaders, p.RemoveHeaders)
+	}
+
+	for _, id := range []string{
+		"api",
+		"=localhost:9000",
+		"api=ftp://localhost:21",
+		"api=localhost:9000?timeout=soon",
+		"api=localhost:9000?header=novalue",
+		"api=localhost:9000?retries=3",
+	} {
+		if _, err := ParseProxyTargetFromString(id); err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Env", r.Header.Get("X-Env"))
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Forwarded", r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer upstream.Close()
+
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+	s.Tokens, _ = NewTokenStore([]*Token{
+		{Name: "api", Secret: "api-token", Targets: []string{"api"}},
+		{Name: "ssh", Secret: "ssh-token", Targets: []string{"ssh"}},
+	})
+	p, err := ParseProxyTargetFromString("api=" + upstream.URL + "/v2?auth&timeout=100ms&header=X-Env:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := s.proxyHandler(*p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, token string) *http.Response {
+		r := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	resp := get("/api/items/1", "api-token")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Path") != "/v2/items/1" {
+		t.Errorf("expected the prefix to be rewritten, got %d %s", resp.StatusCode, resp.Header.Get("X-Path"))
+	}
+	if resp.Header.Get("X-Env") != "prod" || resp.Header.Get("X-Auth") != "" || resp.Header.Get("X-Forwarded") == "" {
+		t.Errorf("unexpected upstream headers %v", resp.Header)
+	}
+
+	if resp := get("/api/items/1", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+	if resp := get("/api/items/1", "ssh-token"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a token scoped to another target, got %d", resp.StatusCode)
+	}
+	if resp := get("/api/slow", "api-token"); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 from a slow upstream, got %d", resp.StatusCode)
+	}
+
+	upstream.Close()
+	resp = get("/api/items/1", "api-token")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "502 Bad Gateway") {
+		t.Errorf("expected a 502 page from a closed upstream, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestProxyWhetUpstream(t *testing.T) {
+	s, _ := NewWhetServer("", map[string]*ForwardTargetPort{}, nil, nil, true)
+	listener, err := s.AddListener("dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "dash "+r.URL.Path)
+	}))
+
+	p, err := ParseProxyTargetFromString("dash=whet:dash/ui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := s.proxyHandler(*p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dash/index.html", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "dash /ui/index.html" {
+		t.Errorf("expected the listener to answer, got %d %q", w.Code, w.Body.String())
+	}
+
+	// an unknown target is a bad gateway
+	p, _ = ParseProxyTargetFromString("missing=whet:missing")
+	handler, _ = s.proxyHandler(*p)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for an unknown target, got %d", w.Code)
+	}
+
+	for id, server := range map[string]string{
+		"wiki=whet://edge:8080/wiki":          "http://edge:8080",
+		"wiki=whets://edge.example.com/wiki/": "https://edge.example.com",
+	} {
+		p, err := ParseProxyTargetFromString(id)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", id, err)
+		}
+		wu, _ := p.whetUpstream()
+		if wu == nil || wu.server != server || wu.target != "wiki" {
+			t.Errorf("%s: got %+v", id, wu)
+		}
+	}
+	if _, err := ParseProxyTargetFromString("wiki=whet://edge:8080/"); err == nil {
+		t.Errorf("expected a missing target to fail")
+	}
+}
+
+func TestDialClosedListener(t *testing.T) {
+	s, _ := NewWhetServer("", map[string]*ForwardTargetPort{}, nil, nil, true)
+	listener, err := s.AddListener("dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dials racing the close fail rather than panic on a closed channel
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if conn, err := s.dialLocalTarget(ctx, "dash"); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	// let the dials wait for an accept
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	wg.Wait()
+
+	if _, err := s.dialLocalTarget(context.Background(), "dash"); err == nil {
+		t.Errorf("expected dialing a closed listener to fail")
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Errorf("expected accept on a closed listener to fail")
+	}
+	listener.Close()
+}
@@ -0,0 +1,296 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Folders are served in the form 'subdomain=/path[?options]'.  Files get an ETag and are
+revalidated with If-None-Match, directories without an index.html are listed.
+
+// serve a single page app, falling back to index.html for client-side routes
+-servefolder app=/srv/app?spa&cache=1h&precompressed
+
+// serve downloads without a directory listing and never cache them
+-servefolder files=/srv/files?nolisting&cache=no-store
+
+The options are:
+spa            serve the root index.html for unknown paths without a file extension
+nolisting      return 404 for directories without an index.html
+cache          a duration for 'Cache-Control: public, max-age=...', or no-cache or no-store.
+               index.html is always served with no-cache so new deployments are picked up.
+precompressed  serve file.br or file.gz next to file to clients that accept them
+
+A folder can also be embedded into the binary by adding a ServeFolder with FS set to an
+embed.FS, e.g. ws.AddFolder(&ServeFolder{Subdomain: "app", FS: sub, SPA: true}).
+*/
+
+// ServeFolder is a folder of static files served under /subdomain/
+type ServeFolder struct {
+	Subdomain string
+	// Path is the folder on disk, not used when FS is set
+	Path string
+	// FS is the file system to serve instead of Path, such as an embed.FS
+	FS fs.FS
+	// SPA serves the root index.html for unknown paths without a file extension so
+	// client-side routes work
+	SPA bool
+	// NoListing returns 404 for directories without an index.html
+	NoListing bool
+	// CacheControl is the Cache-Control header of files other than index.html, empty for none
+	CacheControl string
+	// Precompressed serves file.br or file.gz in place of file to clients that accept them
+	Precompressed bool
+
+	// etags caches the content hashes of files without a modification time
+	etags sync.Map
+}
+
+// ParseServeFolderFromString parses a folder in the form subdomain=/path[?options]
+func ParseServeFolderFromString(spec string) (*ServeFolder, error) {
+	subdomain, folder, ok := strings.Cut(spec, "=")
+	subdomain = strings.Trim(subdomain, "/")
+	folder, options, _ := strings.Cut(folder, "?")
+	if !ok || subdomain == "" || folder == "" {
+		return nil, fmt.Errorf("invalid folder specification: %s (expected format: subdomain=/path)", spec)
+	}
+
+	sf := &ServeFolder{
+		Subdomain: subdomain,
+		Path:      folder,
+	}
+	if err := sf.parseOptions(options); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// parseOptions parses the '?key=value&...' options of a folder
+func (sf *ServeFolder) parseOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return fmt.Errorf("invalid folder options %q", options)
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "spa":
+			if sf.SPA, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid spa %q", value)
+			}
+		case "nolisting":
+			if sf.NoListing, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid nolisting %q", value)
+			}
+		case "precompressed":
+			if sf.Precompressed, err = parseBoolOption(value); err != nil {
+				return fmt.Errorf("invalid precompressed %q", value)
+			}
+		case "cache":
+			switch value {
+			case "no-cache", "no-store":
+				sf.CacheControl = value
+			default:
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					return fmt.Errorf("invalid cache %q", value)
+				}
+				sf.CacheControl = "public, max-age=" + strconv.Itoa(int(d.Seconds()))
+			}
+		default:
+			return fmt.Errorf("unknown folder option %q", key)
+		}
+	}
+	return nil
+}
+
+// fsys returns the file system the folder is served from
+func (sf *ServeFolder) fsys() fs.FS {
+	if sf.FS != nil {
+		return sf.FS
+	}
+	return os.DirFS(sf.Path)
+}
+
+// AddFolder serves the folder under /subdomain/ on a server that is already set up
+func (ws *WhetServer) AddFolder(sf *ServeFolder) error {
+	pattern := "/" + sf.Subdomain + "/"
+	if _, existing := ws.Mux.Handler(&http.Request{URL: &url.URL{Path: pattern}}); existing == pattern {
+		return fmt.Errorf("handler already exists for %s", pattern)
+	}
+	ws.Mux.Handle(pattern, http.StripPrefix(pattern[:len(pattern)-1], sf.handler()))
+	return nil
+}
+
+// handler serves the files of the folder, the request path is relative to the folder
+func (sf *ServeFolder) handler() http.Handler {
+	fsys := sf.fsys()
+	listing := http.FileServer(http.FS(fsys))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the browser whet client registers its service worker from here
+		w.Header().Set("Service-Worker-Allowed", "/whet/")
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		urlPath := path.Clean("/" + r.URL.Path)
+		name := strings.TrimPrefix(urlPath, "/")
+		if name == "" {
+			name = "."
+		}
+
+		info, err := fs.Stat(fsys, name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if sf.SPA && path.Ext(urlPath) == "" {
+				sf.serveFile(w, r, fsys, "index.html")
+				return
+			}
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !info.IsDir() {
+			sf.serveFile(w, r, fsys, name)
+			return
+		}
+
+		// directories are addressed with a trailing slash so relative links work.  The
+		// redirect is relative since the path has the subdomain stripped.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := path.Base(urlPath) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Location", target)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if _, err := fs.Stat(fsys, index); err == nil {
+			sf.serveFile(w, r, fsys, index)
+			return
+		}
+		if sf.NoListing {
+			http.NotFound(w, r)
+			return
+		}
+		listing.ServeHTTP(w, r)
+	})
+}
+
+// serveFile serves a file of the folder with its cache headers, or its precompressed
+// variant when the client accepts it
+func (sf *ServeFolder) serveFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	servedName := name
+	if sf.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !acceptsEncoding(accept, enc.name) {
+				continue
+			}
+			if info, err := fs.Stat(fsys, name+enc.ext); err == nil && !info.IsDir() {
+				servedName = name + enc.ext
+				w.Header().Set("Content-Encoding", enc.name)
+				break
+			}
+		}
+	}
+
+	f, err := fsys.Open(servedName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if path.Base(name) == "index.html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if sf.CacheControl != "" {
+		w.Header().Set("Cache-Control", sf.CacheControl)
+	}
+	if etag := sf.etag(servedName, info, content); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	// ServeContent would sniff the type of the compressed bytes, it's set above when known
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// etag returns the ETag of a file, built from the modification time and size or, for
+// files without a modification time such as embedded files, from a hash of the content
+func (sf *ServeFolder) etag(name string, info fs.FileInfo, content io.ReadSeeker) string {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	}
+	if etag, ok := sf.etags.Load(name); ok {
+		return etag.(string)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return ""
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+	sf.etags.Store(name, etag)
+	return etag
+}
+
+// acceptsEncoding reports if an Accept-Encoding header allows the encoding
+func acceptsEncoding(accept string, encoding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(enc), encoding) {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseServeFolder(t *testing.T) {
+	sf, err := ParseServeFolderFromString("app=/srv/app?spa&nolisting&cache=1h&precompressed")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if sf.Subdomain != "app" || sf.Path != "/srv/app" || !sf.SPA || !sf.NoListing || !sf.Precompressed || sf.CacheControl != "public, max-age=3600" {
+		t.Errorf("got %+v", sf)
+	}
+
+	for _, spec := range []string{"app", "app=", "app=/srv/app?cache=forever", "app=/srv/app?gzip"} {
+		if _, err := ParseServeFolderFromString(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestServeFolder(t *testing.T) {
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+	err := s.AddFolder(&ServeFolder{
+		Subdomain: "app",
+		FS: fstest.MapFS{
+			"index.html":       {Data: []byte("<html>app</html>")},
+			"app.js":           {Data: []byte("console.log('app')")},
+			"app.js.br":        {Data: []byte("brotli")},
+			"assets/logo.svg":  {Data: []byte("<svg/>")},
+			"docs/readme.txt":  {Data: []byte("readme")},
+			"docs/guide/a.txt": {Data: []byte("a")},
+		},
+		SPA:           true,
+		NoListing:     true,
+		CacheControl:  "public, max-age=60",
+		Precompressed: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// client-side routes fall back to index.html, missing files with an extension don't
+	if w := get("/app/settings/profile"); w.Code != http.StatusOK || w.Body.String() != "<html>app</html>" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected the SPA index, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := get("/app/missing.png"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing file, got %d", w.Code)
+	}
+
+	// directories are redirected relative to the folder and not listed without an index
+	if w := get("/app/docs"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "docs/" {
+		t.Errorf("expected a redirect to docs/, got %d %v", w.Code, w.Header())
+	}
+	if w := get("/app/docs/"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a directory listing, got %d", w.Code)
+	}
+
+	// the precompressed variant is served with the type of the original
+	w := get("/app/app.js", "Accept-Encoding", "gzip, br")
+	if w.Body.String() != "brotli" || w.Header().Get("Content-Encoding") != "br" || w.Header().Get("Content-Type") != "text/javascript; charset=utf-8" {
+		t.Errorf("expected the brotli variant, got %q %v", w.Body.String(), w.Header())
+	}
+	w = get("/app/app.js")
+	if w.Body.String() != "console.log('app')" || w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("expected the uncompressed file, got %q %v", w.Body.String(), w.Header())
+	}
+
+	// files are revalidated with their ETag
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+	if w := get("/app/app.js", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", w.Code)
+	}
+
+	if err := s.AddFolder(&ServeFolder{Subdomain: "app", FS: fstest.MapFS{}}); err == nil {
+		t.Errorf("expected adding the same folder twice to fail")
+	}
+}
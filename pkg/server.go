@@ -2,12 +2,13 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
@@ -22,7 +23,24 @@ import (
 // type to represent proxy targets
 type ProxyTarget struct {
 	Subdomain string
-	Address   string
+	// Address is the upstream, host:port for plain http, an http:// or https:// URL
+	// whose path is prepended to the forwarded path, or a whet target as 'whet:target'
+	// or 'whet://server/target'
+	Address string
+	// KeepPrefix forwards the /subdomain prefix instead of stripping it
+	KeepPrefix bool
+	// Auth requires a token that may open a target named like the subdomain
+	Auth bool
+	// Timeout limits waiting for the upstream response headers, 0 for no limit
+	Timeout time.Duration
+	// SetHeaders are set on requests to the upstream, replacing any sent by the client
+	SetHeaders map[string]string
+	// RemoveHeaders are removed from requests to the upstream
+	RemoveHeaders []string
+	// InsecureSkipVerify disables verifying the certificate of an https upstream
+	InsecureSkipVerify bool
+	// Token authenticates to the signal server of a whet:// or whets:// upstream
+	Token string
 }
 
 type WhetServer struct {
@@ -37,46 +55,69 @@ type WhetServer struct {
 	Addr         string
 	Listeners    map[string]*WhetListener
 	Id           string
+	// Tokens holds the named tokens accepted in addition to BearerToken, each
+	// scoped to a set of targets.  When nil only BearerToken is checked.
+	Tokens *TokenStore
+	// JWT validates bearer tokens that are JWTs, typically issued by an SSO provider
+	JWT *JWTValidator
+	// URLSigner verifies signed connect URLs, when nil signed URLs are not accepted
+	URLSigner *URLSigner
+	// RateLimits protects the signaling endpoint from abuse, when nil nothing is limited
+	RateLimits *RateLimitConfig
+	// Metrics counts signaling requests, sessions and rejected requests
+	Metrics *Metrics
+	// Audit receives a record of every session, authentication failure and admin
+	// API change, when nil nothing is recorded
+	Audit AuditSink
+
+	limiter  *rateLimiter
+	sessions map[string]*Connection
+	// reserved counts the slots of each target reserved for sessions not added yet
+	reserved map[string]int
+	// CORS restricts the browser origins allowed to use the signaling endpoints.
+	// When nil every origin is allowed.  Use SetCORS on a running server.
+	CORS *CORSConfig
+	// RemoteListeners lets other processes, such as browser tabs, register targets they
+	// serve on /api/listeners, see relay.go.  Use SetRemoteListeners on a running server.
+	RemoteListeners bool
+
+	relays map[string]*relayListener
 }
 
 type WhetListener struct {
-	Server    *WhetServer
+	Server *WhetServer
+	// ConnsChan carries the connections to Accept.  It is never closed, so sending on
+	// it can't panic, use deliver to stop once the listener is closed.
 	ConnsChan chan net.Conn
-	isopen    bool
+	// done is closed by Close
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (ws *WhetServer) configureSignalServer() error {
-	// Create a reverse proxy handler
-	proxyHandler := func(target string) http.Handler {
-		return &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				targetURL, _ := url.Parse("http://" + target)
-				req.URL.Scheme = targetURL.Scheme
-				req.URL.Host = targetURL.Host
-
-				// Remove the first subdomain from the path
-				parts := strings.Split(req.URL.Path, "/")
-				if len(parts) > 2 {
-					req.URL.Path = "/" + strings.Join(parts[2:], "/")
-				}
-
-				// Update the Host header
-				req.Host = targetURL.Host
-			},
-		}
-	}
-
 	// Handle proxy targets first
 	for _, proxy := range ws.ProxyTargets {
+		handler, err := ws.proxyHandler(proxy)
+		if err != nil {
+			return err
+		}
 		pattern := fmt.Sprintf("/%s/", proxy.Subdomain)
-		ws.Mux.Handle(pattern, proxyHandler(proxy.Address))
+		ws.Mux.Handle(pattern, handler)
 	}
 
 	// Handle WHET signals
 	ws.Mux.HandleFunc("/whet/", func(w http.ResponseWriter, r *http.Request) {
+		// GET /whet/ lists the targets the caller may open
+		if r.URL.Path == "/whet/" && (r.Method == http.MethodGet || r.Method == http.MethodOptions) {
+			ws.targetsHandler(w, r)
+			return
+		}
 		ws.WhetHandler(w, r)
 	})
 
+	// Signaling over a WebSocket, see signalsocket.go
+	ws.Mux.HandleFunc("/whet/ws", ws.signalSocketHandler)
+
 	// Add catch-all handler last
 	ws.Mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "404 page not found", http.StatusNotFound)
@@ -87,42 +128,31 @@ func (ws *WhetServer) configureSignalServer() error {
 	// Simple API endpoint to return server health or a "ping"
 	ws.Mux.HandleFunc("/api/health", ws.healthHandler)
 
-	// // Set up file servers for each folder in serveFolders
-	// for _, folderSpec := range ws.ServeFolders {
-	// 	parts := strings.Split(folderSpec, "=")
-	// 	if len(parts) != 2 {
-	// 		log.Printf("Invalid folder specification: %s (expected format: subdomain=/path)", folderSpec)
-	// 		continue
-	// 	}
+	// Admin API endpoints to manage the token store
+	ws.Mux.HandleFunc("/api/tokens", ws.tokensHandler)
+	ws.Mux.HandleFunc("/api/tokens/reload", ws.tokensReloadHandler)
+	ws.Mux.HandleFunc("/api/sign", ws.signHandler)
+	ws.Mux.HandleFunc("/api/metrics", ws.metricsHandler)
+	ws.Mux.HandleFunc("/api/sessions", ws.sessionsHandler)
+	ws.Mux.HandleFunc("/api/sessions/", ws.sessionsHandler)
 
-	// 	subdomain := strings.Trim(parts[0], "/")
-	// 	path := parts[1]
+	// Targets served by remote listeners
+	ws.Mux.HandleFunc("/api/listeners", ws.listenersHandler)
+	ws.Mux.HandleFunc("/api/listeners/", ws.listenersHandler)
 
-	// 	fs := http.FileServer(http.Dir(path))
-	// 	pattern := fmt.Sprintf("/%s/", subdomain)
-	// 	ws.Mux.Handle(pattern, http.StripPrefix(pattern, fs))
-	// }
+	// List the targets the caller may open
+	ws.Mux.HandleFunc("/api/targets", ws.targetsHandler)
 
 	// Set up file servers for each folder in serveFolders
 	for _, folderSpec := range ws.ServeFolders {
-		parts := strings.Split(folderSpec, "=")
-		if len(parts) != 2 {
-			log.Printf("Invalid folder specification: %s (expected format: subdomain=/path)", folderSpec)
+		folder, err := ParseServeFolderFromString(folderSpec)
+		if err != nil {
+			log.Printf("Invalid folder specification: %v", err)
 			continue
 		}
-
-		subdomain := strings.Trim(parts[0], "/")
-		path := parts[1]
-
-		fs := http.FileServer(http.Dir(path))
-		wrappedFs := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Add Service-Worker-Allowed header
-			w.Header().Set("Service-Worker-Allowed", "/whet/")
-			fs.ServeHTTP(w, r)
-		})
-
-		pattern := fmt.Sprintf("/%s/", subdomain)
-		ws.Mux.Handle(pattern, http.StripPrefix(pattern, wrappedFs))
+		if err := ws.AddFolder(folder); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -166,6 +196,22 @@ func (ws *WhetServer) Close() error {
 		listener.Close()
 	}
 
+	// stop checking the health of target backends
+	ws.mut.Lock()
+	for _, target := range ws.Targets {
+		target.stopHealthChecks()
+	}
+	relays := make([]*relayListener, 0, len(ws.relays))
+	for _, relay := range ws.relays {
+		relays = append(relays, relay)
+	}
+	ws.mut.Unlock()
+
+	// drop the remote listeners
+	for _, relay := range relays {
+		ws.removeRelay(relay, "server closed")
+	}
+
 	// close the Http server
 	ws.Http.Close()
 
@@ -229,6 +275,14 @@ func NewWhetServer(bearerToken string, targets map[string]*ForwardTargetPort, se
 		Detached:     detached,
 		BearerToken:  bearerToken,
 		Listeners:    make(map[string]*WhetListener),
+		Metrics:      NewMetrics(),
+		limiter:      newRateLimiter(),
+		sessions:     make(map[string]*Connection),
+		reserved:     make(map[string]int),
+		relays:       make(map[string]*relayListener),
+	}
+	for _, target := range targets {
+		target.startHealthChecks()
 	}
 	err := retv.configureSignalServer()
 	return retv, err
@@ -239,60 +293,40 @@ func (ws *WhetServer) WhetHandler(w http.ResponseWriter, r *http.Request) {
 	whetPath := "/whet/"
 	pathSuffix := strings.TrimPrefix(r.URL.Path, whetPath)
 
-	// Set CORS headers for all responses
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-
-	// Allow the Location  header to be exposed
-	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	// Set CORS headers for all responses, rejecting browsers from origins we don't allow
+	if !ws.setCORSHeaders(w, r, "POST, GET, DELETE, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
 
-	var err error
 	if r.Method == "POST" {
-		// Check bearer token if set before checking the target to prevent probing
-		if ws.BearerToken != "" {
-			if r.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", ws.BearerToken) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-		}
+		ws.Metrics.Inc("whet_signal_requests_total", "method", r.Method)
 
-		// Check if the target exists in the targets map
-		// the target may have a hyphen to deliniate the target port in a range
-		portoffset := 0
-
-		// try to split the pathSuffix by a hyphen, if there are more than 2 parts, it's not a valid target
-		// if there are 2 parts, the second part should be a number
-		// if there is only 1 part, it should be a valid target and the portoffset should be 0
-		parts := strings.Split(pathSuffix, "-")
-		if len(parts) == 2 {
-			// try to parse the second part as an integer
-			portoffset, err = strconv.Atoi(parts[1])
-			if err != nil {
-				http.Error(w, "Invalid target", http.StatusBadRequest)
-				return
-			}
-		} else if len(parts) > 2 {
-			http.Error(w, "Invalid target", http.StatusBadRequest)
+		// Limit the offers a single client IP can make before doing any real work
+		clientIP := remoteIP(r).String()
+		if err := ws.limitClient(clientIP); err != nil {
+			ws.rejectOffer(w, err)
 			return
 		}
 
-		// check if the target exists in the map and get the target address
-		target, ok := ws.Targets[parts[0]]
-		if !ok {
-			http.Error(w, "Invalid target", http.StatusBadRequest)
+		// Check bearer token if set before checking the target to prevent probing
+		identity, authErr := ws.authenticate(r)
+		if authErr != nil {
+			ws.authFailed(r, clientIP, pathSuffix, authErr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		// check if the portoffset is within the range
-		if portoffset < 0 || (portoffset != 0 && portoffset >= target.PortCount) {
-			http.Error(w, "Invalid target", http.StatusBadRequest)
+		if err := ws.limitIdentity(identity); err != nil {
+			ws.rejectOffer(w, err)
 			return
 		}
 
-		// create the target address from the target name and the port offset
-		targetAddr := fmt.Sprintf("%s:%d", target.Host, target.StartPort+portoffset)
+		target, targetName, portoffset, oerr := ws.checkOffer(pathSuffix, identity, r.Header.Get("Origin"))
+		if oerr != nil {
+			ws.rejectOffer(w, oerr)
+			return
+		}
 
 		originProto := "http://"
 		if strings.HasPrefix(r.Proto, "HTTPS") {
@@ -302,219 +336,383 @@ func (ws *WhetServer) WhetHandler(w http.ResponseWriter, r *http.Request) {
 		// build a WebRTC peer connection
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
+			ws.releaseSession(targetName)
 			http.Error(w, "Failed to read body", http.StatusBadRequest)
 			return
 		}
 
-		// create the WebRTC peer connection
-		_, peerConnection, err := setupWebRTCConnection(ws.Detached)
+		// a remote listener answers the offer itself, otherwise the target is connected once
+		// the data channel opens
+		var sessionID, responseSDP string
+		if target.ForwardTargetType == ForwardTargetTypeRemote {
+			sessionID, responseSDP, err = ws.relayOffer(r.Context(), target.relay, pathSuffix, string(body), identity)
+			ws.releaseSession(targetName)
+		} else {
+			sessionID, responseSDP, err = ws.answerOffer(string(body), target, targetName, portoffset, identity, r.RemoteAddr, nil)
+		}
 		if err != nil {
-			http.Error(w, "Failed to create peer connection", http.StatusInternalServerError)
+			ws.rejectOffer(w, err)
 			return
 		}
 
-		// our connection object
-		c := &Connection{
-			peerConnection: peerConnection,
-			dataChannel:    nil,
-			conn:           nil,
-			clientReady:    false,
-			sendMoreCh:     make(chan struct{}, 1),
-			detached:       ws.Detached,
-			bearerToken:    ws.BearerToken,
-		}
+		// Before writing the response, set the Location header
+		// This is REQUIRED for the http DELETE handler to be called on teardown
+		// The connectionID MUST be the last part of the path and SHOULD be a UUID
+		location := originProto + r.Host + whetPath + sessionID
+		w.Header().Set("Location", location)
 
-		var wg sync.WaitGroup
-		wg.Add(1)
+		// write out the SDP response to the client in the response body
+		// we set the content type to application/sdp similar to the WHEP spec
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Write([]byte(responseSDP))
+	} else if r.Method == "DELETE" {
+		// the pathSuffix will contain the UUID for the distro to remove
+		ws.closeSignaledSession(pathSuffix)
+	} else if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else {
+		http.Error(w, "Method not allowed you doink!", http.StatusMethodNotAllowed)
+	}
+}
 
-		// wait group that is signaled when the net.conn is attached to the Connection
-		var connWg sync.WaitGroup
-		connWg.Add(1)
+// offerError is an offer rejected with an HTTP status.  reason names the limit of a 429.
+type offerError struct {
+	status  int
+	message string
+	reason  string
+	retry   time.Duration
+}
 
-		// we only support the single port forwading for now, so we'll generate a new random UUID for each request
-		distroUUID := uuid.New()
+func (e *offerError) Error() string {
+	return e.message
+}
 
-		peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
-			fmt.Println("New data channel:", dataChannel.Label())
+// rejectOffer writes the response to an offer that failed with err
+func (ws *WhetServer) rejectOffer(w http.ResponseWriter, err error) {
+	var oerr *offerError
+	switch {
+	case !errors.As(err, &oerr):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case oerr.status == http.StatusTooManyRequests:
+		ws.tooManyRequests(w, oerr.reason, oerr.retry)
+	default:
+		http.Error(w, oerr.message, oerr.status)
+	}
+}
 
-			// handle the data channel opening
-			dataChannel.OnOpen(func() {
-				// detach the channel if we're in detached mode
-				rawDetached, dErr := dataChannel.Detach()
-				if dErr != nil {
-					panic(dErr)
-				}
-				c.rawDetached = rawDetached
-
-				// handle the handshake and tcp proxying in a separate goroutine
-				go func() {
-					// Handshake
-					err := handleHandshake(c, true, &wg)
-					if err != nil {
-						fmt.Printf("Error handling handshake: %v\n", err)
-						if c.conn != nil {
-							c.conn.Close()
-						}
-						c.closed = true
-					}
+// checkOffer checks identity may open targetPath, the target name with an optional
+// port offset, from a browser at origin and reserves a session slot if the target's
+// session limits allow another session.  It returns the target with its name and port
+// offset.  The slot is taken by answerOffer, otherwise it must be released.  Offers to
+// a remote listener release it once relayed, the server can't see the session close.
+func (ws *WhetServer) checkOffer(targetPath string, identity *Identity, origin string) (*ForwardTargetPort, string, int, *offerError) {
+	invalid := &offerError{status: http.StatusBadRequest, message: "Invalid target"}
+
+	// the target may have a hyphen to deliniate the target port in a range
+	name, portoffset, ok := parseTargetPath(targetPath)
+	if !ok {
+		return nil, "", 0, invalid
+	}
 
-					connWg.Wait()
-					if c.conn != nil {
-						// we have a TCP connection, read from the data channel and write to the TCP connection
-						// until the data channel is closed
-						defer c.conn.Close()
-						buffer := make([]byte, maxBufferSize)
-						fmt.Println("Server side data channel opened - receiving data")
-						for {
-							n, err := c.ReceiveRaw(buffer)
-							if n == 0 || err != nil {
-								fmt.Println("Connection closed by client")
-								break
-							}
+	// check the token may open the target before checking the target exists to prevent probing
+	if !identity.CanAccess(name, portoffset) {
+		return nil, "", 0, &offerError{status: http.StatusForbidden, message: "Forbidden"}
+	}
 
-							// write all the data to the TCP connection
-							err = c.SendDataTCP(buffer[:n])
-							if err != nil {
-								fmt.Printf("Error writing to target connection: %v\n", err)
-								break
-							}
-						}
-					}
-				}()
-
-				fmt.Println("Data channel opened")
-				c.dataChannel = dataChannel
-				// create the target type
-				if target.ForwardTargetType == ForwardTargetTypeTCP {
-					// try to open the TCP connection to our target if the target type is TCP
-					conn, err := net.Dial("tcp", targetAddr)
-					if err != nil {
-						if c.rawDetached != nil {
-							c.rawDetached.Write([]byte("SERVER_ERROR"))
-						}
-						fmt.Printf("Error connecting to target: %v\n", err)
+	// check if the target exists in the map and get the target address
+	target, ok := ws.Target(name)
+	if !ok {
+		return nil, "", 0, invalid
+	}
 
-						// clean up the connection
-						peerConnection.Close()
+	// check if the browser origin may open this target
+	if !targetOriginAllowed(target, origin) {
+		return nil, "", 0, &offerError{status: http.StatusForbidden, message: "Origin not allowed"}
+	}
 
-						return
-					} else {
-						// we have a connection, store it in the connection object and signal the wait group
-						// so the tcp proxying can start
-						c.conn = conn
-						connWg.Done()
+	// check if the portoffset is within the range
+	if portoffset < 0 || (portoffset != 0 && portoffset >= target.PortCount) {
+		return nil, "", 0, invalid
+	}
 
-						go func() {
-							createServerSideConnection(peerConnection, dataChannel, &wg, c)
-						}()
-					}
-				} else if target.ForwardTargetType == ForwardTargetTypeListener {
-					// wait for the handshake that is managed in the above proxy goroutine
-					wg.Wait()
-
-					// we need to create a WebRTCConn
-					listernconn, _ := ListenerWebRTCConn(c)
-					wl := ws.Listeners[parts[0]]
-					if wl != nil {
-						wl.ConnsChan <- listernconn
-					} else {
-						http.Error(w, "Listener not found", http.StatusBadRequest)
-						fmt.Println("Listener not found")
-					}
-				}
-			})
-
-			// Set bufferedAmountLowThreshold so that we can get notified when
-			// we can send more
-			dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
-
-			// This callback is made when the current bufferedAmount becomes lower than the threshold
-			dataChannel.OnBufferedAmountLow(func() {
-				fmt.Println("Buffered amount low, sending more")
-				// Make sure to not block this channel or perform long running operations in this callback
-				// This callback is executed by pion/sctp. If this callback is blocking it will stop operations
-				select {
-				case c.sendMoreCh <- struct{}{}:
-				default:
-				}
-			})
-		})
+	// cap the sessions that are waiting to connect and the sessions of each target
+	if limit, retry := ws.reserveSession(name); limit != "" {
+		return nil, "", 0, tooManyOffers(limit, retry)
+	}
+	return target, name, portoffset, nil
+}
 
-		// set the remote description
-		err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
-		if err != nil {
-			http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
-			return
+// closeSignaledSession closes the session with the id a signaling client was given
+func (ws *WhetServer) closeSignaledSession(sessionID string) {
+	id, err := uuid.Parse(sessionID)
+	if err != nil {
+		return
+	}
+	connectionsLock.Lock()
+	c, ok := OpenConnections[id.String()]
+	if ok {
+		delete(OpenConnections, id.String())
+	}
+	connectionsLock.Unlock()
+	fmt.Println("Deleting peer with ID:", id)
+
+	// stop the peer connection
+	if c != nil && c.conn != nil {
+		// closing the net.Conn will also close the data channel and the peer connection
+		if !c.closed {
+			c.conn.Close()
+			c.closed = true
+		} else {
+			fmt.Println("Connection already closed")
 		}
+	}
+}
 
-		// create the answer
-		answer, err := peerConnection.CreateAnswer(nil)
-		if err != nil {
-			http.Error(w, "Failed to create answer", http.StatusInternalServerError)
-			return
-		}
+// answerOffer answers a client's offer for the target at portoffset and returns the
+// session id and the answer.  The target is connected once the data channel opens.
+// The offer comes from the signaling endpoint or, on an agent, from a rendezvous server.
+// With trickle set the answer is returned before gathering completes and trickle is
+// called with each local candidate, then with nil once gathering is done.  The session
+// takes the slot reserved for it by checkOffer or reserveSession.
+func (ws *WhetServer) answerOffer(offer string, target *ForwardTargetPort, targetName string, portoffset int, identity *Identity, remoteAddr string, trickle func(*webrtc.ICECandidate)) (string, string, error) {
+	// create the WebRTC peer connection
+	_, peerConnection, err := setupWebRTCConnection(ws.Detached, nil)
+	if err != nil {
+		ws.releaseSession(targetName)
+		return "", "", errors.New("Failed to create peer connection")
+	}
 
-		// get the channel that is closed when gathering is complete
-		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	// we only support the single port forwading for now, so we'll generate a new random UUID for each request
+	distroUUID := uuid.New()
+
+	// our connection object
+	c := &Connection{
+		peerConnection: peerConnection,
+		dataChannel:    nil,
+		conn:           nil,
+		clientReady:    false,
+		sendMoreCh:     make(chan struct{}, 1),
+		detached:       ws.Detached,
+		bearerToken:    ws.BearerToken,
+		identity:       identity,
+		id:             distroUUID.String(),
+		targetName:     targetName,
+		targetAddr:     target.Address(portoffset),
+		remoteAddr:     remoteAddr,
+		created:        time.Now(),
+	}
 
-		// set the local description
-		err = peerConnection.SetLocalDescription(answer)
-		if err != nil {
-			http.Error(w, "Failed to set local description", http.StatusInternalServerError)
-			return
+	// track the session until the peer connection closes or fails
+	ws.addSession(c)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			ws.sessionConnected(c)
+		case webrtc.PeerConnectionStateFailed:
+			peerConnection.Close()
+			ws.endSession(c, "peer connection failed")
+		case webrtc.PeerConnectionStateClosed:
+			// a half-closed target connection is no longer closed by the data channel reader
+			if conn := c.Conn(); conn != nil {
+				conn.Close()
+			}
+			ws.endSession(c, "peer connection closed")
 		}
+	})
 
-		// wait for the gathering to complete
-		<-gatherComplete
+	// close peer connections that never connect so they don't hold resources
+	if ws.RateLimits != nil && ws.RateLimits.PendingTimeout > 0 {
+		time.AfterFunc(ws.RateLimits.PendingTimeout, func() {
+			if ws.sessionPending(c) {
+				peerConnection.Close()
+				ws.endSession(c, "timed out waiting to connect")
+			}
+		})
+	}
 
-		// get the SDP response
-		responseSDP := peerConnection.LocalDescription().SDP
+	var wg sync.WaitGroup
+	wg.Add(1)
 
-		// store the connection in the map
-		connectionsLock.Lock()
-		OpenConnections[distroUUID.String()] = c
-		connectionsLock.Unlock()
+	// wait group that is signaled when the net.conn is attached to the Connection
+	var connWg sync.WaitGroup
+	connWg.Add(1)
 
-		// Before writing the response, set the Location header
-		// This is REQUIRED for the http DELETE handler to be called on teardown
-		// The connectionID MUST be the last part of the path and SHOULD be a UUID
-		location := originProto + r.Host + whetPath + distroUUID.String()
-		w.Header().Set("Location", location)
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		fmt.Println("New data channel:", dataChannel.Label())
 
-		// write out the SDP response to the client in the response body
-		// we set the content type to application/sdp similar to the WHEP spec
-		w.Header().Set("Content-Type", "application/sdp")
-		w.Write([]byte(responseSDP))
-	} else if r.Method == "DELETE" {
-		// the pathSuffix will contain the UUID for the distro to remove
-		id, err := uuid.Parse(pathSuffix)
-		if err == nil {
-			var c *Connection = nil
-			connectionsLock.Lock()
-			c, ok := OpenConnections[id.String()]
-			if ok {
-				delete(OpenConnections, id.String())
+		// handle the data channel opening
+		dataChannel.OnOpen(func() {
+			// detach the channel if we're in detached mode
+			rawDetached, dErr := dataChannel.Detach()
+			if dErr != nil {
+				panic(dErr)
 			}
-			connectionsLock.Unlock()
-			fmt.Println("Deleting peer with ID:", id)
+			c.rawDetached = rawDetached
+
+			// handle the handshake and tcp proxying in a separate goroutine
+			go func() {
+				// Handshake
+				err := handleHandshake(c, true, &wg)
+				if err != nil {
+					fmt.Printf("Error handling handshake: %v\n", err)
+					if c.conn != nil {
+						c.conn.Close()
+					}
+					c.closed = true
+				}
 
-			// stop the peer connection
-			if c != nil && c.conn != nil {
-				// closing the net.Conn will also close the data channel and the peer connection
-				if !c.closed {
+				connWg.Wait()
+				if c.conn != nil {
+					// we have a TCP connection, read from the data channel and write to the TCP connection
+					// until the data channel is closed
+					buffer := make([]byte, maxBufferSize)
+					fmt.Println("Server side data channel opened - receiving data")
+					for {
+						n, err := c.ReceiveRaw(buffer)
+						if n == 0 && err == nil {
+							// an empty message is the client signalling the end of its stream.  Half-close
+							// the target so it sees EOF but can still reply, the target's side of the
+							// connection closes it when it is done.
+							if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+								fmt.Println("Client finished sending")
+								cw.CloseWrite()
+								return
+							}
+						}
+						if n == 0 || err != nil {
+							fmt.Println("Connection closed by client")
+							break
+						}
+
+						// write all the data to the TCP connection
+						err = c.SendDataTCP(buffer[:n])
+						if err != nil {
+							fmt.Printf("Error writing to target connection: %v\n", err)
+							break
+						}
+					}
 					c.conn.Close()
-					c.closed = true
+				}
+			}()
+
+			fmt.Println("Data channel opened")
+			c.dataChannel = dataChannel
+			// create the target type
+			if target.ForwardTargetType == ForwardTargetTypeTCP || target.ForwardTargetType == ForwardTargetTypeUnix {
+				// try to open the TCP or unix socket connection to one of our target's backends
+				conn, backend, err := target.dial(portoffset)
+				if err != nil {
+					if c.rawDetached != nil {
+						c.rawDetached.Write([]byte("SERVER_ERROR"))
+					}
+					fmt.Printf("Error connecting to target: %v\n", err)
+
+					// clean up the connection
+					peerConnection.Close()
+
+					return
 				} else {
-					fmt.Println("Connection already closed")
+					// we have a connection, store it in the connection object and signal the wait group
+					// so the tcp proxying can start
+					ws.sessionBackend(c, backend)
+					c.conn = conn
+					connWg.Done()
+
+					go func() {
+						createServerSideConnection(peerConnection, dataChannel, &wg, c)
+					}()
+				}
+			} else if target.ForwardTargetType == ForwardTargetTypeListener {
+				// wait for the handshake that is managed in the above proxy goroutine
+				wg.Wait()
+
+				// we need to create a WebRTCConn
+				listernconn, _ := ListenerWebRTCConn(c)
+				ws.mut.Lock()
+				wl := ws.Listeners[targetName]
+				ws.mut.Unlock()
+				if wl == nil {
+					fmt.Println("Listener not found")
+				} else if err := wl.deliver(context.Background(), listernconn); err != nil {
+					listernconn.Close()
 				}
 			}
-		}
-	} else if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	} else {
-		http.Error(w, "Method not allowed you doink!", http.StatusMethodNotAllowed)
+		})
+
+		// Set bufferedAmountLowThreshold so that we can get notified when
+		// we can send more
+		dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+
+		// This callback is made when the current bufferedAmount becomes lower than the threshold
+		dataChannel.OnBufferedAmountLow(func() {
+			fmt.Println("Buffered amount low, sending more")
+			// Make sure to not block this channel or perform long running operations in this callback
+			// This callback is executed by pion/sctp. If this callback is blocking it will stop operations
+			select {
+			case c.sendMoreCh <- struct{}{}:
+			default:
+			}
+		})
+	})
+
+	// set the remote description
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		peerConnection.Close()
+		ws.endSession(c, "failed to set remote description")
+		return "", "", errors.New("Failed to set remote description")
+	}
+
+	// create the answer
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		ws.endSession(c, "failed to create answer")
+		return "", "", errors.New("Failed to create answer")
+	}
+
+	// get the channel that is closed when gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if trickle != nil {
+		peerConnection.OnICECandidate(trickle)
 	}
+
+	// set the local description
+	err = peerConnection.SetLocalDescription(answer)
+	if err != nil {
+		peerConnection.Close()
+		ws.endSession(c, "failed to set local description")
+		return "", "", errors.New("Failed to set local description")
+	}
+
+	// wait for the gathering to complete unless the candidates are trickled
+	if trickle == nil {
+		<-gatherComplete
+	}
+
+	// get the SDP response
+	responseSDP := peerConnection.LocalDescription().SDP
+
+	// a single use signed URL is used up by the session it opened
+	if err := identity.claim(); err != nil {
+		peerConnection.Close()
+		ws.endSession(c, err.Error())
+		return "", "", &offerError{status: http.StatusUnauthorized, message: "Unauthorized"}
+	}
+
+	// store the connection in the map
+	connectionsLock.Lock()
+	OpenConnections[distroUUID.String()] = c
+	connectionsLock.Unlock()
+	ws.Metrics.Inc("whet_sessions_opened_total", "target", targetName, "identity", identity.Name)
+	ws.mut.Lock()
+	event := auditSession(AuditSessionOpen, c)
+	ws.mut.Unlock()
+	ws.audit(event)
+	fmt.Printf("Session %s opened by %s for target %s\n", distroUUID.String(), identity.Name, targetPath(targetName, portoffset))
+
+	return distroUUID.String(), responseSDP, nil
 }
 
 func createServerSideConnection(peer *webrtc.PeerConnection, dataChannel *webrtc.DataChannel, wg *sync.WaitGroup, c *Connection) {
@@ -586,7 +784,7 @@ func (ws *WhetServer) AddListener(targetid string) (*WhetListener, error) {
 	retv := &WhetListener{
 		Server:    ws,
 		ConnsChan: make(chan net.Conn),
-		isopen:    true,
+		done:      make(chan struct{}),
 	}
 
 	forwarder := &ForwardTargetPort{
@@ -606,22 +804,104 @@ func (ws *WhetServer) AddListener(targetid string) (*WhetListener, error) {
 	return retv, nil
 }
 
+// targetPath returns the name used to open the port at offset of a target, e.g. range-2
+func targetPath(name string, offset int) string {
+	if offset == 0 {
+		return name
+	}
+	return name + "-" + strconv.Itoa(offset)
+}
+
+// parseTargetPath splits a target path such as ssh or range-2 into the target name
+// and port offset
+func parseTargetPath(targetPath string) (string, int, bool) {
+	parts := strings.Split(targetPath, "-")
+	if len(parts) > 2 {
+		return "", 0, false
+	}
+	if len(parts) == 1 {
+		return parts[0], 0, true
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], offset, true
+}
+
+// Target returns the forward target with the given name
+func (ws *WhetServer) Target(name string) (*ForwardTargetPort, bool) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	target, ok := ws.Targets[name]
+	return target, ok
+}
+
+// SetCORS replaces the CORS configuration of a running server
+func (ws *WhetServer) SetCORS(cors *CORSConfig) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	ws.CORS = cors
+}
+
+// SetRemoteListeners allows or stops new remote listener registrations on a running
+// server.  Registered remote listeners are kept.
+func (ws *WhetServer) SetRemoteListeners(enabled bool) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	ws.RemoteListeners = enabled
+}
+
+// SetTargets replaces the forward targets of a running server.  Listener targets added
+// with AddListener and targets of remote listeners are kept.  Sessions that are already
+// open are not affected.
+func (ws *WhetServer) SetTargets(targets map[string]*ForwardTargetPort) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+
+	updated := make(map[string]*ForwardTargetPort)
+	for name, target := range targets {
+		target.startHealthChecks()
+		updated[name] = target
+	}
+	for name, target := range ws.Targets {
+		if target.ForwardTargetType == ForwardTargetTypeListener || target.ForwardTargetType == ForwardTargetTypeRemote {
+			updated[name] = target
+		} else if updated[name] != target {
+			target.stopHealthChecks()
+		}
+	}
+	ws.Targets = updated
+}
+
 // Accept waits for and returns the next connection to the listener.
 func (wl *WhetListener) Accept() (net.Conn, error) {
-	retv := <-wl.ConnsChan
-	if retv == nil {
+	select {
+	case retv := <-wl.ConnsChan:
+		return retv, nil
+	case <-wl.done:
 		return nil, fmt.Errorf("listener closed")
 	}
-	return retv, nil
+}
+
+// deliver hands conn to Accept, failing if the listener is closed or ctx is done first
+func (wl *WhetListener) deliver(ctx context.Context, conn net.Conn) error {
+	select {
+	case wl.ConnsChan <- conn:
+		return nil
+	case <-wl.done:
+		return fmt.Errorf("listener closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Close closes the listener.
 func (wl *WhetListener) Close() error {
-	// close the channel so accept will return an error and the listener will be closed
-	if wl.isopen {
-		close(wl.ConnsChan)
-		wl.isopen = false
-	}
+	// accept returns an error once the listener is closed
+	wl.closeOnce.Do(func() {
+		close(wl.done)
+	})
 	return nil
 }
 
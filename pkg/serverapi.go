@@ -2,17 +2,22 @@ package pkg
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
-	// ... the rest of your imports
 )
 
 func (ws *WhetServer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers, rejecting browsers from origins we don't allow
+	if !ws.setCORSHeaders(w, r, "GET, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
 	// Handle CORS preflight
 	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -24,7 +29,6 @@ func (ws *WhetServer) healthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set headers for the actual GET response
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	// Build a JSON response
@@ -38,3 +42,257 @@ func (ws *WhetServer) healthHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
 	}
 }
+
+// TokenInfo is the public description of a token returned by the admin API
+type TokenInfo struct {
+	Name        string     `json:"name"`
+	Targets     []string   `json:"targets,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	SourceCIDRs []string   `json:"source_cidrs,omitempty"`
+	Admin       bool       `json:"admin,omitempty"`
+}
+
+// tokensHandler lists the tokens in the server's token store without their secrets
+func (ws *WhetServer) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "GET, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ws.requireAdmin(w, r) == nil {
+		return
+	}
+
+	resp := make([]TokenInfo, 0)
+	if ws.Tokens != nil {
+		for _, t := range ws.Tokens.Tokens() {
+			resp = append(resp, TokenInfo{
+				Name:        t.Name,
+				Targets:     t.Targets,
+				Expires:     t.Expires,
+				SourceCIDRs: t.SourceCIDRs,
+				Admin:       t.Admin,
+			})
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+// tokensReloadHandler reloads the server's token store from its file
+func (ws *WhetServer) tokensReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "POST, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := ws.requireAdmin(w, r)
+	if identity == nil {
+		return
+	}
+
+	if ws.Tokens == nil {
+		http.Error(w, "No token store configured", http.StatusNotFound)
+		return
+	}
+	if err := ws.Tokens.Reload(); err != nil {
+		ws.auditAdmin(r, identity, "tokens_reload", err.Error())
+		http.Error(w, fmt.Sprintf("Failed to reload tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	ws.auditAdmin(r, identity, "tokens_reload", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// signRequest is the body of a request to mint a signed connect URL
+type signRequest struct {
+	Target    string `json:"target"`
+	TTL       string `json:"ttl"`
+	SingleUse bool   `json:"single_use"`
+}
+
+// signHandler mints a signed connect URL for a single target
+func (ws *WhetServer) signHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "POST, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := ws.requireAdmin(w, r)
+	if identity == nil {
+		return
+	}
+
+	if ws.URLSigner == nil {
+		http.Error(w, "URL signing is not configured", http.StatusNotFound)
+		return
+	}
+
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Hour
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	signed, err := ws.URLSigner.SignURL(requestBaseURL(r), req.Target, ttl, req.SingleUse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws.auditAdmin(r, identity, "sign_url", fmt.Sprintf("target=%s ttl=%s single_use=%t", req.Target, ttl, req.SingleUse))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": signed})
+}
+
+// metricsHandler writes the server metrics in the Prometheus text format
+func (ws *WhetServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ws.requireAdmin(w, r) == nil {
+		return
+	}
+
+	open, pending, _ := ws.sessionCounts("")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ws.Metrics.WriteText(w, map[string]int64{
+		"whet_sessions_active":  int64(open),
+		"whet_sessions_pending": int64(pending),
+	})
+}
+
+// TargetInfo describes a forward target in the target listing
+type TargetInfo struct {
+	Name string `json:"name"`
+	// Type is the kind of target, "tcp", "unix", "listener" or "remote"
+	Type string `json:"type"`
+	// Ports is the number of ports of a range target, 1 for a single port
+	Ports       int    `json:"ports"`
+	Description string `json:"description,omitempty"`
+}
+
+// targetsHandler lists the targets the caller may open.  It is served on
+// /api/targets and GET /whet/.
+func (ws *WhetServer) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "GET, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := ws.requireIdentity(w, r)
+	if identity == nil {
+		return
+	}
+
+	resp := make([]TargetInfo, 0)
+	ws.mut.Lock()
+	for name, target := range ws.Targets {
+		ports := target.PortCount
+		if ports < 1 {
+			ports = 1
+		}
+		for offset := 0; offset < ports; offset++ {
+			if identity.CanAccess(name, offset) {
+				resp = append(resp, TargetInfo{
+					Name:        name,
+					Type:        target.ForwardTargetType.String(),
+					Ports:       ports,
+					Description: target.Description,
+				})
+				break
+			}
+		}
+	}
+	ws.mut.Unlock()
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+// sessionsHandler lists the open and pending sessions, and kills a session on
+// DELETE /api/sessions/<id>
+func (ws *WhetServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.setCORSHeaders(w, r, "GET, DELETE, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+	if r.Method == http.MethodGet && id == "" {
+		if ws.requireAdmin(w, r) == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ws.SessionInfos()); err != nil {
+			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+		}
+		return
+	}
+	if r.Method != http.MethodDelete || id == "" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity := ws.requireAdmin(w, r)
+	if identity == nil {
+		return
+	}
+	if !ws.KillSession(id) {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	ws.auditAdmin(r, identity, "session_kill", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,5 +1,203 @@
 package pkg
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDialTimeout limits connecting to a target backend when the target has no timeout
+const defaultDialTimeout = 10 * time.Second
+
 func (ws *WhetServer) CreateTCPForwarder() error {
 	return nil
-}
\ No newline at end of file
+}
+
+// targetHealth holds the results of the health checks of a pool target
+type targetHealth struct {
+	mut      *sync.Mutex
+	down     map[string]bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// backends returns the backends of the target, a single backend unless it is a pool
+func (t *ForwardTargetPort) backends() []TargetBackend {
+	if len(t.Backends) == 0 {
+		return []TargetBackend{{Host: t.Host, StartPort: t.StartPort}}
+	}
+	return t.Backends
+}
+
+// Address describes where the target connects to, e.g. 'localhost:22',
+// '10.0.0.5:5432,10.0.0.6:5432' or 'srv:_postgres._tcp.example.com'
+func (t *ForwardTargetPort) Address(offset int) string {
+	switch {
+	case t.ForwardTargetType == ForwardTargetTypeListener:
+		return "listener:" + t.TargetName
+	case t.ForwardTargetType == ForwardTargetTypeRemote:
+		return "remote:" + t.TargetName
+	case t.ForwardTargetType == ForwardTargetTypeUnix:
+		return t.Path
+	case t.SRV != "":
+		return srvPrefix + t.SRV
+	}
+	addrs := make([]string, 0, len(t.backends()))
+	for _, b := range t.backends() {
+		addrs = append(addrs, net.JoinHostPort(b.Host, strconv.Itoa(b.StartPort+offset)))
+	}
+	return strings.Join(addrs, ",")
+}
+
+// candidates returns the addresses to try for the port at offset, in the order they
+// should be tried
+func (t *ForwardTargetPort) candidates(offset int) ([]string, error) {
+	if t.SRV != "" {
+		// LookupSRV sorts the records by priority and randomizes them by weight
+		_, records, err := net.LookupSRV("", "", t.SRV)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(records))
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)+offset)))
+		}
+		return addrs, nil
+	}
+
+	backends := t.backends()
+	start := 0
+	if t.Policy == PolicyRoundRobin {
+		start = int((atomic.AddUint32(&t.next, 1) - 1) % uint32(len(backends)))
+	}
+
+	// try the healthy backends first, the others only if none of them connect
+	var healthy, unhealthy []string
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		addr := net.JoinHostPort(b.Host, strconv.Itoa(b.StartPort+offset))
+		if t.isDown(b) {
+			unhealthy = append(unhealthy, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	return append(healthy, unhealthy...), nil
+}
+
+// dial connects to the port at offset of the target, returning the connection and the
+// address of the backend it connected to
+func (t *ForwardTargetPort) dial(offset int) (net.Conn, string, error) {
+	timeout := t.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	if t.ForwardTargetType == ForwardTargetTypeUnix {
+		conn, err := net.DialTimeout("unix", t.Path, timeout)
+		if err == nil && t.TLS != nil {
+			// a unix socket has no host name to verify, so sni or insecure is needed
+			conn, err = t.TLS.client(conn, "", timeout)
+		}
+		return conn, t.Path, err
+	}
+
+	addrs, err := t.candidates(offset)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no backends")
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err == nil && t.TLS != nil {
+			conn, err = t.TLS.client(conn, addr, timeout)
+		}
+		if err == nil {
+			return conn, addr, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// isDown reports if the backend failed its last health check
+func (t *ForwardTargetPort) isDown(b TargetBackend) bool {
+	h := t.health
+	if h == nil {
+		return false
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.down[net.JoinHostPort(b.Host, strconv.Itoa(b.StartPort))]
+}
+
+// startHealthChecks periodically checks that the backends of a pool target accept
+// connections on their first port
+func (t *ForwardTargetPort) startHealthChecks() {
+	if t.HealthInterval <= 0 || t.health != nil || t.ForwardTargetType != ForwardTargetTypeTCP || t.SRV != "" {
+		return
+	}
+	h := &targetHealth{
+		mut:  &sync.Mutex{},
+		down: make(map[string]bool),
+		stop: make(chan struct{}),
+	}
+	t.health = h
+
+	timeout := t.DialTimeout
+	if timeout <= 0 || timeout > t.HealthInterval {
+		timeout = t.HealthInterval
+	}
+
+	check := func() {
+		for _, b := range t.backends() {
+			addr := net.JoinHostPort(b.Host, strconv.Itoa(b.StartPort))
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if conn != nil {
+				conn.Close()
+			}
+
+			h.mut.Lock()
+			wasDown := h.down[addr]
+			h.down[addr] = err != nil
+			h.mut.Unlock()
+
+			if err != nil && !wasDown {
+				fmt.Printf("Backend %s of target %s is down: %v\n", addr, t.TargetName, err)
+			} else if err == nil && wasDown {
+				fmt.Printf("Backend %s of target %s is up\n", addr, t.TargetName)
+			}
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(t.HealthInterval)
+		defer ticker.Stop()
+		check()
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopHealthChecks stops the health checks started by startHealthChecks.  The target
+// keeps the last results.
+func (t *ForwardTargetPort) stopHealthChecks() {
+	if h := t.health; h != nil {
+		h.stopOnce.Do(func() { close(h.stop) })
+	}
+}
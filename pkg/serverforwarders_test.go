@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTargetPool(t *testing.T) {
+	target, err := ParseForwardTargetPortFromString("db=10.0.0.5:5432,10.0.0.6:5432?policy=roundrobin&timeout=3s&health=10s")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(target.Backends) != 2 || target.Backends[1].Host != "10.0.0.6" || target.Host != "10.0.0.5" || target.StartPort != 5432 {
+		t.Errorf("got backends %+v", target.Backends)
+	}
+	if target.Policy != PolicyRoundRobin || target.DialTimeout != 3*time.Second || target.HealthInterval != 10*time.Second {
+		t.Errorf("got options %+v", target)
+	}
+	if target.Address(0) != "10.0.0.5:5432,10.0.0.6:5432" {
+		t.Errorf("got address %s", target.Address(0))
+	}
+
+	target, err = ParseForwardTargetPortFromString("db=srv:_postgres._tcp.example.com")
+	if err != nil || target.SRV != "_postgres._tcp.example.com" {
+		t.Errorf("expected an SRV target, got %+v %v", target, err)
+	}
+
+	for _, id := range []string{
+		"db=10.0.0.5:5432,10.0.0.6:5432-5433",
+		"db=10.0.0.5:5432?policy=random",
+		"db=10.0.0.5:5432?timeout=soon",
+		"db=10.0.0.5:5432?retries=3",
+	} {
+		if _, err := ParseForwardTargetPortFromString(id); err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+}
+
+func TestTargetPoolDial(t *testing.T) {
+	// one backend that accepts connections and one that refuses them
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		for {
+			conn, err := up.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downAddr := down.Addr().String()
+	down.Close()
+
+	_, upPort, _ := net.SplitHostPort(up.Addr().String())
+	_, downPort, _ := net.SplitHostPort(downAddr)
+	target, err := ParseForwardTargetPortFromString("db=127.0.0.1:" + downPort + ",127.0.0.1:" + upPort + "?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first backend is down so the second one is used
+	conn, backend, err := target.dial(0)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	if backend != up.Addr().String() {
+		t.Errorf("expected backend %s, got %s", up.Addr(), backend)
+	}
+
+	// round robin starts at a different backend each time
+	target.Policy = PolicyRoundRobin
+	first, _ := target.candidates(0)
+	second, _ := target.candidates(0)
+	if first[0] == second[0] {
+		t.Errorf("expected round robin to rotate, got %v then %v", first, second)
+	}
+
+	// once a health check marks the first backend down it is tried last
+	target.Policy = PolicyFirst
+	target.HealthInterval = time.Hour
+	target.startHealthChecks()
+	defer target.stopHealthChecks()
+	downPortNum, _ := strconv.Atoi(downPort)
+	deadline := time.Now().Add(5 * time.Second)
+	for !target.isDown(TargetBackend{Host: "127.0.0.1", StartPort: downPortNum}) {
+		if time.Now().After(deadline) {
+			t.Fatal("health check did not mark the backend down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addrs, _ := target.candidates(0)
+	if addrs[0] != up.Addr().String() {
+		t.Errorf("expected the healthy backend first, got %v", addrs)
+	}
+}
+
+func TestTargetTLSDial(t *testing.T) {
+	cert, err := SelfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// the self-signed certificate is rejected unless verification is skipped
+	target, err := ParseForwardTargetPortFromString("api=" + backend.Addr().String() + "?tls&timeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := target.dial(0); err == nil {
+		t.Errorf("expected an untrusted certificate to fail")
+	}
+
+	target, err = ParseForwardTargetPortFromString("api=" + backend.Addr().String() + "?insecure&timeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := target.dial(0)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected echo, got %q %v", buf, err)
+	}
+}
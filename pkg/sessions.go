@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// addSession registers a new server side session in place of the slot reserved for it
+// by reserveSession.  The session is pending until its peer connection connects.
+func (ws *WhetServer) addSession(c *Connection) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	ws.sessions[c.id] = c
+	ws.unreserve(c.targetName)
+}
+
+// sessionConnected marks a session as no longer pending and records the ICE candidate
+// pair its peer connection selected
+func (ws *WhetServer) sessionConnected(c *Connection) {
+	local, remote := "", ""
+	if sctp := c.peerConnection.SCTP(); sctp != nil {
+		if pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			local = pair.Local.String()
+			remote = pair.Remote.String()
+		}
+	}
+
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	c.connected = true
+	c.localCandidate = local
+	c.remoteCandidate = remote
+}
+
+// sessionBackend records the backend a session's target connection was made to
+func (ws *WhetServer) sessionBackend(c *Connection, backend string) {
+	ws.mut.Lock()
+	c.backend = backend
+	ws.mut.Unlock()
+	fmt.Printf("Session %s for target %s connected to %s\n", c.id, c.targetName, backend)
+}
+
+// reserveSession checks the session caps and reserves a pending slot for a new session
+// to a target in the same step, so concurrent offers can't exceed the caps.  It returns
+// the cap the session would exceed and how long to wait before retrying, or "" when the
+// slot was reserved.  The slot is taken over by addSession or given back with
+// releaseSession.
+func (ws *WhetServer) reserveSession(targetName string) (string, time.Duration) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	if ws.RateLimits != nil {
+		_, pending, targetSessions := ws.countSessions(targetName)
+		for name, n := range ws.reserved {
+			pending += n
+			if name == targetName {
+				targetSessions += n
+			}
+		}
+		if ws.RateLimits.MaxPending > 0 && pending >= ws.RateLimits.MaxPending {
+			return "pending", time.Second
+		}
+		if ws.RateLimits.MaxSessionsPerTarget > 0 && targetSessions >= ws.RateLimits.MaxSessionsPerTarget {
+			return "target", 5 * time.Second
+		}
+	}
+	ws.reserved[targetName]++
+	return "", 0
+}
+
+// releaseSession gives back a slot reserved by reserveSession that no session was added for
+func (ws *WhetServer) releaseSession(targetName string) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	ws.unreserve(targetName)
+}
+
+// unreserve removes a reserved slot of a target, ws.mut must be held
+func (ws *WhetServer) unreserve(targetName string) {
+	if ws.reserved[targetName] > 1 {
+		ws.reserved[targetName]--
+	} else {
+		delete(ws.reserved, targetName)
+	}
+}
+
+// sessionPending reports if a session has neither connected nor ended
+func (ws *WhetServer) sessionPending(c *Connection) bool {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	return !c.connected && !c.ended
+}
+
+// endSession removes a session from the server.  It is safe to call more than once,
+// only the first call has any effect.
+func (ws *WhetServer) endSession(c *Connection, reason string) {
+	ws.mut.Lock()
+	if c.ended {
+		ws.mut.Unlock()
+		return
+	}
+	c.ended = true
+	c.closeReason = reason
+	delete(ws.sessions, c.id)
+	// the audit event is built under the lock, it's sent after so a slow sink can't stall the server
+	event := auditSession(AuditSessionClose, c)
+	ws.mut.Unlock()
+
+	connectionsLock.Lock()
+	if OpenConnections[c.id] == c {
+		delete(OpenConnections, c.id)
+	}
+	connectionsLock.Unlock()
+
+	ws.Metrics.Inc("whet_sessions_closed_total", "target", c.targetName)
+	ws.audit(event)
+	fmt.Printf("Session %s for target %s closed after %s: %s\n", c.id, c.targetName, time.Since(c.created).Round(time.Millisecond), reason)
+}
+
+// sessionCounts returns the number of open and pending sessions, and the number of
+// sessions of the given target
+func (ws *WhetServer) sessionCounts(targetName string) (open int, pending int, target int) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	return ws.countSessions(targetName)
+}
+
+// countSessions is sessionCounts with ws.mut held
+func (ws *WhetServer) countSessions(targetName string) (open int, pending int, target int) {
+	for _, c := range ws.sessions {
+		if c.connected {
+			open++
+		} else {
+			pending++
+		}
+		if c.targetName == targetName {
+			target++
+		}
+	}
+	return open, pending, target
+}
+
+// Sessions returns the open and pending sessions of the server, oldest first
+func (ws *WhetServer) Sessions() []*Connection {
+	ws.mut.Lock()
+	retv := make([]*Connection, 0, len(ws.sessions))
+	for _, c := range ws.sessions {
+		retv = append(retv, c)
+	}
+	ws.mut.Unlock()
+
+	sort.Slice(retv, func(i, j int) bool { return retv[i].created.Before(retv[j].created) })
+	return retv
+}
+
+// KillSession closes the session with the given id, returning false if there is no such session
+func (ws *WhetServer) KillSession(id string) bool {
+	ws.mut.Lock()
+	c, ok := ws.sessions[id]
+	ws.mut.Unlock()
+	if !ok {
+		return false
+	}
+
+	ws.endSession(c, "killed")
+	if c.conn != nil && !c.closed {
+		c.conn.Close()
+		c.closed = true
+	}
+	if c.peerConnection != nil {
+		c.peerConnection.Close()
+	}
+	return true
+}
+
+// SessionInfo describes a server side session in the admin API
+type SessionInfo struct {
+	ID              string    `json:"id"`
+	Identity        string    `json:"identity,omitempty"`
+	Target          string    `json:"target"`
+	TargetAddr      string    `json:"target_addr"`
+	Backend         string    `json:"backend,omitempty"`
+	RemoteAddr      string    `json:"remote_addr,omitempty"`
+	Created         time.Time `json:"created"`
+	Connected       bool      `json:"connected"`
+	LocalCandidate  string    `json:"local_candidate,omitempty"`
+	RemoteCandidate string    `json:"remote_candidate,omitempty"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+}
+
+// SessionInfos describes the open and pending sessions of the server, oldest first
+func (ws *WhetServer) SessionInfos() []SessionInfo {
+	sessions := ws.Sessions()
+
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	retv := make([]SessionInfo, 0, len(sessions))
+	for _, c := range sessions {
+		info := SessionInfo{
+			ID:              c.id,
+			Target:          c.targetName,
+			TargetAddr:      c.targetAddr,
+			Backend:         c.backend,
+			RemoteAddr:      c.remoteAddr,
+			Created:         c.created,
+			Connected:       c.connected,
+			LocalCandidate:  c.localCandidate,
+			RemoteCandidate: c.remoteCandidate,
+			BytesIn:         c.BytesIn(),
+			BytesOut:        c.BytesOut(),
+		}
+		if c.identity != nil {
+			info.Identity = c.identity.Name
+		}
+		retv = append(retv, info)
+	}
+	return retv
+}
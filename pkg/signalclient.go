@@ -0,0 +1,380 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// socketConn is a client WebSocket carrying text messages
+type socketConn interface {
+	Send(data []byte) error
+	Receive() ([]byte, error)
+	Close() error
+}
+
+// IsSocketURL reports if signalServer selects signaling over a WebSocket, such as
+// wss://example.com
+func IsSocketURL(signalServer string) bool {
+	return strings.HasPrefix(signalServer, "ws://") || strings.HasPrefix(signalServer, "wss://")
+}
+
+// socketURL returns the URL of the signaling WebSocket of signalServer
+func socketURL(signalServer string) string {
+	u := strings.TrimSuffix(signalServer, "/")
+	if !strings.HasSuffix(u, "/whet/ws") {
+		u += "/whet/ws"
+	}
+	return u
+}
+
+// signaledAnswer is the signal server's answer to an offer
+type signaledAnswer struct {
+	sdp string
+	// connectionID is the server's id for the session
+	connectionID string
+	// resourceURL is deleted to close a session signaled over HTTP
+	resourceURL string
+	// socket is the session of an offer sent over a signaling WebSocket
+	socket *socketSession
+}
+
+// signalOffer sends an offer for targetPath, e.g. whet/ssh, to the signal server over
+// HTTP or, for ws:// and wss:// addresses, over the shared signaling WebSocket
+func signalOffer(ctx context.Context, signalServer string, targetPath string, bearerToken string, offer string) (*signaledAnswer, error) {
+	if IsSocketURL(signalServer) {
+		sc, err := sharedSignalClient(ctx, signalServer, bearerToken)
+		if err != nil {
+			return nil, err
+		}
+		return sc.offer(ctx, strings.TrimPrefix(targetPath, "whet/"), offer)
+	}
+
+	signalServer = signalURL(signalServer, targetPath)
+	fmt.Printf("WHET client using endpoint %s\n", signalServer)
+	req, err := http.NewRequestWithContext(ctx, "POST", signalServer, bytes.NewBuffer([]byte(offer)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/sdp")
+	if bearerToken != "" {
+		req.Header.Add("Authorization", "Bearer "+bearerToken)
+	}
+
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 201 && resp.StatusCode != 200 {
+		return nil, &SignalError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	// location provides the resource URL that is used to manage the connection
+	// the last part of the URL is the connection ID
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("location not found in response")
+	}
+	resourceUrl, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Resource URL %s\n", resourceUrl)
+	base, err := url.Parse(signalServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signaledAnswer{
+		sdp:          string(body),
+		connectionID: resourceUrl.Path[strings.LastIndex(resourceUrl.Path, "/")+1:],
+		resourceURL:  base.ResolveReference(resourceUrl).String(),
+	}, nil
+}
+
+// start sets the answer as the remote description of peerConnection and adds the
+// candidates the server trickles
+func (a *signaledAnswer) start(peerConnection *webrtc.PeerConnection) error {
+	err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: a.sdp})
+	if err != nil {
+		return fmt.Errorf("failed to set remote description: %v", err)
+	}
+	if a.socket != nil {
+		go a.socket.trickle(peerConnection)
+	}
+	return nil
+}
+
+// closeSignaling tells the signal server the session is closed, with DELETE on the
+// resource URL or a close message on the signaling socket
+func (c *Connection) closeSignaling() error {
+	if c.socket != nil {
+		c.socket.close()
+		return nil
+	}
+	if c.resourceURL == "" {
+		return nil
+	}
+	req, err := http.NewRequest("DELETE", c.resourceURL, nil)
+	if err != nil {
+		return fmt.Errorf("unexpected error building http request. %v", err)
+	}
+	if c.bearerToken != "" {
+		req.Header.Add("Authorization", "Bearer "+c.bearerToken)
+	}
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed http DELETE request: %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// signalClient is the client side of a signaling WebSocket, see signalsocket.go
+type signalClient struct {
+	conn socketConn
+	done chan struct{}
+	// onRelayOffer is called with the offers relayed to a listening client
+	onRelayOffer func(*signalClient, *signalMessage)
+
+	writeMut sync.Mutex
+
+	mut    sync.Mutex
+	err    error
+	nextID int
+	// waiting receives the messages for each id
+	waiting map[string]chan *signalMessage
+}
+
+// signalClients are the signaling sockets shared by dialers, by URL and token
+var signalClients = make(map[string]*signalClient)
+var signalClientsLock sync.Mutex
+
+// sharedSignalClient returns the open signaling socket to signalServer for bearerToken,
+// opening one if there is none
+func sharedSignalClient(ctx context.Context, signalServer string, bearerToken string) (*signalClient, error) {
+	key := socketURL(signalServer) + " " + bearerToken
+	signalClientsLock.Lock()
+	defer signalClientsLock.Unlock()
+	if sc := signalClients[key]; sc != nil && !sc.closed() {
+		return sc, nil
+	}
+	sc, err := dialSignalClient(ctx, signalServer, bearerToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	signalClients[key] = sc
+	return sc, nil
+}
+
+// dialSignalClient opens a signaling socket to signalServer authenticated with bearerToken
+func dialSignalClient(ctx context.Context, signalServer string, bearerToken string, onRelayOffer func(*signalClient, *signalMessage)) (*signalClient, error) {
+	conn, err := dialSocket(ctx, socketURL(signalServer))
+	if err != nil {
+		return nil, err
+	}
+	sc := &signalClient{
+		conn:         conn,
+		done:         make(chan struct{}),
+		onRelayOffer: onRelayOffer,
+		waiting:      make(map[string]chan *signalMessage),
+	}
+	if bearerToken != "" {
+		if err := sc.send(&signalMessage{Type: "auth", Token: bearerToken}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go sc.receive()
+	return sc, nil
+}
+
+// receive dispatches the server's messages until the socket closes
+func (sc *signalClient) receive() {
+	defer func() {
+		sc.mut.Lock()
+		if sc.err == nil {
+			sc.err = errors.New("signaling socket closed")
+		}
+		sc.mut.Unlock()
+		close(sc.done)
+		sc.conn.Close()
+	}()
+
+	for {
+		data, err := sc.conn.Receive()
+		if err != nil {
+			return
+		}
+		var msg signalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			fmt.Printf("Invalid signaling message: %v\n", err)
+			continue
+		}
+		switch {
+		case msg.Type == "relay-offer":
+			if sc.onRelayOffer != nil {
+				go sc.onRelayOffer(sc, &msg)
+			}
+		case msg.Type == "error" && msg.ID == "":
+			// the socket failed, the server closes it
+			sc.mut.Lock()
+			sc.err = &SignalError{StatusCode: msg.Status, Message: msg.Error}
+			sc.mut.Unlock()
+		case msg.ID != "":
+			sc.mut.Lock()
+			ch := sc.waiting[msg.ID]
+			sc.mut.Unlock()
+			if ch != nil {
+				// a session that stopped reading misses its messages rather than stalling the socket
+				select {
+				case ch <- &msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// closed reports if the socket is closed
+func (sc *signalClient) closed() bool {
+	select {
+	case <-sc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the socket
+func (sc *signalClient) close() error {
+	return sc.conn.Close()
+}
+
+// send sends a message to the server
+func (sc *signalClient) send(msg *signalMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sc.writeMut.Lock()
+	defer sc.writeMut.Unlock()
+	return sc.conn.Send(data)
+}
+
+// open returns a new id and the channel that receives its messages
+func (sc *signalClient) open() (string, chan *signalMessage) {
+	sc.mut.Lock()
+	defer sc.mut.Unlock()
+	sc.nextID++
+	id := strconv.Itoa(sc.nextID)
+	ch := make(chan *signalMessage, 64)
+	sc.waiting[id] = ch
+	return id, ch
+}
+
+// forget stops receiving the messages of id
+func (sc *signalClient) forget(id string) {
+	sc.mut.Lock()
+	delete(sc.waiting, id)
+	sc.mut.Unlock()
+}
+
+// request sends msg with a new id and waits for the server's reply, returning the
+// channel of the id's later messages
+func (sc *signalClient) request(ctx context.Context, msg *signalMessage) (*signalMessage, chan *signalMessage, error) {
+	id, ch := sc.open()
+	msg.ID = id
+	if err := sc.send(msg); err != nil {
+		sc.forget(id)
+		return nil, nil, err
+	}
+	select {
+	case reply := <-ch:
+		if reply.Type == "error" {
+			sc.forget(id)
+			return nil, nil, &SignalError{StatusCode: reply.Status, Message: reply.Error}
+		}
+		return reply, ch, nil
+	case <-sc.done:
+		sc.forget(id)
+		sc.mut.Lock()
+		defer sc.mut.Unlock()
+		return nil, nil, sc.err
+	case <-ctx.Done():
+		sc.forget(id)
+		return nil, nil, ctx.Err()
+	}
+}
+
+// offer sends an offer for target and returns the server's answer
+func (sc *signalClient) offer(ctx context.Context, target string, sdp string) (*signaledAnswer, error) {
+	reply, ch, err := sc.request(ctx, &signalMessage{Type: "offer", Target: target, SDP: sdp})
+	if err != nil {
+		return nil, err
+	}
+	return &signaledAnswer{
+		sdp:          reply.SDP,
+		connectionID: reply.Session,
+		socket:       &socketSession{client: sc, id: reply.ID, messages: ch, closed: make(chan struct{})},
+	}, nil
+}
+
+// socketSession is a session signaled over a signaling socket
+type socketSession struct {
+	client    *signalClient
+	id        string
+	messages  chan *signalMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// trickle adds the candidates the server trickles for the session to peerConnection
+// until gathering is done
+func (s *socketSession) trickle(peerConnection *webrtc.PeerConnection) {
+	for {
+		select {
+		case msg := <-s.messages:
+			if msg.Type != "candidate" {
+				continue
+			}
+			if msg.Candidate == nil {
+				s.client.forget(s.id)
+				return
+			}
+			if err := peerConnection.AddICECandidate(*msg.Candidate); err != nil {
+				fmt.Printf("Failed to add trickled candidate: %v\n", err)
+			}
+		case <-s.closed:
+			return
+		case <-s.client.done:
+			return
+		}
+	}
+}
+
+// close tells the server the session is closed
+func (s *socketSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.client.forget(s.id)
+		if !s.client.closed() {
+			s.client.send(&signalMessage{Type: "close", ID: s.id})
+		}
+	})
+}
@@ -0,0 +1,401 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+/*
+WebSocket signaling carries the signaling of many sessions over one WebSocket to
+/whet/ws, for networks where repeated POSTs are slow.  Clients select it with a ws:// or
+wss:// signal server address.  Messages are JSON objects with a type:
+
+client to server
+	{"type": "auth", "token"}                        authenticates the socket, for clients that can't
+	                                                 send an Authorization header on the upgrade.  The
+	                                                 token is checked again for every offer and listen.
+	{"type": "offer", "id", "target", "sdp"}         opens target like POST /whet/<target>.  id is the
+	                                                 client's name for the session, unique on the socket.
+	{"type": "candidate", "id", "candidate"}         adds a trickled candidate to the session
+	{"type": "close", "id"}                          closes the session like DELETE /whet/<session>
+	{"type": "listen", "id", "targets"}              registers targets like POST /api/listeners,
+	                                                 replacing the socket's earlier registration
+	{"type": "unlisten"}                             removes the socket's registration
+	{"type": "relay-answer", "session", "sdp"}       answers a relayed offer, or with "error" refuses it
+	{"type": "ping"}                                 keeps the socket open, the server replies pong
+
+server to client
+	{"type": "answer", "id", "session", "sdp"}       the server's candidates follow the answer
+	{"type": "candidate", "id", "candidate"}         without candidate once there are no more
+	{"type": "error", "id", "status", "error"}       the message with id failed with the HTTP status,
+	                                                 the socket is closed after a 401
+	{"type": "listening", "id", "targets"}           the targets are registered
+	{"type": "relay-offer", "session", "target", "identity", "sdp"}
+	                                                 an offer for a registered target
+
+The same authentication, rate limits and checks apply as to the HTTP endpoints.  Sessions
+outlive the socket, a registration is removed when the socket closes.  Offers relayed to
+remote listeners must be complete, candidates are only trickled to and from this server.
+A socket that sends nothing for relayExpiry is closed.
+*/
+
+// signalMessage is a message on a signaling WebSocket
+type signalMessage struct {
+	Type      string                   `json:"type"`
+	ID        string                   `json:"id,omitempty"`
+	Token     string                   `json:"token,omitempty"`
+	Target    string                   `json:"target,omitempty"`
+	Session   string                   `json:"session,omitempty"`
+	Identity  string                   `json:"identity,omitempty"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Targets   []relayTarget            `json:"targets,omitempty"`
+	Status    int                      `json:"status,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+// maxSignalMessage limits the size of a message on a signaling WebSocket
+const maxSignalMessage = 1 << 20
+
+// signalSocket is the server side of a signaling WebSocket
+type signalSocket struct {
+	server   *WhetServer
+	conn     *websocket.Conn
+	request  *http.Request
+	clientIP string
+	// origin is the browser origin targets are checked against, empty for the server's own
+	origin string
+	done   chan struct{}
+
+	writeMut sync.Mutex
+
+	mut sync.Mutex
+	// token is the token of the last auth message, checked again for every offer and
+	// listen so an expired or revoked token stops working on an open socket
+	token string
+	// sessions maps the client's ids to session ids
+	sessions map[string]string
+	relay    *relayListener
+}
+
+// signalSocketHandler upgrades a request to /whet/ws to a signaling WebSocket
+func (ws *WhetServer) signalSocketHandler(w http.ResponseWriter, r *http.Request) {
+	// the Go client sends the server's own origin, which is trusted like a request
+	// without one
+	origin := r.Header.Get("Origin")
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		origin = ""
+	}
+	if origin != "" && !ws.setCORSHeaders(w, r, "GET, OPTIONS") {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	ws.Metrics.Inc("whet_signal_requests_total", "method", "WS")
+
+	clientIP := remoteIP(r).String()
+	if err := ws.limitClient(clientIP); err != nil {
+		ws.rejectOffer(w, err)
+		return
+	}
+
+	// an Authorization header is checked up front
+	if bearerFromRequest(r) != "" {
+		if _, err := ws.authenticate(r); err != nil {
+			ws.authFailed(r, clientIP, "ws", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	server := websocket.Server{
+		// the origin was checked above
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = maxSignalMessage
+			s := &signalSocket{
+				server:   ws,
+				conn:     conn,
+				request:  r,
+				clientIP: clientIP,
+				origin:   origin,
+				done:     make(chan struct{}),
+				sessions: make(map[string]string),
+			}
+			s.serve()
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// serve handles the socket's messages until it closes
+func (s *signalSocket) serve() {
+	defer func() {
+		close(s.done)
+		s.conn.Close()
+		s.mut.Lock()
+		relay := s.relay
+		s.mut.Unlock()
+		if relay != nil {
+			s.server.removeRelay(relay, "socket closed")
+		}
+	}()
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(relayExpiry))
+		var msg signalMessage
+		if err := websocket.JSON.Receive(s.conn, &msg); err != nil {
+			return
+		}
+		if !s.handle(&msg) {
+			return
+		}
+	}
+}
+
+// handle handles a message from the client, returning false to close the socket
+func (s *signalSocket) handle(msg *signalMessage) bool {
+	switch msg.Type {
+	case "auth":
+		s.mut.Lock()
+		s.token = msg.Token
+		s.mut.Unlock()
+		_, ok := s.authenticate()
+		return ok
+	case "offer":
+		return s.offer(msg)
+	case "candidate":
+		s.mut.Lock()
+		session, ok := s.sessions[msg.ID]
+		s.mut.Unlock()
+		connectionsLock.Lock()
+		c := OpenConnections[session]
+		connectionsLock.Unlock()
+		if !ok || c == nil {
+			s.fail(msg.ID, &offerError{status: http.StatusNotFound, message: "Unknown session"})
+			return true
+		}
+		if msg.Candidate != nil {
+			if err := c.peerConnection.AddICECandidate(*msg.Candidate); err != nil {
+				s.fail(msg.ID, &offerError{status: http.StatusBadRequest, message: "Invalid candidate"})
+			}
+		}
+	case "close":
+		s.mut.Lock()
+		session := s.sessions[msg.ID]
+		delete(s.sessions, msg.ID)
+		s.mut.Unlock()
+		s.server.closeSignaledSession(session)
+	case "listen":
+		return s.listen(msg)
+	case "unlisten":
+		s.mut.Lock()
+		relay := s.relay
+		s.relay = nil
+		s.mut.Unlock()
+		if relay != nil {
+			s.server.removeRelay(relay, "unregistered")
+		}
+	case "relay-answer":
+		s.mut.Lock()
+		relay := s.relay
+		s.mut.Unlock()
+		// an unknown session is one the client gave up waiting for
+		if relay != nil {
+			relay.answered(relayAnswer{Session: msg.Session, SDP: msg.SDP, Error: msg.Error})
+		}
+	case "ping":
+		s.send(&signalMessage{Type: "pong"})
+	default:
+		s.fail(msg.ID, &offerError{status: http.StatusBadRequest, message: "Unknown message type"})
+	}
+	return true
+}
+
+// authenticate returns the identity of the socket, authenticating it with the token of
+// an auth message or the upgrade request.  On failure the socket is told and false is
+// returned so it's closed.
+func (s *signalSocket) authenticate() (*Identity, bool) {
+	s.mut.Lock()
+	token := s.token
+	s.mut.Unlock()
+
+	r := s.request
+	if token != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	identity, err := s.server.authenticate(r)
+	if err != nil {
+		s.server.authFailed(r, s.clientIP, "ws", err)
+		s.fail("", &offerError{status: http.StatusUnauthorized, message: "Unauthorized"})
+		return nil, false
+	}
+	return identity, true
+}
+
+// offer answers an offer, or relays it to the remote listener of the target
+func (s *signalSocket) offer(msg *signalMessage) bool {
+	ws := s.server
+	if err := ws.limitClient(s.clientIP); err != nil {
+		s.fail(msg.ID, err)
+		return true
+	}
+	identity, ok := s.authenticate()
+	if !ok {
+		return false
+	}
+	if err := ws.limitIdentity(identity); err != nil {
+		s.fail(msg.ID, err)
+		return true
+	}
+
+	s.mut.Lock()
+	_, exists := s.sessions[msg.ID]
+	s.mut.Unlock()
+	if msg.ID == "" || exists {
+		s.fail(msg.ID, &offerError{status: http.StatusBadRequest, message: "Invalid session id"})
+		return true
+	}
+
+	target, targetName, portoffset, oerr := ws.checkOffer(msg.Target, identity, s.origin)
+	if oerr != nil {
+		s.fail(msg.ID, oerr)
+		return true
+	}
+
+	// relaying waits for the remote listener, so it doesn't hold up the socket
+	if target.ForwardTargetType == ForwardTargetTypeRemote {
+		s.mut.Lock()
+		s.sessions[msg.ID] = ""
+		s.mut.Unlock()
+		go func() {
+			session, answer, err := ws.relayOffer(s.request.Context(), target.relay, msg.Target, msg.SDP, identity)
+			ws.releaseSession(targetName)
+			if err != nil {
+				s.fail(msg.ID, err)
+				return
+			}
+			// the relayed answer is complete, no candidates follow it
+			s.send(&signalMessage{Type: "answer", ID: msg.ID, Session: session, SDP: answer})
+			s.send(&signalMessage{Type: "candidate", ID: msg.ID})
+		}()
+		return true
+	}
+
+	// candidates gathered before the answer is sent are held back so the answer is first
+	var trickleMut sync.Mutex
+	var held []*webrtc.ICECandidate
+	answered := false
+	sendCandidate := func(candidate *webrtc.ICECandidate) {
+		m := &signalMessage{Type: "candidate", ID: msg.ID}
+		if candidate != nil {
+			init := candidate.ToJSON()
+			m.Candidate = &init
+		}
+		s.send(m)
+	}
+	trickle := func(candidate *webrtc.ICECandidate) {
+		trickleMut.Lock()
+		defer trickleMut.Unlock()
+		if !answered {
+			held = append(held, candidate)
+			return
+		}
+		sendCandidate(candidate)
+	}
+
+	session, answer, err := ws.answerOffer(msg.SDP, target, targetName, portoffset, identity, s.request.RemoteAddr, trickle)
+	if err != nil {
+		s.fail(msg.ID, err)
+		return true
+	}
+	s.mut.Lock()
+	s.sessions[msg.ID] = session
+	s.mut.Unlock()
+
+	trickleMut.Lock()
+	s.send(&signalMessage{Type: "answer", ID: msg.ID, Session: session, SDP: answer})
+	for _, candidate := range held {
+		sendCandidate(candidate)
+	}
+	answered = true
+	trickleMut.Unlock()
+	return true
+}
+
+// listen registers the message's targets as a remote listener served over the socket
+func (s *signalSocket) listen(msg *signalMessage) bool {
+	identity, ok := s.authenticate()
+	if !ok {
+		return false
+	}
+
+	s.mut.Lock()
+	previous := s.relay
+	s.relay = nil
+	s.mut.Unlock()
+	if previous != nil {
+		s.server.removeRelay(previous, "registration replaced")
+	}
+
+	relay, err := s.server.addRelay(identity, msg.Targets)
+	if err != nil {
+		s.fail(msg.ID, err)
+		return true
+	}
+	// the socket keeps the registration from expiring
+	relay.mut.Lock()
+	relay.polls++
+	relay.mut.Unlock()
+	s.mut.Lock()
+	s.relay = relay
+	s.mut.Unlock()
+
+	s.send(&signalMessage{Type: "listening", ID: msg.ID, Targets: msg.Targets})
+	go func() {
+		for {
+			select {
+			case offer := <-relay.offers:
+				s.send(&signalMessage{Type: "relay-offer", Session: offer.Session, Target: offer.Target, Identity: offer.Identity, SDP: offer.SDP})
+			case <-relay.done:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// fail sends the error of the message with id to the client
+func (s *signalSocket) fail(id string, err error) {
+	msg := &signalMessage{Type: "error", ID: id, Status: http.StatusInternalServerError, Error: err.Error()}
+	var oerr *offerError
+	if errors.As(err, &oerr) {
+		msg.Status = oerr.status
+		if oerr.status == http.StatusTooManyRequests {
+			s.server.Metrics.Inc("whet_rate_limited_total", "reason", oerr.reason)
+		}
+	}
+	s.send(msg)
+}
+
+// send sends a message to the client
+func (s *signalSocket) send(msg *signalMessage) {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	if err := websocket.JSON.Send(s.conn, msg); err != nil {
+		fmt.Printf("Failed to send %s on signaling socket: %v\n", msg.Type, err)
+	}
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSignalSocket(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	target, err := ParseForwardTargetPortFromString("echo=" + echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewWhetServer("secret", map[string]*ForwardTargetPort{"echo": target}, nil, nil, true)
+	s.RemoteListeners = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	socketServer := "ws://" + listener.Addr().String()
+
+	echoed := func(conn net.Conn, msg string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, []byte(msg)) {
+			t.Fatalf("expected the message echoed, got %q %v", got, err)
+		}
+	}
+
+	d := &Dialer{Timeout: 20 * time.Second}
+	var signalErr *SignalError
+	if _, err := d.Dial(socketServer, "whet/echo", "wrong"); !errors.As(err, &signalErr) || signalErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the wrong token, got %v", err)
+	}
+	if _, err := d.Dial(socketServer, "whet/missing", "secret"); !errors.As(err, &signalErr) || signalErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown target, got %v", err)
+	}
+
+	// both sessions are signaled over the same socket
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial(socketServer, "whet/echo", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoed(conn, "hello over a websocket")
+		conn.Close()
+	}
+
+	// a remote listener registered over a socket is dialed over HTTP
+	l, err := d.ListenRemote(socketServer, "remote", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := d.Dial("http://"+listener.Addr().String(), "whet/remote", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoed(conn, "hello remote listener")
+
+	// closing the socket removes the registration
+	l.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.Target("remote"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the target to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignalSocketRevokedToken(t *testing.T) {
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+	s.RemoteListeners = true
+	s.Tokens, _ = NewTokenStore([]*Token{{Name: "agent", Secret: "agent-secret"}})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartWithListener(listener, false); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := websocket.Dial("ws://"+listener.Addr().String()+"/whet/ws", "", "http://"+listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	exchange := func(msg *signalMessage) *signalMessage {
+		t.Helper()
+		if err := websocket.JSON.Send(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		var reply signalMessage
+		if err := websocket.JSON.Receive(conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return &reply
+	}
+
+	if err := websocket.JSON.Send(conn, &signalMessage{Type: "auth", Token: "agent-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	targets := []relayTarget{{Name: "remote"}}
+	if reply := exchange(&signalMessage{Type: "listen", ID: "1", Targets: targets}); reply.Type != "listening" {
+		t.Fatalf("expected the targets to be registered, got %+v", reply)
+	}
+
+	// a token revoked while the socket is open is refused on the next listen
+	s.Tokens.Remove("agent")
+	if reply := exchange(&signalMessage{Type: "listen", ID: "2", Targets: targets}); reply.Type != "error" || reply.Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 once the token is revoked, got %+v", reply)
+	}
+}
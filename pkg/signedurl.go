@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSignedURLInvalid = errors.New("invalid url signature")
+	ErrSignedURLExpired = errors.New("signed url expired")
+	ErrSignedURLUsed    = errors.New("signed url already used")
+)
+
+// URLSigner mints and verifies HMAC signed connect URLs that grant temporary
+// access to a single target without a bearer token, e.g.
+// https://example.com/whet/ssh?exp=1700000000&sig=...
+type URLSigner struct {
+	key  []byte
+	mut  *sync.Mutex
+	used map[string]time.Time
+}
+
+// NewURLSigner creates a signer with the given HMAC key
+func NewURLSigner(key []byte) *URLSigner {
+	return &URLSigner{
+		key:  key,
+		mut:  &sync.Mutex{},
+		used: make(map[string]time.Time),
+	}
+}
+
+// signature computes the signature of a connect URL for target
+func (s *URLSigner) signature(target string, exp string, nonce string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(target + "\n" + exp + "\n" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL returns a connect URL for target on the whet server at serverURL that expires
+// after ttl.  A single use URL is rejected after it has opened one session.
+func (s *URLSigner) SignURL(serverURL string, target string, ttl time.Duration, singleUse bool) (string, error) {
+	if target == "" || strings.Contains(target, "/") {
+		return "", fmt.Errorf("invalid target %q", target)
+	}
+	if !strings.HasPrefix(serverURL, "http") {
+		serverURL = "http://" + serverURL
+	}
+	base, err := url.Parse(strings.TrimSuffix(serverURL, "/"))
+	if err != nil {
+		return "", err
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	nonce := ""
+	if singleUse {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		nonce = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	q := url.Values{}
+	q.Set("exp", exp)
+	if nonce != "" {
+		q.Set("once", nonce)
+	}
+	q.Set("sig", s.signature(target, exp, nonce))
+
+	base.Path = base.Path + "/whet/" + target
+	base.RawQuery = q.Encode()
+	return base.String(), nil
+}
+
+// Verify checks the signature and expiry of a connect URL for target and returns an
+// identity limited to that target.  A single use URL is only consumed when a session
+// is created for the identity, so it is rejected after it has opened one session.
+func (s *URLSigner) Verify(target string, q url.Values) (*Identity, error) {
+	exp := q.Get("exp")
+	nonce := q.Get("once")
+	sig := q.Get("sig")
+
+	expected := s.signature(target, exp, nonce)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, ErrSignedURLInvalid
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return nil, ErrSignedURLInvalid
+	}
+	expires := time.Unix(expUnix, 0)
+	if time.Now().After(expires) {
+		return nil, ErrSignedURLExpired
+	}
+
+	identity := &Identity{
+		Name:    "signed-url",
+		Targets: []string{target},
+	}
+	if nonce != "" {
+		s.mut.Lock()
+		_, used := s.used[nonce]
+		s.mut.Unlock()
+		if used {
+			return nil, ErrSignedURLUsed
+		}
+		identity.once = func() error {
+			return s.consume(nonce, expires)
+		}
+	}
+	return identity, nil
+}
+
+// consume marks the nonce of a single use URL used, failing if it already was
+func (s *URLSigner) consume(nonce string, expires time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	// forget about used URLs that have expired anyway
+	now := time.Now()
+	for n, e := range s.used {
+		if now.After(e) {
+			delete(s.used, n)
+		}
+	}
+	if _, ok := s.used[nonce]; ok {
+		return ErrSignedURLUsed
+	}
+	s.used[nonce] = expires
+	return nil
+}
+
+// isSignedURL reports if a whet URL carries a URL signature
+func isSignedURL(q url.Values) bool {
+	return q.Get("sig") != ""
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	signer := NewURLSigner([]byte("secret"))
+
+	signed, err := signer.SignURL("https://whet.example.com", "ssh", time.Minute, false)
+	if err != nil {
+		t.Fatalf("SignURL: %v", err)
+	}
+	if !strings.HasPrefix(signed, "https://whet.example.com/whet/ssh?") {
+		t.Fatalf("unexpected signed url %s", signed)
+	}
+	if !IsConnectURL(signed) || signalURL(signed, "whet/other") != signed {
+		t.Errorf("expected signed url to be used as is by clients")
+	}
+
+	u, _ := url.Parse(signed)
+	id, err := signer.Verify("ssh", u.Query())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !id.CanAccess("ssh", 0) || id.CanAccess("db", 0) || id.Admin {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	// the signature is bound to the target
+	if _, err := signer.Verify("db", u.Query()); err != ErrSignedURLInvalid {
+		t.Errorf("expected ErrSignedURLInvalid for another target, got %v", err)
+	}
+
+	// a different key does not verify
+	if _, err := NewURLSigner([]byte("other")).Verify("ssh", u.Query()); err != ErrSignedURLInvalid {
+		t.Errorf("expected ErrSignedURLInvalid for another key, got %v", err)
+	}
+
+	expired, _ := signer.SignURL("https://whet.example.com", "ssh", -time.Minute, false)
+	u, _ = url.Parse(expired)
+	if _, err := signer.Verify("ssh", u.Query()); err != ErrSignedURLExpired {
+		t.Errorf("expected ErrSignedURLExpired, got %v", err)
+	}
+}
+
+func TestSignedURLSingleUse(t *testing.T) {
+	s, _ := NewWhetServer("token", nil, nil, nil, true)
+	s.URLSigner = NewURLSigner([]byte("secret"))
+
+	signed, _ := s.URLSigner.SignURL("http://127.0.0.1:8080", "range-3", time.Minute, true)
+
+	r := httptest.NewRequest("POST", signed, nil)
+	id, err := s.authenticate(r)
+	if err != nil {
+		t.Fatalf("expected signed url to authenticate, got %v", err)
+	}
+	if !id.CanAccess("range", 3) || id.CanAccess("range", 4) {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	// an offer that fails doesn't use up the URL
+	w := httptest.NewRecorder()
+	s.WhetHandler(w, httptest.NewRequest("POST", signed, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for the missing target, got %d", w.Code)
+	}
+	if id, err = s.authenticate(httptest.NewRequest("POST", signed, nil)); err != nil {
+		t.Fatalf("expected the url to be usable after a failed offer, got %v", err)
+	}
+
+	// the URL is used up by the session it opens
+	if err := id.claim(); err != nil {
+		t.Fatalf("expected the first session to claim the url, got %v", err)
+	}
+	if err := id.claim(); err != ErrSignedURLUsed {
+		t.Errorf("expected a concurrent offer not to claim the url, got %v", err)
+	}
+	if _, err := s.authenticate(httptest.NewRequest("POST", signed, nil)); err != ErrSignedURLUsed {
+		t.Errorf("expected ErrSignedURLUsed on second use, got %v", err)
+	}
+}
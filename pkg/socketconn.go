@@ -0,0 +1,51 @@
+//go:build !js
+
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// netSocket is a client WebSocket over a network connection
+type netSocket struct {
+	conn *websocket.Conn
+}
+
+// dialSocket opens a WebSocket to socketURL
+func dialSocket(ctx context.Context, socketURL string) (socketConn, error) {
+	// the origin is the server's own, which it allows like a same origin request
+	origin := "http" + strings.TrimPrefix(socketURL, "ws")
+	config, err := websocket.NewConfig(socketURL, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         tls.VersionTLS13,
+	}
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.MaxPayloadBytes = maxSignalMessage
+	return &netSocket{conn: conn}, nil
+}
+
+func (s *netSocket) Send(data []byte) error {
+	return websocket.Message.Send(s.conn, string(data))
+}
+
+func (s *netSocket) Receive() ([]byte, error) {
+	var data string
+	err := websocket.Message.Receive(s.conn, &data)
+	return []byte(data), err
+}
+
+func (s *netSocket) Close() error {
+	return s.conn.Close()
+}
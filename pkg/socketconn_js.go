@@ -0,0 +1,132 @@
+//go:build js
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall/js"
+)
+
+// jsSocket is a client WebSocket using the browser's WebSocket
+type jsSocket struct {
+	ws    js.Value
+	funcs []js.Func
+	// ready is signaled when a message is queued or the socket closes
+	ready chan struct{}
+
+	mut      sync.Mutex
+	messages [][]byte
+	closed   bool
+	err      error
+}
+
+// dialSocket opens a WebSocket to socketURL.  Browsers send their own origin.
+func dialSocket(ctx context.Context, socketURL string) (socketConn, error) {
+	s := &jsSocket{
+		ws:    js.Global().Get("WebSocket").New(socketURL),
+		ready: make(chan struct{}, 1),
+	}
+	opened := make(chan struct{})
+	var openOnce sync.Once
+
+	// the callbacks run on the event loop, so they must not block
+	s.on("open", func(event js.Value) {
+		openOnce.Do(func() { close(opened) })
+	})
+	s.on("message", func(event js.Value) {
+		data := event.Get("data")
+		if data.Type() != js.TypeString {
+			return
+		}
+		s.mut.Lock()
+		s.messages = append(s.messages, []byte(data.String()))
+		s.mut.Unlock()
+		s.signal()
+	})
+	s.on("close", func(event js.Value) {
+		s.mut.Lock()
+		if s.err == nil {
+			s.err = errors.New("signaling socket closed")
+		}
+		s.closed = true
+		s.mut.Unlock()
+		openOnce.Do(func() { close(opened) })
+		s.signal()
+		go s.release()
+	})
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil, errors.New("failed to open signaling socket " + socketURL)
+	}
+	return s, nil
+}
+
+// on adds a listener for the socket's event
+func (s *jsSocket) on(event string, fn func(event js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})
+	s.funcs = append(s.funcs, f)
+	s.ws.Call("addEventListener", event, f)
+}
+
+// signal wakes a waiting Receive
+func (s *jsSocket) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// release releases the socket's listeners once it is closed
+func (s *jsSocket) release() {
+	for _, f := range s.funcs {
+		f.Release()
+	}
+	s.funcs = nil
+}
+
+func (s *jsSocket) Send(data []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return s.err
+	}
+	s.ws.Call("send", string(data))
+	return nil
+}
+
+func (s *jsSocket) Receive() ([]byte, error) {
+	for {
+		s.mut.Lock()
+		if len(s.messages) > 0 {
+			data := s.messages[0]
+			s.messages = s.messages[1:]
+			s.mut.Unlock()
+			return data, nil
+		}
+		if s.closed {
+			err := s.err
+			s.mut.Unlock()
+			return nil, err
+		}
+		s.mut.Unlock()
+		<-s.ready
+	}
+}
+
+func (s *jsSocket) Close() error {
+	s.ws.Call("close")
+	return nil
+}
@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TargetTLS configures originating TLS from the server to the backends of a target
+type TargetTLS struct {
+	Enabled bool
+	// ServerName is the SNI and verified name, the backend host when empty
+	ServerName string
+	// CAFile is a PEM bundle of the CAs to verify the backend with, the system roots when empty
+	CAFile string
+	// CertFile and KeyFile are a client certificate presented to the backend
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verifying the backend certificate
+	InsecureSkipVerify bool
+
+	config *tls.Config
+}
+
+// setOption sets a target TLS option, any option other than 'tls' enables TLS.  Options
+// are set in the order of optionKeys so an explicit 'tls' option is set last and wins.
+func (t *TargetTLS) setOption(key string, value string) error {
+	var err error
+	switch key {
+	case "tls":
+		t.Enabled, err = parseBoolOption(value)
+		if err != nil {
+			return fmt.Errorf("invalid tls %q", value)
+		}
+		return nil
+	case "sni":
+		t.ServerName = value
+	case "ca":
+		t.CAFile = value
+	case "cert":
+		t.CertFile = value
+	case "key":
+		t.KeyFile = value
+	case "insecure":
+		t.InsecureSkipVerify, err = parseBoolOption(value)
+		if err != nil {
+			return fmt.Errorf("invalid insecure %q", value)
+		}
+	}
+	t.Enabled = true
+	return nil
+}
+
+// load reads the CA bundle and client certificate so bad files are reported when the
+// target is parsed rather than on the first connection
+func (t *TargetTLS) load() error {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	t.config = config
+	return nil
+}
+
+// client wraps a connection to the backend at addr in TLS and completes the handshake
+// within timeout
+func (t *TargetTLS) client(conn net.Conn, addr string, timeout time.Duration) (net.Conn, error) {
+	config := t.config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// SelfSignedCertificate creates a self-signed ECDSA certificate valid for a year for the
+// given host names and IP addresses
+func SelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"whet"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the leaf certificate as
+// colon separated hex, the form browsers and openssl show
+func CertificateFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, ":")
+}
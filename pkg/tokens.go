@@ -0,0 +1,318 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownToken = errors.New("unknown token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenSource  = errors.New("token not allowed from this address")
+)
+
+// Token is a named bearer token that grants access to a set of targets.
+type Token struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	// Targets lists the target names or patterns the token may open, e.g. "ssh",
+	// "db*", "range" (every port of a range) or "range-3" (a single port of a range).
+	// An empty list allows every target.
+	Targets []string `json:"targets,omitempty"`
+	// Expires is the optional time after which the token is no longer accepted
+	Expires *time.Time `json:"expires,omitempty"`
+	// SourceCIDRs optionally restricts the client addresses the token is accepted from
+	SourceCIDRs []string `json:"source_cidrs,omitempty"`
+	// Admin tokens may use the server admin API
+	Admin bool `json:"admin,omitempty"`
+
+	nets []*net.IPNet
+}
+
+// tokenFile is the on-disk format of a token store
+type tokenFile struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// TokenStore holds the tokens accepted by a WhetServer.  A store loaded from a file
+// can be reloaded at runtime without restarting the server.
+type TokenStore struct {
+	mut    *sync.RWMutex
+	update *sync.Mutex // serializes changes so concurrent adds and removes are not lost
+	path   string
+	tokens map[[sha256.Size]byte]*Token
+}
+
+// Identity is the authenticated caller of a whet request
+type Identity struct {
+	Name string
+	// Targets lists the target patterns the caller may open, an empty list allows every target
+	Targets []string
+	Admin   bool
+
+	// once consumes the single use signed URL the identity was authenticated with
+	once func() error
+}
+
+// claim consumes the single use signed URL the identity was authenticated with, if any.
+// It's called once a session has been created so a failed offer leaves the URL usable.
+func (id *Identity) claim() error {
+	if id.once == nil {
+		return nil
+	}
+	return id.once()
+}
+
+// anonymousIdentity is used when the server has no authentication configured.  It may
+// open every target but only uses the admin API from the server's own host.
+var anonymousIdentity = &Identity{Name: "anonymous"}
+
+// CanAccess reports if the identity may open the port at offset of the named target
+func (id *Identity) CanAccess(targetName string, offset int) bool {
+	if len(id.Targets) == 0 {
+		return true
+	}
+	return targetPatternsMatch(id.Targets, targetName, offset)
+}
+
+// targetPatternsMatch reports if any pattern matches either the target name itself,
+// allowing every port of the target, or the 'name-offset' form of a single port.
+func targetPatternsMatch(patterns []string, targetName string, offset int) bool {
+	withOffset := targetName + "-" + strconv.Itoa(offset)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, targetName); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, withOffset); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTokenStore creates a token store from a slice of tokens
+func NewTokenStore(tokens []*Token) (*TokenStore, error) {
+	ts := &TokenStore{
+		mut:    &sync.RWMutex{},
+		update: &sync.Mutex{},
+	}
+	if err := ts.set(tokens); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// LoadTokenStore creates a token store from a JSON token file
+func LoadTokenStore(filename string) (*TokenStore, error) {
+	ts := &TokenStore{
+		mut:    &sync.RWMutex{},
+		update: &sync.Mutex{},
+		path:   filename,
+	}
+	if err := ts.Reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// OpenTokenStore loads a token store from a JSON token file like LoadTokenStore, but
+// returns an empty store if the file does not exist yet so tokens can be added and saved
+func OpenTokenStore(filename string) (*TokenStore, error) {
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return &TokenStore{
+			mut:    &sync.RWMutex{},
+			update: &sync.Mutex{},
+			path:   filename,
+			tokens: make(map[[sha256.Size]byte]*Token),
+		}, nil
+	}
+	return LoadTokenStore(filename)
+}
+
+// Reload re-reads the token file the store was loaded from.  On error the
+// current tokens are left untouched.
+func (ts *TokenStore) Reload() error {
+	if ts.path == "" {
+		return errors.New("token store was not loaded from a file")
+	}
+
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		return err
+	}
+
+	var tf tokenFile
+	if err := json.Unmarshal(data, &tf); err != nil {
+		return fmt.Errorf("invalid token file %s: %v", ts.path, err)
+	}
+	ts.update.Lock()
+	defer ts.update.Unlock()
+	return ts.set(tf.Tokens)
+}
+
+// set validates tokens and swaps them in.  Each token is copied before its parsed
+// networks are filled in, since tokens handed out by Tokens may still be read by
+// Lookup while the new set is built.
+func (ts *TokenStore) set(tokens []*Token) error {
+	byHash := make(map[[sha256.Size]byte]*Token)
+	names := make(map[string]bool)
+	for i, t := range tokens {
+		copied := *t
+		t := &copied
+		if t.Name == "" {
+			return fmt.Errorf("token %d: missing name", i)
+		}
+		if t.Secret == "" {
+			return fmt.Errorf("token %s: missing secret", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("token %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		for _, pattern := range t.Targets {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("token %s: invalid target pattern %q", t.Name, pattern)
+			}
+		}
+
+		t.nets = make([]*net.IPNet, 0, len(t.SourceCIDRs))
+		for _, cidr := range t.SourceCIDRs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("token %s: invalid source CIDR %q", t.Name, cidr)
+			}
+			t.nets = append(t.nets, ipnet)
+		}
+
+		byHash[sha256.Sum256([]byte(t.Secret))] = t
+	}
+
+	ts.mut.Lock()
+	ts.tokens = byHash
+	ts.mut.Unlock()
+	return nil
+}
+
+// Tokens returns the tokens in the store
+func (ts *TokenStore) Tokens() []*Token {
+	ts.mut.RLock()
+	defer ts.mut.RUnlock()
+	retv := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		retv = append(retv, t)
+	}
+	return retv
+}
+
+// Add adds a token to the store, failing if a token with the same name exists
+func (ts *TokenStore) Add(t *Token) error {
+	ts.update.Lock()
+	defer ts.update.Unlock()
+	return ts.set(append(ts.Tokens(), t))
+}
+
+// Remove removes the named token from the store
+func (ts *TokenStore) Remove(name string) error {
+	ts.update.Lock()
+	defer ts.update.Unlock()
+	tokens := ts.Tokens()
+	for i, t := range tokens {
+		if t.Name == name {
+			return ts.set(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return ErrUnknownToken
+}
+
+// Save writes the store back to the file it was loaded from.  The file is replaced
+// atomically so a server reloading it never sees a partial write.
+func (ts *TokenStore) Save() error {
+	if ts.path == "" {
+		return errors.New("token store was not loaded from a file")
+	}
+
+	tokens := ts.Tokens()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	data, err := json.MarshalIndent(tokenFile{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ts.path), ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ts.path)
+}
+
+// GenerateTokenSecret returns a new random token secret
+func GenerateTokenSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Lookup finds the token with the given secret and checks that it has not expired
+// and is presented from an allowed source address.  remoteIP may be nil if the
+// source address is unknown, in which case tokens restricted to CIDRs are rejected.
+func (ts *TokenStore) Lookup(secret string, remoteIP net.IP) (*Token, error) {
+	// look the token up by the hash of the secret so the lookup time does not
+	// depend on how much of the secret matches
+	ts.mut.RLock()
+	t, ok := ts.tokens[sha256.Sum256([]byte(secret))]
+	ts.mut.RUnlock()
+	if !ok || secret == "" {
+		return nil, ErrUnknownToken
+	}
+
+	if t.Expires != nil && time.Now().After(*t.Expires) {
+		return nil, ErrTokenExpired
+	}
+
+	if len(t.nets) > 0 {
+		allowed := false
+		for _, ipnet := range t.nets {
+			if remoteIP != nil && ipnet.Contains(remoteIP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, ErrTokenSource
+		}
+	}
+
+	return t, nil
+}
+
+// Identity returns the identity of callers presenting the token
+func (t *Token) Identity() *Identity {
+	return &Identity{
+		Name:    t.Name,
+		Targets: t.Targets,
+		Admin:   t.Admin,
+	}
+}
@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentityCanAccess(t *testing.T) {
+	id := &Identity{Name: "ops", Targets: []string{"ssh", "db*", "range-3"}}
+
+	tests := []struct {
+		target string
+		offset int
+		want   bool
+	}{
+		{"ssh", 0, true},
+		{"db", 0, true},
+		{"dbreplica", 0, true},
+		{"range", 3, true},
+		{"range", 4, false},
+		{"range", 0, false},
+		{"web", 0, false},
+	}
+	for _, tt := range tests {
+		if got := id.CanAccess(tt.target, tt.offset); got != tt.want {
+			t.Errorf("CanAccess(%s, %d) = %v, want %v", tt.target, tt.offset, got, tt.want)
+		}
+	}
+
+	// an identity without target patterns may access everything
+	all := &Identity{Name: "all"}
+	if !all.CanAccess("anything", 7) {
+		t.Errorf("expected unrestricted identity to access every target")
+	}
+}
+
+func TestTokenStoreLookup(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	ts, err := NewTokenStore([]*Token{
+		{Name: "ssh", Secret: "s1", Targets: []string{"ssh"}},
+		{Name: "old", Secret: "s2", Expires: &past},
+		{Name: "lan", Secret: "s3", SourceCIDRs: []string{"10.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatalf("NewTokenStore: %v", err)
+	}
+
+	if tok, err := ts.Lookup("s1", nil); err != nil || tok.Name != "ssh" {
+		t.Errorf("expected token ssh, got %v %v", tok, err)
+	}
+	if _, err := ts.Lookup("nope", nil); err != ErrUnknownToken {
+		t.Errorf("expected ErrUnknownToken, got %v", err)
+	}
+	if _, err := ts.Lookup("s2", nil); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+	if _, err := ts.Lookup("s3", net.ParseIP("192.168.1.1")); err != ErrTokenSource {
+		t.Errorf("expected ErrTokenSource, got %v", err)
+	}
+	if _, err := ts.Lookup("s3", net.ParseIP("10.1.2.3")); err != nil {
+		t.Errorf("expected token lan from 10.1.2.3, got %v", err)
+	}
+
+	if _, err := NewTokenStore([]*Token{{Name: "a", Secret: "x"}, {Name: "a", Secret: "y"}}); err == nil {
+		t.Errorf("expected duplicate token names to be rejected")
+	}
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(filename, []byte(`{"tokens":[{"name":"a","secret":"one"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := LoadTokenStore(filename)
+	if err != nil {
+		t.Fatalf("LoadTokenStore: %v", err)
+	}
+	if _, err := ts.Lookup("one", nil); err != nil {
+		t.Fatalf("expected token one, got %v", err)
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"tokens":[{"name":"b","secret":"two"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := ts.Lookup("one", nil); err != ErrUnknownToken {
+		t.Errorf("expected token one to be gone after reload, got %v", err)
+	}
+	if _, err := ts.Lookup("two", nil); err != nil {
+		t.Errorf("expected token two after reload, got %v", err)
+	}
+
+	// a broken file leaves the current tokens in place
+	if err := os.WriteFile(filename, []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Reload(); err == nil {
+		t.Errorf("expected reload of invalid file to fail")
+	}
+	if _, err := ts.Lookup("two", nil); err != nil {
+		t.Errorf("expected token two to survive a failed reload, got %v", err)
+	}
+}
+
+func TestTokenStoreSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+
+	ts, err := OpenTokenStore(filename)
+	if err != nil {
+		t.Fatalf("OpenTokenStore: %v", err)
+	}
+	if err := ts.Add(&Token{Name: "a", Secret: "one", Targets: []string{"ssh"}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := ts.Add(&Token{Name: "b", Secret: "two"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := ts.Add(&Token{Name: "a", Secret: "three"}); err == nil {
+		t.Errorf("expected adding a duplicate name to fail")
+	}
+	if err := ts.Remove("b"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := ts.Remove("b"); err != ErrUnknownToken {
+		t.Errorf("expected removing a missing token to fail, got %v", err)
+	}
+	if err := ts.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := LoadTokenStore(filename)
+	if err != nil {
+		t.Fatalf("LoadTokenStore: %v", err)
+	}
+	tok, err := loaded.Lookup("one", nil)
+	if err != nil {
+		t.Fatalf("expected token one after save, got %v", err)
+	}
+	if len(tok.Targets) != 1 || tok.Targets[0] != "ssh" {
+		t.Errorf("expected targets to be saved, got %v", tok.Targets)
+	}
+	if _, err := loaded.Lookup("two", nil); err != ErrUnknownToken {
+		t.Errorf("expected removed token to be gone, got %v", err)
+	}
+}
+
+func TestServerAuthenticate(t *testing.T) {
+	s, _ := NewWhetServer("legacy", nil, nil, nil, true)
+	s.Tokens, _ = NewTokenStore([]*Token{{Name: "ssh", Secret: "scoped", Targets: []string{"ssh"}}})
+
+	r := httptest.NewRequest("POST", "/whet/ssh", nil)
+	r.Header.Set("Authorization", "Bearer scoped")
+	id, err := s.authenticate(r)
+	if err != nil || id.Name != "ssh" || id.Admin {
+		t.Errorf("expected scoped identity, got %v %v", id, err)
+	}
+
+	r.Header.Set("Authorization", "Bearer legacy")
+	id, err = s.authenticate(r)
+	if err != nil || !id.Admin {
+		t.Errorf("expected legacy bearer token to be accepted, got %v %v", id, err)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := s.authenticate(r); err == nil {
+		t.Errorf("expected unknown token to be rejected")
+	}
+}
+
+func TestAnonymousAdmin(t *testing.T) {
+	s, _ := NewWhetServer("", nil, nil, nil, true)
+
+	r := httptest.NewRequest("GET", "/api/sessions", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	w := httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Errorf("expected the admin API to be served on loopback, got %d", w.Code)
+	}
+
+	r.RemoteAddr = "192.0.2.10:4000"
+	w = httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Errorf("expected the admin API to be refused to a remote caller, got %d", w.Code)
+	}
+
+	// a remote anonymous caller may still open targets
+	id, err := s.authenticate(r)
+	if err != nil || id.Admin || !id.CanAccess("ssh", 0) {
+		t.Errorf("expected a non admin anonymous identity, got %v %v", id, err)
+	}
+}
+
+func TestTokenStoreConcurrentAdd(t *testing.T) {
+	ts, err := NewTokenStore([]*Token{{Name: "lan", Secret: "s1", SourceCIDRs: []string{"10.0.0.0/8"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lookups keep running while tokens are added, and no add may be lost
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if _, err := ts.Lookup("s1", net.ParseIP("10.1.2.3")); err != nil {
+				t.Errorf("lookup: %v", err)
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := ts.Add(&Token{Name: fmt.Sprintf("t%d", i), Secret: fmt.Sprintf("secret%d", i)}); err != nil {
+				t.Errorf("add: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	<-done
+
+	if n := len(ts.Tokens()); n != 21 {
+		t.Errorf("expected 21 tokens, got %d", n)
+	}
+}
@@ -1,12 +1,16 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type WebRTCConn struct {
@@ -27,7 +31,83 @@ func DialWebRTCConn(signalServer string, targetName string, bearerToken string,
 	if err != nil {
 		return nil, err
 	}
+	return newWebRTCConn(c, bearerToken), nil
+}
+
+// Dialer dials whet targets with its own ICE servers and timeout
+type Dialer struct {
+	// ICEServers are used in place of the package ICEServers when not nil
+	ICEServers []webrtc.ICEServer
+	// Timeout limits signaling, ICE and the handshake, zero for no limit
+	Timeout time.Duration
+	// MDNS resolves the server of whet://name.local/target URLs to the whet server
+	// advertised as name on the local network, see mdns.go
+	MDNS bool
+}
+
+// Dial connects to a target through a whet server, targetName is in the form whet/name
+func (d *Dialer) Dial(signalServer string, targetName string, bearerToken string) (*WebRTCConn, error) {
+	return d.DialContext(context.Background(), signalServer, targetName, bearerToken)
+}
+
+// DialContext is Dial giving up when ctx is done
+func (d *Dialer) DialContext(ctx context.Context, signalServer string, targetName string, bearerToken string) (*WebRTCConn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	// the server always detaches its data channels
+	c, err := dialClientConnection(ctx, signalServer, targetName, bearerToken, true, d.ICEServers)
+	if err != nil {
+		return nil, err
+	}
+	return newWebRTCConn(c, bearerToken), nil
+}
+
+// DialURL connects to the target of a URL such as whet://server/ssh, signaling with
+// http, or whets://server/ssh, signaling with https
+func (d *Dialer) DialURL(ctx context.Context, targetURL string, bearerToken string) (*WebRTCConn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil || (u.Scheme != "whet" && u.Scheme != "whets") || u.Host == "" {
+		return nil, fmt.Errorf("invalid whet URL %q", targetURL)
+	}
+	target, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if target == "" {
+		return nil, fmt.Errorf("missing target in whet URL %q", targetURL)
+	}
+	server, err := ResolveServer(ctx, u.Scheme+"://"+u.Host, d.MDNS)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, server, "whet/"+target, bearerToken)
+}
 
+// ResolveServer returns the signal server address of a whet://server or whets://server
+// URL, http://server or https://server.  With mdns set a server named name.local
+// without a port is looked up on the local network.  Other addresses are returned as
+// they are.
+func ResolveServer(ctx context.Context, server string, mdns bool) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "whet" && u.Scheme != "whets") {
+		return server, nil
+	}
+	if name, ok := strings.CutSuffix(u.Host, ".local"); ok && mdns {
+		return lookupServer(ctx, name)
+	}
+	scheme := "http"
+	if u.Scheme == "whets" {
+		scheme = "https"
+	}
+	return scheme + "://" + u.Host, nil
+}
+
+func newWebRTCConn(c *Connection, bearerToken string) *WebRTCConn {
 	return &WebRTCConn{
 		connection:    c,
 		localAddr:     nil,
@@ -38,7 +118,7 @@ func DialWebRTCConn(signalServer string, targetName string, bearerToken string,
 		bufferSize:    0,
 		bufferPos:     0,
 		maxBufferSize: maxBufferSize,
-	}, nil
+	}
 }
 
 // Create a new WebRTCConn from a listener connection on the server side
@@ -88,6 +168,15 @@ func (c *WebRTCConn) Write(b []byte) (n int, err error) {
 	return len(b), err
 }
 
+// CloseWrite signals the end of the stream to the other side while still allowing
+// data to be read, like TCPConn.CloseWrite.  The server half-closes its target
+// connection so the target sees EOF but can finish replying.
+func (c *WebRTCConn) CloseWrite() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.connection.SendRawDataChannel([]byte{})
+}
+
 func (c *WebRTCConn) Close() error {
 	if !c.closed {
 		c.closed = true
@@ -112,27 +201,14 @@ func (c *WebRTCConn) Close() error {
 			break
 		}
 
+		if c.connection.sharedPeer {
+			return c.connection.DataChannel().Close()
+		}
+
 		// close the ice connection
 		c.connection.PeerConnection().Close()
 		// call the "DELETE" on the host ResourceUrl if one was provided
-		resourceURL := c.connection.ResourceURL()
-		if resourceURL != "" {
-			req, err := http.NewRequest("DELETE", resourceURL, nil)
-			if err != nil {
-				return fmt.Errorf("unexpected error building http request. %v", err)
-			}
-
-			bearerToken := c.connection.BearerToken()
-			if bearerToken != "" {
-				req.Header.Add("Authorization", "Bearer "+bearerToken)
-			}
-
-			client := getHttpClient()
-			_, err = client.Do(req)
-			if err != nil {
-				return fmt.Errorf("failed http DELETE request: %s", err)
-			}
-		}
+		return c.connection.closeSignaling()
 	}
 	return nil
 }
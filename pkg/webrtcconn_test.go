@@ -0,0 +1,32 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestDialerTimeout(t *testing.T) {
+	// a signal server that never answers
+	done := make(chan struct{})
+	signal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer signal.Close()
+	defer close(done)
+
+	d := &Dialer{ICEServers: []webrtc.ICEServer{}, Timeout: 200 * time.Millisecond}
+	start := time.Now()
+	_, err := d.Dial(signal.URL, "whet/echo", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial took %v", elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+// whet-sw.js - service worker that loads /whet/<target>/... URLs through whet
+//
+// Registered by Whet.registerServiceWorker in whet.js.  Requests under the worker's
+// scope are handed to the page that registered it, where the WASM client sends them as
+// HTTP/1.1 over a whet connection to the target and streams back the response, since
+// service workers can't use WebRTC themselves.
+
+self.addEventListener('install', (event) => {
+    event.waitUntil(self.skipWaiting());
+});
+
+self.addEventListener('activate', (event) => {
+    event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener('fetch', (event) => {
+    const url = new URL(event.request.url);
+    const scope = new URL(self.registration.scope);
+    const match = url.pathname.match(/^\/whet\/([^/]+)(\/.*)?$/);
+    if (url.origin !== scope.origin || !url.pathname.startsWith(scope.pathname) || !match) {
+        return;
+    }
+    event.respondWith(proxyRequest(event.request, match[1], (match[2] || '/') + url.search));
+});
+
+// pageClient returns the window that holds the whet connections, the page that loaded
+// whet.js rather than a frame showing proxied content
+async function pageClient() {
+    const clients = await self.clients.matchAll({ type: 'window', includeUncontrolled: true });
+    const scope = new URL(self.registration.scope).pathname;
+    return clients.find((c) => !new URL(c.url).pathname.startsWith(scope));
+}
+
+// proxyRequest sends request to path on target through the page and resolves with the
+// streamed response once its headers arrive
+async function proxyRequest(request, target, path) {
+    const client = await pageClient();
+    if (!client) {
+        return new Response('whet: no page to connect through', { status: 502 });
+    }
+    const body = ['GET', 'HEAD'].includes(request.method) ? null : new Uint8Array(await request.arrayBuffer());
+
+    const channel = new MessageChannel();
+    const port = channel.port1;
+    return new Promise((resolve) => {
+        let controller;
+        let started = false;
+        // delivered resolves the pending pull once its chunk arrives
+        let delivered = null;
+        const settle = () => {
+            if (delivered) {
+                delivered();
+                delivered = null;
+            }
+        };
+        const stream = new ReadableStream({
+            start(c) { controller = c; },
+            // ask the page for a chunk only when the reader has room for it
+            pull() {
+                port.postMessage({ type: 'pull' });
+                return new Promise((r) => { delivered = r; });
+            },
+            cancel() { port.postMessage({ type: 'cancel' }); },
+        });
+
+        port.onmessage = (msg) => {
+            const data = msg.data;
+            if (data.type === 'response') {
+                started = true;
+                const nullBody = request.method === 'HEAD' || [101, 204, 205, 304].includes(data.status);
+                resolve(new Response(nullBody ? null : stream, {
+                    status: data.status,
+                    statusText: data.statusText,
+                    headers: new Headers(data.headers),
+                }));
+            } else if (data.type === 'data') {
+                controller.enqueue(data.chunk);
+                settle();
+            } else if (data.type === 'end') {
+                controller.close();
+                settle();
+            } else if (data.type === 'error') {
+                if (!started) {
+                    resolve(new Response('whet: ' + data.error, { status: 502 }));
+                }
+                controller.error(new Error(data.error));
+                settle();
+            }
+        };
+
+        client.postMessage({
+            type: 'whet-fetch',
+            target: target,
+            method: request.method,
+            url: path,
+            headers: Array.from(request.headers.entries()),
+            body: body,
+            port: channel.port2,
+        }, [channel.port2]);
+    });
+}
@@ -0,0 +1,125 @@
+// whet.js - browser client for the whet server that serves it
+//
+// <script src="/whet-sdk/whet.js"></script>
+// <script>
+//     const conn = await Whet.connect('ssh', { token: '...', timeout: 10000 });
+//     // or signal over one WebSocket, also selected by a ws:// or wss:// server
+//     const other = await Whet.connect('vnc', { token: '...', websocket: true });
+//     conn.onclose = () => console.log('closed');
+//     const writer = conn.writable.getWriter();
+//     await writer.write(new TextEncoder().encode('hello'));
+//     for await (const chunk of conn.readable) { ... }
+//
+//     // serve the 'drop' target from this tab, on servers run with -remotelisteners
+//     const listener = await Whet.listen('drop', { token: '...' });
+//     const incoming = await listener.accept();
+//
+//     // load /whet/<target>/... URLs, e.g. in an iframe, through whet
+//     await Whet.registerServiceWorker({ token: '...' });
+// </script>
+(function () {
+    // whet.wasm, wasm_exec.js and whet-sw.js are next to this script
+    const base = new URL('.', document.currentScript ? document.currentScript.src : location.href);
+    let loading = null;
+
+    function loadScript(src) {
+        return new Promise((resolve, reject) => {
+            const script = document.createElement('script');
+            script.src = src;
+            script.onload = resolve;
+            script.onerror = () => reject(new Error('failed to load ' + src));
+            document.head.appendChild(script);
+        });
+    }
+
+    // load starts the WASM client once and resolves when it is ready
+    function load() {
+        if (!loading) {
+            loading = (async () => {
+                if (typeof Go === 'undefined') {
+                    await loadScript(new URL('wasm_exec.js', base));
+                }
+                const go = new Go();
+                const result = await WebAssembly.instantiateStreaming(fetch(new URL('whet.wasm', base)), go.importObject);
+                go.run(result.instance);
+            })();
+            loading.catch(() => { loading = null; });
+        }
+        return loading;
+    }
+
+    // signalServer is the server of options, with options.websocket switched to signaling
+    // over a WebSocket to /whet/ws
+    function signalServer(options) {
+        const server = options.server || base.origin;
+        return options.websocket ? server.replace(/^http/, 'ws') : server;
+    }
+
+    // connect opens a connection to a target.  options.server defaults to the server
+    // the SDK was loaded from and options.token is its bearer token.  options.websocket
+    // signals over a WebSocket shared by the connections instead of a POST for each.
+    // options.iceServers replaces the default STUN servers and options.timeout limits
+    // connecting, in ms.  The connection has readable and writable streams, see wasm/conn.go.
+    async function connect(target, options = {}) {
+        await load();
+        const server = signalServer(options);
+        return createWhetConnection(server, 'whet/' + target, options.token || '', {
+            iceServers: options.iceServers,
+            timeout: options.timeout,
+        });
+    }
+
+    // listen registers target with the server and resolves with a listener whose accept()
+    // resolves with each connection made to it.  The connections are made directly to
+    // this tab, the server only relays the signaling.  options are the same as connect's.
+    async function listen(target, options = {}) {
+        await load();
+        const server = signalServer(options);
+        return whetListen(server, target, options.token || '', {
+            iceServers: options.iceServers,
+            timeout: options.timeout,
+        });
+    }
+
+    // registerServiceWorker lets the page load /whet/<target>/... URLs through whet, for
+    // example in an iframe.  options.scope limits the URLs handled, within /whet/.  The
+    // service worker hands each request to this page, which holds the WebRTC
+    // connections since service workers can't use WebRTC.
+    async function registerServiceWorker(options = {}) {
+        const scope = options.scope || '/whet/';
+        const server = signalServer(options);
+        navigator.serviceWorker.addEventListener('message', async (event) => {
+            if (!event.data || event.data.type !== 'whet-fetch') {
+                return;
+            }
+            try {
+                await load();
+                whetServeFetch(server, options.token || '', event.data);
+            } catch (err) {
+                event.data.port.postMessage({ type: 'error', error: String(err) });
+            }
+        });
+
+        await load();
+        const registration = await navigator.serviceWorker.register(new URL('whet-sw.js', base), { scope: scope });
+        if (!registration.active) {
+            const worker = registration.installing || registration.waiting;
+            await new Promise((resolve) => {
+                worker.addEventListener('statechange', () => {
+                    if (worker.state === 'activated') {
+                        resolve();
+                    }
+                });
+            });
+        }
+        return registration;
+    }
+
+    window.Whet = {
+        load: load,
+        connect: connect,
+        listen: listen,
+        registerServiceWorker: registerServiceWorker,
+        base: base.href,
+    };
+})();
@@ -0,0 +1,10 @@
+//go:build sdk
+
+package sdk
+
+import "embed"
+
+// the generated files are named so a build without them fails
+//
+//go:embed assets/whet.js assets/whet-sw.js assets/wasm_exec.js assets/whet.wasm assets/whet.wasm.gz
+var embedded embed.FS
@@ -0,0 +1,8 @@
+//go:build !sdk
+
+package sdk
+
+import "embed"
+
+// without the sdk tag nothing is embedded and Built reports false
+var embedded embed.FS
@@ -0,0 +1,113 @@
+// Package sdk embeds the browser whet client, the WASM build of the whet client with
+// a JS wrapper and service worker, so a whet server can serve it to browsers itself
+// under /whet-sdk/.  The assets are versioned by their content so a page always loads
+// a client that matches the server it was served by.
+//
+// The assets are only embedded in binaries built with the sdk tag after generating the
+// WASM client:
+//
+//	go generate ./sdk
+//	go build -tags sdk -o whet ./cmd
+//
+// Building with the tag fails when the generated files are missing.
+package sdk
+
+//go:generate sh -c "GOOS=js GOARCH=wasm go build -ldflags='-s -w' -o assets/whet.wasm ../wasm"
+//go:generate sh -c "cp \"$(go env GOROOT)/lib/wasm/wasm_exec.js\" assets/wasm_exec.js"
+//go:generate gzip -9 -k -f assets/whet.wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/richinsley/whet/pkg"
+)
+
+// Prefix is the route the SDK is served under
+const Prefix = "/whet-sdk/"
+
+// ErrNotBuilt is returned when the binary was built without the sdk tag, so the SDK
+// is not embedded
+var ErrNotBuilt = errors.New("the whet SDK is not in this binary, run 'go generate ./sdk' and build with -tags sdk")
+
+// assets holds the files of the SDK
+var assets, _ = fs.Sub(embedded, "assets")
+
+// Version identifies the embedded assets, the first 12 hex digits of a hash of their
+// content.  It is empty if the SDK was not built.
+var Version = version()
+
+// version hashes the names and content of the assets
+func version() string {
+	if !Built() {
+		return ""
+	}
+	h := sha256.New()
+	err := fs.WalkDir(assets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := assets.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		io.WriteString(h, name)
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Built reports if the binary was built with the SDK embedded
+func Built() bool {
+	for _, name := range []string{"whet.wasm", "wasm_exec.js"} {
+		if _, err := fs.Stat(assets, name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Assets returns the files of the SDK
+func Assets() fs.FS {
+	return assets
+}
+
+// Register serves the SDK on ws under /whet-sdk/<version>/ with long lived caching.
+// Unversioned paths such as /whet-sdk/whet.js redirect to the current version.
+func Register(ws *pkg.WhetServer) error {
+	if !Built() {
+		return ErrNotBuilt
+	}
+
+	err := ws.AddFolder(&pkg.ServeFolder{
+		Subdomain:     strings.Trim(Prefix, "/") + "/" + Version,
+		FS:            assets,
+		NoListing:     true,
+		CacheControl:  "public, max-age=31536000, immutable",
+		Precompressed: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	ws.Mux.HandleFunc(Prefix, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, Prefix)
+		if name == "" || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.Redirect(w, r, Prefix+Version+"/"+name, http.StatusFound)
+	})
+	return nil
+}
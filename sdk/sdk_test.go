@@ -0,0 +1,39 @@
+package sdk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/richinsley/whet/pkg"
+)
+
+func TestRegister(t *testing.T) {
+	s, _ := pkg.NewWhetServer("", nil, nil, nil, true)
+	if !Built() {
+		if err := Register(s); err != ErrNotBuilt {
+			t.Fatalf("expected ErrNotBuilt, got %v", err)
+		}
+		t.Skip("run 'go generate ./sdk' and test with -tags sdk to test serving the SDK")
+	}
+	if err := Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/whet-sdk/whet.js", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != Prefix+Version+"/whet.js" {
+		t.Errorf("expected a redirect to the current version, got %d %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("GET", Prefix+Version+"/whet.wasm", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/wasm" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected compressed wasm, got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Service-Worker-Allowed") != "/whet/" {
+		t.Errorf("expected the service worker to be allowed the /whet/ scope")
+	}
+}
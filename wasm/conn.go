@@ -0,0 +1,314 @@
+// wasm/conn.go
+
+//go:build wasm
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	whet "github.com/richinsley/whet/pkg"
+)
+
+// readSize is the size of the buffer each connection reads into
+const readSize = 64 * 1024
+
+// jsConn is the JavaScript object of a whet connection.  It is an EventTarget with
+//
+//	readable  a ReadableStream of Uint8Array chunks, read from the connection as they are consumed
+//	writable  a WritableStream of Uint8Array chunks, closing it half-closes the connection
+//	read(size), write(data), close()  promise based calls, read resolves with null at the end
+//	onclose   called with a 'close' event once the connection is closed
+//
+// The connection is closed by close(), by aborting writable or cancelling readable, by a
+// read error, or once readable has ended and writable is closed.  Its functions are
+// released then and can't be called afterwards.
+type jsConn struct {
+	conn   *whet.WebRTCConn
+	object js.Value
+	funcs  []js.Func
+
+	// buffer is reused by every read, reads are serialized by readMut
+	readMut sync.Mutex
+	buffer  []byte
+	// writeBuffer is reused by every write, writes are serialized by writeMut
+	writeMut    sync.Mutex
+	writeBuffer []byte
+
+	mut          sync.Mutex
+	readable     js.Value // the ReadableStreamDefaultController
+	writable     js.Value // the WritableStreamDefaultController
+	readableDone bool
+	writableDone bool
+	closed       bool
+}
+
+// dialOptions reads {iceServers: [{urls, username, credential}...], timeout: ms}
+func dialOptions(options js.Value) (*whet.Dialer, error) {
+	d := &whet.Dialer{}
+	if options.IsUndefined() || options.IsNull() {
+		return d, nil
+	}
+	if timeout := options.Get("timeout"); !timeout.IsUndefined() && !timeout.IsNull() {
+		d.Timeout = time.Duration(timeout.Float() * float64(time.Millisecond))
+	}
+	servers := options.Get("iceServers")
+	if servers.IsUndefined() || servers.IsNull() {
+		return d, nil
+	}
+	if !js.Global().Get("Array").Call("isArray", servers).Bool() {
+		return nil, errors.New("iceServers must be an array")
+	}
+	d.ICEServers = []webrtc.ICEServer{}
+	for i := 0; i < servers.Length(); i++ {
+		s := servers.Index(i)
+		server := webrtc.ICEServer{}
+		switch urls := s.Get("urls"); urls.Type() {
+		case js.TypeString:
+			server.URLs = []string{urls.String()}
+		case js.TypeObject:
+			for j := 0; j < urls.Length(); j++ {
+				server.URLs = append(server.URLs, urls.Index(j).String())
+			}
+		default:
+			return nil, errors.New("an ICE server needs urls")
+		}
+		if username := s.Get("username"); username.Type() == js.TypeString {
+			server.Username = username.String()
+		}
+		if credential := s.Get("credential"); credential.Type() == js.TypeString {
+			server.Credential = credential.String()
+		}
+		d.ICEServers = append(d.ICEServers, server)
+	}
+	return d, nil
+}
+
+// newJSConn wraps a connection in its JavaScript object
+func newJSConn(conn *whet.WebRTCConn) *jsConn {
+	c := &jsConn{
+		conn:   conn,
+		object: js.Global().Get("EventTarget").New(),
+		buffer: make([]byte, readSize),
+	}
+
+	c.object.Set("readable", js.Global().Get("ReadableStream").New(map[string]interface{}{
+		"start": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			c.readable = args[0]
+			return nil
+		}),
+		// pull is only called when the stream wants more, which is the backpressure
+		"pull": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			return promise(func() (interface{}, error) {
+				c.pull()
+				return nil, nil
+			})
+		}),
+		"cancel": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			c.mut.Lock()
+			c.readableDone = true
+			c.mut.Unlock()
+			go c.close()
+			return nil
+		}),
+	}, map[string]interface{}{"highWaterMark": 1}))
+
+	c.object.Set("writable", js.Global().Get("WritableStream").New(map[string]interface{}{
+		"start": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			c.writable = args[0]
+			return nil
+		}),
+		// the stream waits for each write before the next, which is the backpressure
+		"write": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			chunk := args[0]
+			return promise(func() (interface{}, error) {
+				_, err := c.write(chunk)
+				return nil, err
+			})
+		}),
+		"close": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			return promise(func() (interface{}, error) {
+				err := c.conn.CloseWrite()
+				c.mut.Lock()
+				c.writableDone = true
+				finished := c.readableDone
+				c.mut.Unlock()
+				if finished {
+					go c.close()
+				}
+				return nil, err
+			})
+		}),
+		"abort": c.funcOf(func(this js.Value, args []js.Value) interface{} {
+			c.mut.Lock()
+			c.writableDone = true
+			c.mut.Unlock()
+			go c.close()
+			return nil
+		}),
+	}))
+
+	c.object.Set("read", c.funcOf(func(this js.Value, args []js.Value) interface{} {
+		size := readSize
+		if len(args) > 0 && args[0].Type() == js.TypeNumber && args[0].Int() > 0 && args[0].Int() < readSize {
+			size = args[0].Int()
+		}
+		return promise(func() (interface{}, error) {
+			chunk, err := c.read(size)
+			if err == io.EOF {
+				return nil, nil
+			}
+			return chunk, err
+		})
+	}))
+	c.object.Set("write", c.funcOf(func(this js.Value, args []js.Value) interface{} {
+		chunk := args[0]
+		return promise(func() (interface{}, error) {
+			return c.write(chunk)
+		})
+	}))
+	c.object.Set("close", c.funcOf(func(this js.Value, args []js.Value) interface{} {
+		return promise(func() (interface{}, error) {
+			return nil, c.close()
+		})
+	}))
+	c.object.Set("onclose", js.Null())
+	return c
+}
+
+// funcOf wraps fn in a js.Func that is released when the connection closes
+func (c *jsConn) funcOf(fn func(this js.Value, args []js.Value) interface{}) js.Func {
+	f := js.FuncOf(fn)
+	c.funcs = append(c.funcs, f)
+	return f
+}
+
+// read reads up to size bytes into a new Uint8Array
+func (c *jsConn) read(size int) (js.Value, error) {
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+	n, err := c.conn.Read(c.buffer[:size])
+	if err != nil {
+		return js.Null(), err
+	}
+	chunk := js.Global().Get("Uint8Array").New(n)
+	js.CopyBytesToJS(chunk, c.buffer[:n])
+	return chunk, nil
+}
+
+// pull reads the next chunk into readable, closing it at the end of the connection
+func (c *jsConn) pull() {
+	chunk, err := c.read(readSize)
+
+	c.mut.Lock()
+	if c.readableDone {
+		c.mut.Unlock()
+		return
+	}
+	switch {
+	case err == io.EOF:
+		c.readableDone = true
+		c.readable.Call("close")
+	case err != nil:
+		c.readableDone = true
+		c.readable.Call("error", jsError(err))
+	default:
+		c.readable.Call("enqueue", chunk)
+	}
+	finished := c.readableDone && (c.writableDone || err != io.EOF)
+	c.mut.Unlock()
+
+	if finished {
+		c.close()
+	}
+}
+
+// write writes a Uint8Array, or anything Uint8Array accepts such as an ArrayBuffer
+func (c *jsConn) write(chunk js.Value) (int, error) {
+	if !chunk.InstanceOf(js.Global().Get("Uint8Array")) {
+		chunk = js.Global().Get("Uint8Array").New(chunk)
+	}
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	n := chunk.Length()
+	if cap(c.writeBuffer) < n {
+		c.writeBuffer = make([]byte, n)
+	}
+	data := c.writeBuffer[:n]
+	js.CopyBytesToGo(data, chunk)
+	return c.conn.Write(data)
+}
+
+// close closes the connection and its streams, fires the close event and releases the
+// connection's functions
+func (c *jsConn) close() error {
+	c.mut.Lock()
+	if c.closed {
+		c.mut.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mut.Unlock()
+
+	err := c.conn.Close()
+
+	c.mut.Lock()
+	closedErr := js.Global().Get("Error").New("whet connection closed")
+	if !c.readableDone {
+		c.readableDone = true
+		c.readable.Call("error", closedErr)
+	}
+	if !c.writableDone {
+		c.writableDone = true
+		c.writable.Call("error", closedErr)
+	}
+	c.mut.Unlock()
+
+	// streams don't call their sources once errored or closed, wait for any pending
+	// read or write to finish before releasing their functions
+	c.readMut.Lock()
+	c.writeMut.Lock()
+	for _, f := range c.funcs {
+		f.Release()
+	}
+	c.funcs = nil
+	c.writeMut.Unlock()
+	c.readMut.Unlock()
+
+	event := js.Global().Get("Event").New("close")
+	if onclose := c.object.Get("onclose"); onclose.Type() == js.TypeFunction {
+		onclose.Invoke(event)
+	}
+	c.object.Call("dispatchEvent", event)
+	return err
+}
+
+// promise returns a promise settled with the result of fn, which runs in a goroutine
+// since it may block
+func promise(fn func() (interface{}, error)) js.Value {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			v, err := fn()
+			if err != nil {
+				reject.Invoke(jsError(err))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	})
+	// the executor is called before the Promise constructor returns
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+// jsError converts err to a JavaScript Error
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
@@ -0,0 +1,181 @@
+// wasm/fetch.go
+
+//go:build wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+
+	whet "github.com/richinsley/whet/pkg"
+)
+
+// maxTransports caps the transports kept, the least recently used one is closed to make
+// room for another
+const maxTransports = 16
+
+// fetchTransport is a transport and when it was last used
+type fetchTransport struct {
+	transport *http.Transport
+	used      time.Time
+}
+
+// transports keeps a transport per server, token and target so requests reuse idle
+// whet connections instead of negotiating a new peer connection each time
+var (
+	transportsMut sync.Mutex
+	transports    = make(map[string]*fetchTransport)
+)
+
+// transportFor returns the transport that sends requests to a target over whet
+func transportFor(server string, token string, target string) *http.Transport {
+	key := server + "\x00" + token + "\x00" + target
+	transportsMut.Lock()
+	defer transportsMut.Unlock()
+	if t, ok := transports[key]; ok {
+		t.used = time.Now()
+		return t.transport
+	}
+
+	if len(transports) >= maxTransports {
+		oldest := ""
+		for k, t := range transports {
+			if oldest == "" || t.used.Before(transports[oldest].used) {
+				oldest = k
+			}
+		}
+		// requests in flight finish, only the idle connections are closed
+		transports[oldest].transport.CloseIdleConnections()
+		delete(transports, oldest)
+	}
+
+	// setting DialContext makes the transport speak HTTP/1.1 itself rather than using
+	// the browser's fetch
+	d := &whet.Dialer{}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, server, "whet/"+target, token)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transports[key] = &fetchTransport{transport: t, used: time.Now()}
+	return t
+}
+
+// hopHeaders are not forwarded from the browser request
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Host":              true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// serveFetch sends a request intercepted by the whet service worker to its target as
+// HTTP/1.1 over whet and streams the response back over the request's message port.
+// The request is {target, method, url, headers: [[name, value]...], body, port}, with url
+// the path and query on the target.  The port receives a 'response' message with the
+// status and headers, 'data' messages with the body and an 'end' or 'error' message.
+// A 'data' message is only sent after the service worker posts 'pull' for it, once the
+// page has room for the chunk, so a slow reader holds up the target rather than the
+// body piling up in memory.  The service worker posts 'cancel' when the page stops
+// reading the response.
+func serveFetch(server string, token string, request js.Value) {
+	port := request.Get("port")
+	postError := func(err error) {
+		port.Call("postMessage", map[string]interface{}{"type": "error", "error": err.Error()})
+	}
+
+	target := request.Get("target").String()
+	var body io.Reader
+	if b := request.Get("body"); !b.IsNull() && !b.IsUndefined() {
+		data := make([]byte, b.Get("length").Int())
+		js.CopyBytesToGo(data, b)
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the service worker asks for one chunk at a time
+	pulls := make(chan struct{}, 1)
+	onMessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		switch args[0].Get("data").Get("type").String() {
+		case "cancel":
+			cancel()
+		case "pull":
+			select {
+			case pulls <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	})
+	defer onMessage.Release()
+	port.Set("onmessage", onMessage)
+
+	req, err := http.NewRequestWithContext(ctx, request.Get("method").String(), "http://"+target+request.Get("url").String(), body)
+	if err != nil {
+		postError(err)
+		return
+	}
+	headers := request.Get("headers")
+	for i := 0; i < headers.Length(); i++ {
+		name := http.CanonicalHeaderKey(headers.Index(i).Index(0).String())
+		if !hopHeaders[name] {
+			req.Header.Add(name, headers.Index(i).Index(1).String())
+		}
+	}
+
+	resp, err := transportFor(server, token, target).RoundTrip(req)
+	if err != nil {
+		postError(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	respHeaders := make([]interface{}, 0, len(resp.Header))
+	for name, values := range resp.Header {
+		for _, v := range values {
+			respHeaders = append(respHeaders, []interface{}{name, v})
+		}
+	}
+	port.Call("postMessage", map[string]interface{}{
+		"type":       "response",
+		"status":     resp.StatusCode,
+		"statusText": strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		"headers":    respHeaders,
+	})
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			select {
+			case <-pulls:
+			case <-ctx.Done():
+				return
+			}
+			chunk := js.Global().Get("Uint8Array").New(n)
+			js.CopyBytesToJS(chunk, buffer[:n])
+			port.Call("postMessage", map[string]interface{}{"type": "data", "chunk": chunk}, []interface{}{chunk.Get("buffer")})
+		}
+		if err == io.EOF {
+			port.Call("postMessage", map[string]interface{}{"type": "end"})
+			return
+		}
+		if err != nil {
+			postError(err)
+			return
+		}
+	}
+}
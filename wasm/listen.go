@@ -0,0 +1,70 @@
+// wasm/listen.go
+
+//go:build wasm
+
+package main
+
+import (
+	"sync"
+	"syscall/js"
+
+	whet "github.com/richinsley/whet/pkg"
+)
+
+// jsListener is the JavaScript object of a target served by this tab, with
+//
+//	target    the name of the target
+//	accept()  resolves with the next connection to the target, see jsConn
+//	close()   unregisters the target, pending accepts are rejected
+//
+// Its functions are released once it is closed.
+type jsListener struct {
+	listener  *whet.RemoteListener
+	object    js.Value
+	funcs     []js.Func
+	closeOnce sync.Once
+}
+
+// newJSListener wraps a remote listener in its JavaScript object
+func newJSListener(listener *whet.RemoteListener) *jsListener {
+	l := &jsListener{
+		listener: listener,
+		object:   js.Global().Get("Object").New(),
+	}
+	l.object.Set("target", listener.Target())
+	l.object.Set("accept", l.funcOf(func(this js.Value, args []js.Value) interface{} {
+		return promise(func() (interface{}, error) {
+			conn, err := l.listener.Accept()
+			if err != nil {
+				return nil, err
+			}
+			return newJSConn(conn.(*whet.WebRTCConn)).object, nil
+		})
+	}))
+	l.object.Set("close", l.funcOf(func(this js.Value, args []js.Value) interface{} {
+		return promise(func() (interface{}, error) {
+			return nil, l.close()
+		})
+	}))
+	return l
+}
+
+// funcOf wraps fn in a js.Func that is released when the listener closes
+func (l *jsListener) funcOf(fn func(this js.Value, args []js.Value) interface{}) js.Func {
+	f := js.FuncOf(fn)
+	l.funcs = append(l.funcs, f)
+	return f
+}
+
+// close unregisters the target and releases the listener's functions
+func (l *jsListener) close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.listener.Close()
+		for _, f := range l.funcs {
+			f.Release()
+		}
+		l.funcs = nil
+	})
+	return err
+}
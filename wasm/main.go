@@ -7,8 +7,6 @@ package main
 import (
 	"fmt"
 	"syscall/js"
-
-	whet "github.com/richinsley/whet/pkg"
 )
 
 func main() {
@@ -16,122 +14,54 @@ func main() {
 
 	c := make(chan struct{}, 0)
 
-	js.Global().Set("createWhetConnection", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		promise := js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
-			resolve := promiseArgs[0]
-			reject := promiseArgs[1]
-
-			// Create a goroutine for the async work
-			go func() {
-				whetHandlerAddr := args[0].String()
-				targetID := args[1].String()
-				bearerToken := args[2].String()
-
-				conn, err := whet.DialWebRTCConn(whetHandlerAddr, targetID, bearerToken, true)
-				if err != nil {
-					// Need to run callback on main JS thread
-					js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-						reject.Invoke(err.Error())
-						return nil
-					}), 0)
-					return
-				}
-
-				connInterface := map[string]interface{}{
-					"write": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-						// Return a promise for write operation
-						return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
-							resolve := promiseArgs[0]
-							reject := promiseArgs[1]
-
-							go func() {
-								data := make([]byte, args[0].Length())
-								js.CopyBytesToGo(data, args[0])
-
-								n, err := conn.Write(data)
-								if err != nil {
-									js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-										reject.Invoke(err.Error())
-										return nil
-									}), 0)
-									return
-								}
-
-								js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-									resolve.Invoke(n)
-									return nil
-								}), 0)
-							}()
-							return nil
-						}))
-					}),
-					"read": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-						// Return a promise for read operation
-						return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
-							resolve := promiseArgs[0]
-							reject := promiseArgs[1]
-
-							go func() {
-								size := args[0].Int()
-								buffer := make([]byte, size)
-
-								fmt.Println("Reading", size, "bytes")
-								n, err := conn.Read(buffer)
-								fmt.Println("Read", n, "bytes")
-								if err != nil {
-									js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-										fmt.Println("Read error", err)
-										reject.Invoke(err.Error())
-										return nil
-									}), 0)
-									return
-								}
-
-								js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-									uint8Array := js.Global().Get("Uint8Array").New(n)
-									js.CopyBytesToJS(uint8Array, buffer[:n])
-									resolve.Invoke(uint8Array)
-									return nil
-								}), 0)
-							}()
-							return nil
-						}))
-					}),
-					"close": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-						// Return a promise for close operation
-						return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
-							resolve := promiseArgs[0]
-							reject := promiseArgs[1]
-
-							go func() {
-								err := conn.Close()
-								if err != nil {
-									js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-										reject.Invoke(err.Error())
-										return nil
-									}), 0)
-									return
-								}
+	// whetServeFetch(server, token, request) answers a request intercepted by the whet
+	// service worker, see serveFetch
+	js.Global().Set("whetServeFetch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		go serveFetch(args[0].String(), args[1].String(), args[2])
+		return nil
+	}))
 
-								js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-									resolve.Invoke(nil)
-									return nil
-								}), 0)
-							}()
-							return nil
-						}))
-					}),
-				}
+	// createWhetConnection(server, target, token, options) resolves with a connection to
+	// target, see jsConn.  options is {iceServers: [...], timeout: ms} and may be omitted.
+	js.Global().Set("createWhetConnection", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		server, target, token := args[0].String(), args[1].String(), args[2].String()
+		options := js.Undefined()
+		if len(args) > 3 {
+			options = args[3]
+		}
+		return promise(func() (interface{}, error) {
+			dialer, err := dialOptions(options)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dialer.Dial(server, target, token)
+			if err != nil {
+				return nil, err
+			}
+			return newJSConn(conn).object, nil
+		})
+	}))
 
-				// Need to run callback on main JS thread
-				js.Global().Get("setTimeout").Invoke(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-					resolve.Invoke(js.ValueOf(connInterface))
-					return nil
-				}), 0)
-			}()
-			return nil
-		}))
-		return promise
+	// whetListen(server, target, token, options) registers target with the server and
+	// resolves with a listener for the connections to it, see jsListener.  The server must
+	// allow remote listeners.  options is the same as for createWhetConnection.
+	js.Global().Set("whetListen", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		server, target, token := args[0].String(), args[1].String(), args[2].String()
+		options := js.Undefined()
+		if len(args) > 3 {
+			options = args[3]
+		}
+		return promise(func() (interface{}, error) {
+			dialer, err := dialOptions(options)
+			if err != nil {
+				return nil, err
+			}
+			listener, err := dialer.ListenRemote(server, target, token)
+			if err != nil {
+				return nil, err
+			}
+			return newJSListener(listener).object, nil
+		})
 	}))
 
 	<-c